@@ -0,0 +1,200 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DefaultMailAccountID names the account built from the IMAP/SMTP environment variables
+const DefaultMailAccountID = "default"
+
+// ErrNoMailAccount is returned when no clinic account serves a doctor
+var ErrNoMailAccount = errors.New("no mail account configured for this user")
+
+// MailAccount is one clinic's vault mailbox: the IMAP account reports are read
+// from, the SMTP account mail is sent through, and the vault domain patients'
+// addresses live under. Doctors are matched by exact address or by domain.
+type MailAccount struct {
+	ID            string     `json:"id" bson:"_id"`
+	Clinic        string     `json:"clinic" bson:"clinic"`
+	Doctors       []string   `json:"doctors" bson:"doctors"`
+	DoctorDomains []string   `json:"doctor_domains" bson:"doctor_domains"`
+	IMAPServer    string     `json:"imap_server" bson:"imap_server"`
+	IMAPUsername  string     `json:"imap_username" bson:"imap_username"`
+	IMAPPassword  string     `json:"imap_password" bson:"imap_password"`
+	SMTP          SMTPConfig `json:"smtp" bson:"smtp"`
+	Default       bool       `json:"default" bson:"default"` // serves doctors no other account claims
+}
+
+// VaultAddress returns the patient's vault address, e.g. 9876543210@reportsofme.com
+func (a *MailAccount) VaultAddress(mobile string) string {
+	domain := strings.TrimSpace(a.SMTP.Domain)
+	if !strings.HasPrefix(domain, "@") {
+		domain = "@" + domain
+	}
+	return strings.TrimSpace(mobile) + domain
+}
+
+var (
+	mailAccountsMu sync.RWMutex
+	mailAccounts   []*MailAccount
+)
+
+// ✅ Call this in main.go, after InitMongoClient
+func InitMailAccounts() error {
+	var accounts []*MailAccount
+
+	if path := os.Getenv("MAIL_ACCOUNTS_FILE"); path != "" {
+		fromFile, err := loadMailAccountsFile(path)
+		if err != nil {
+			return err
+		}
+		accounts = append(accounts, fromFile...)
+	} else {
+		fromDB, err := loadMailAccountsMongo()
+		if err != nil {
+			return err
+		}
+		accounts = append(accounts, fromDB...)
+	}
+
+	// ✅ The single env-configured mailbox keeps working as the fallback account
+	if envAccount := mailAccountFromEnv(); envAccount != nil {
+		accounts = append(accounts, envAccount)
+	}
+
+	seen := make(map[string]bool)
+	for _, a := range accounts {
+		if a.ID == "" {
+			return errors.New("❌ Mail account without an id")
+		}
+		if seen[a.ID] {
+			return fmt.Errorf("❌ Duplicate mail account id %q", a.ID)
+		}
+		seen[a.ID] = true
+		if a.IMAPServer == "" || a.IMAPUsername == "" || a.IMAPPassword == "" {
+			return fmt.Errorf("❌ Mail account %q is missing IMAP settings", a.ID)
+		}
+		if missing := checkMissingFields(&a.SMTP); missing != "" {
+			return fmt.Errorf("❌ Mail account %q is missing SMTP settings: %s", a.ID, missing)
+		}
+	}
+	if len(accounts) == 0 {
+		return errors.New("❌ No mail accounts configured. Set MAIL_ACCOUNTS_FILE, the MailAccounts collection or EMAIL_USERNAME/EMAIL_PASSWORD")
+	}
+
+	mailAccountsMu.Lock()
+	mailAccounts = accounts
+	mailAccountsMu.Unlock()
+
+	log.Printf("✅ Loaded %d mail account(s)", len(accounts))
+	return nil
+}
+
+func loadMailAccountsFile(path string) ([]*MailAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("❌ Failed to read mail accounts file: %w", err)
+	}
+	var accounts []*MailAccount
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("❌ Invalid mail accounts file %s: %w", path, err)
+	}
+	return accounts, nil
+}
+
+func loadMailAccountsMongo() ([]*MailAccount, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := GetMailAccountCollection().Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("❌ Failed to load mail accounts: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var accounts []*MailAccount
+	if err := cursor.All(ctx, &accounts); err != nil {
+		return nil, fmt.Errorf("❌ Failed to decode mail accounts: %w", err)
+	}
+	return accounts, nil
+}
+
+// mailAccountFromEnv builds the default account from IMAP_SERVER, EMAIL_USERNAME and the SMTP_* variables
+func mailAccountFromEnv() *MailAccount {
+	if os.Getenv("IMAP_SERVER") == "" || os.Getenv("EMAIL_USERNAME") == "" {
+		return nil
+	}
+	smtpConfig, err := LoadSMTPConfig()
+	if err != nil {
+		log.Printf("⚠️ Ignoring env mail account: %v", err)
+		return nil
+	}
+	return &MailAccount{
+		ID:           DefaultMailAccountID,
+		Clinic:       "Default",
+		IMAPServer:   os.Getenv("IMAP_SERVER"),
+		IMAPUsername: os.Getenv("EMAIL_USERNAME"),
+		IMAPPassword: os.Getenv("EMAIL_PASSWORD"),
+		SMTP:         *smtpConfig,
+		Default:      true,
+	}
+}
+
+// MailAccounts returns every configured clinic account
+func MailAccounts() []*MailAccount {
+	mailAccountsMu.RLock()
+	defer mailAccountsMu.RUnlock()
+	return append([]*MailAccount(nil), mailAccounts...)
+}
+
+// MailAccountByID looks an account up by its id
+func MailAccountByID(id string) (*MailAccount, error) {
+	for _, a := range MailAccounts() {
+		if a.ID == id {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoMailAccount, id)
+}
+
+// MailAccountForEmail resolves the clinic account serving a doctor: an exact
+// address match wins over a domain match, which wins over the default account.
+func MailAccountForEmail(email string) (*MailAccount, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	domain := ""
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		domain = email[at+1:]
+	}
+
+	accounts := MailAccounts()
+	for _, a := range accounts {
+		for _, d := range a.Doctors {
+			if strings.EqualFold(strings.TrimSpace(d), email) {
+				return a, nil
+			}
+		}
+	}
+	for _, a := range accounts {
+		for _, d := range a.DoctorDomains {
+			if domain != "" && strings.EqualFold(strings.TrimPrefix(strings.TrimSpace(d), "@"), domain) {
+				return a, nil
+			}
+		}
+	}
+	for _, a := range accounts {
+		if a.Default {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoMailAccount, email)
+}
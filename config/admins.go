@@ -0,0 +1,30 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	adminEmails     map[string]bool
+	adminEmailsOnce sync.Once
+)
+
+// IsAdmin reports whether email is one of the administrators listed in the
+// comma-separated ADMIN_EMAILS variable. Only they may download quarantined
+// attachments.
+func IsAdmin(email string) bool {
+	adminEmailsOnce.Do(func() {
+		adminEmails = make(map[string]bool)
+		for _, addr := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+			if addr = strings.ToLower(strings.TrimSpace(addr)); addr != "" {
+				adminEmails[addr] = true
+			}
+		}
+		log.Printf("✅ %d administrator(s) configured", len(adminEmails))
+	})
+	email = strings.ToLower(strings.TrimSpace(email))
+	return email != "" && adminEmails[email]
+}
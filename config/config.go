@@ -55,6 +55,38 @@ func GetDoctorPatientAccessCollection() *mongo.Collection {
 	return GetDatabase().Collection("RecordAccessRights")
 }
 
+func GetMailIndexCollection() *mongo.Collection {
+	return GetDatabase().Collection("MailIndex")
+}
+
+func GetMailSyncStateCollection() *mongo.Collection {
+	return GetDatabase().Collection("MailSyncState")
+}
+
+func GetMailSearchCollection() *mongo.Collection {
+	return GetDatabase().Collection("MailSearch")
+}
+
+func GetMailIndexMetaCollection() *mongo.Collection {
+	return GetDatabase().Collection("MailIndexMeta")
+}
+
+func GetMailAccountCollection() *mongo.Collection {
+	return GetDatabase().Collection("MailAccounts")
+}
+
+func GetAttachmentCacheCollection() *mongo.Collection {
+	return GetDatabase().Collection("AttachmentCache")
+}
+
+func GetSanitizedBodyCollection() *mongo.Collection {
+	return GetDatabase().Collection("SanitizedBodies")
+}
+
+func GetOutboxCollection() *mongo.Collection {
+	return GetDatabase().Collection("Outbox")
+}
+
 func CloseMongoClient() {
 	if mongoClient != nil {
 		if err := mongoClient.Disconnect(context.Background()); err != nil {
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// DKIMDomain is the DKIM key mail from one domain is signed with. The public
+// key goes in DNS as a TXT record at <selector>._domainkey.<domain>.
+type DKIMDomain struct {
+	Domain         string `json:"domain"`
+	Selector       string `json:"selector"`
+	PrivateKeyPath string `json:"private_key_path"` // PEM, RSA (PKCS#1 or PKCS#8) or Ed25519 (PKCS#8)
+}
+
+// LoadDKIMDomains reads the JSON list of signing domains from DKIM_KEYS_FILE.
+// Without the variable nothing is signed.
+func LoadDKIMDomains() ([]DKIMDomain, error) {
+	path := os.Getenv("DKIM_KEYS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("❌ Failed to read DKIM keys file: %w", err)
+	}
+	var domains []DKIMDomain
+	if err := json.Unmarshal(data, &domains); err != nil {
+		return nil, fmt.Errorf("❌ Invalid DKIM keys file %s: %w", path, err)
+	}
+	for _, d := range domains {
+		if d.Domain == "" || d.Selector == "" || d.PrivateKeyPath == "" {
+			return nil, fmt.Errorf("❌ DKIM keys file %s: domain, selector and private_key_path are required", path)
+		}
+	}
+	return domains, nil
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultMailFolder is the mailbox used when MAIL_FOLDERS is not set
+const DefaultMailFolder = "INBOX"
+
+var (
+	mailFolders     []string
+	mailFoldersOnce sync.Once
+)
+
+// MailFolders returns the mailboxes the document views read from, taken from
+// the comma-separated MAIL_FOLDERS variable (e.g. "INBOX,Lab Reports,Archive").
+// The ArchiveMailbox is always one of them.
+func MailFolders() []string {
+	mailFoldersOnce.Do(func() {
+		seen := make(map[string]bool)
+		for _, name := range strings.Split(os.Getenv("MAIL_FOLDERS"), ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			mailFolders = append(mailFolders, name)
+		}
+		if len(mailFolders) == 0 {
+			mailFolders = []string{DefaultMailFolder}
+			seen[DefaultMailFolder] = true
+		}
+		if archive := ArchiveMailbox(); archive != "" && !seen[archive] {
+			mailFolders = append(mailFolders, archive)
+		}
+		log.Printf("✅ Mail folders: %s", strings.Join(mailFolders, ", "))
+	})
+	return mailFolders
+}
+
+// ArchiveMailbox returns the mailbox generated reports are appended to, from
+// ARCHIVE_MAILBOX, or "" when they only reach the views through the relay
+func ArchiveMailbox() string {
+	return strings.TrimSpace(os.Getenv("ARCHIVE_MAILBOX"))
+}
+
+// IsMailFolder reports whether name is one of the configured folders
+func IsMailFolder(name string) bool {
+	for _, f := range MailFolders() {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
@@ -4,24 +4,24 @@ import (
 	"crypto/tls"
 	"fmt"
 	"log"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/emersion/go-imap/client"
 )
 
-// ConnectIMAP establishes an IMAP connection and tracks execution time
-func ConnectIMAP() (*client.Client, error) {
+// ConnectIMAP establishes an IMAP connection to the account's mailbox and tracks execution time.
+// Services should borrow sessions through AcquireIMAP instead of dialing directly.
+func ConnectIMAP(account *MailAccount) (*client.Client, error) {
 	startTime := time.Now()
 
-	// ✅ Load IMAP configuration from environment variables
-	imapServer := os.Getenv("IMAP_SERVER")
-	username := os.Getenv("EMAIL_USERNAME")
-	password := os.Getenv("EMAIL_PASSWORD")
+	// ✅ Load IMAP configuration from the clinic account
+	imapServer := account.IMAPServer
+	username := account.IMAPUsername
+	password := account.IMAPPassword
 
 	if imapServer == "" || username == "" || password == "" {
-		return nil, fmt.Errorf("❌ Missing IMAP configuration. Check environment variables")
+		return nil, fmt.Errorf("❌ Missing IMAP configuration for account %s", account.ID)
 	}
 
 	parts := strings.Split(imapServer, ":")
@@ -60,16 +60,6 @@ func ConnectIMAP() (*client.Client, error) {
 	}
 	log.Printf("✅ IMAP login successful in %v ms", time.Since(loginStart).Milliseconds())
 
-	// ✅ Keep connection alive with NOOP
-	go func() {
-		for {
-			time.Sleep(40 * time.Minute) // Run every 5 minutes
-			if err := imapClient.Noop(); err != nil {
-				log.Println("⚠️ IMAP NOOP failed, connection might be lost:", err)
-			}
-		}
-	}()
-
 	log.Printf("✅ Total IMAP connection time: %v ms", time.Since(startTime).Milliseconds())
 
 	return imapClient, nil
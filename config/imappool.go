@@ -0,0 +1,289 @@
+package config
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+var (
+	// ErrIMAPPoolClosed is returned by Acquire once the pool has been shut down
+	ErrIMAPPoolClosed = errors.New("IMAP pool is closed")
+
+	// ErrIMAPPoolExhausted is returned by Acquire when every session stayed busy
+	// for imapAcquireWaitDuration; it says nothing about the server's health
+	ErrIMAPPoolExhausted = errors.New("timed out waiting for a free IMAP connection")
+)
+
+const (
+	defaultIMAPPoolSize     = 4
+	imapHealthCheckAfter    = 1 * time.Minute  // NOOP idle clients older than this before handing them out
+	imapKeepAliveInterval   = 10 * time.Minute // background NOOP for idle clients
+	imapMaxIdleClientAge    = 30 * time.Minute // idle clients unused for longer are logged out
+	imapAcquireWaitDuration = 30 * time.Second
+)
+
+type pooledIMAPClient struct {
+	client   *client.Client
+	lastUsed time.Time
+}
+
+// IMAPPool hands out authenticated IMAP clients and keeps a small set of idle
+// sessions alive so services don't pay for a TLS dial and LOGIN on every call.
+type IMAPPool struct {
+	mu     sync.Mutex
+	idle   []*pooledIMAPClient
+	slots  chan struct{} // limits the number of open sessions
+	dial   func() (*client.Client, error)
+	closed bool
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewIMAPPool creates a pool of at most size sessions opened with dial
+func NewIMAPPool(size int, dial func() (*client.Client, error)) *IMAPPool {
+	if size <= 0 {
+		size = defaultIMAPPoolSize
+	}
+	p := &IMAPPool{
+		slots: make(chan struct{}, size),
+		dial:  dial,
+		stop:  make(chan struct{}),
+	}
+
+	p.wg.Add(1)
+	go p.keepAlive()
+
+	return p
+}
+
+// Acquire returns a healthy authenticated client. Callers must hand it back with Release.
+func (p *IMAPPool) Acquire() (*client.Client, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-p.stop:
+		return nil, ErrIMAPPoolClosed
+	case <-time.After(imapAcquireWaitDuration):
+		return nil, ErrIMAPPoolExhausted
+	}
+
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		<-p.slots
+		return nil, ErrIMAPPoolClosed
+	}
+
+	// ✅ Reuse an idle session if one is still healthy
+	for {
+		pc := p.popIdle()
+		if pc == nil {
+			break
+		}
+		if isIMAPClientHealthy(pc) {
+			return pc.client, nil
+		}
+		log.Println("⚠️ Dropping stale IMAP session from pool")
+		logoutQuietly(pc.client)
+	}
+
+	// ✅ Nothing idle: dial a fresh session
+	c, err := p.dial()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// Release returns a client to the pool. Broken sessions are discarded.
+func (p *IMAPPool) Release(c *client.Client) {
+	if c == nil {
+		return
+	}
+	defer func() { <-p.slots }()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || c.State() == imap.LogoutState {
+		go logoutQuietly(c)
+		return
+	}
+	p.idle = append(p.idle, &pooledIMAPClient{client: c, lastUsed: time.Now()})
+}
+
+// Discard logs out a client instead of returning it, e.g. after a protocol error
+func (p *IMAPPool) Discard(c *client.Client) {
+	if c == nil {
+		return
+	}
+	logoutQuietly(c)
+	<-p.slots
+}
+
+// Close stops the keep-alive loop and logs out every idle session
+func (p *IMAPPool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	close(p.stop)
+	p.wg.Wait()
+
+	for _, pc := range idle {
+		logoutQuietly(pc.client)
+	}
+	log.Printf("✅ IMAP pool closed (%d idle sessions logged out)", len(idle))
+}
+
+func (p *IMAPPool) popIdle() *pooledIMAPClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := len(p.idle)
+	if n == 0 {
+		return nil
+	}
+	pc := p.idle[n-1]
+	p.idle = p.idle[:n-1]
+	return pc
+}
+
+// keepAlive NOOPs idle sessions and retires the ones that are too old or broken
+func (p *IMAPPool) keepAlive() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(imapKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		idle := p.idle
+		p.idle = nil
+		p.mu.Unlock()
+
+		var alive []*pooledIMAPClient
+		for _, pc := range idle {
+			if time.Since(pc.lastUsed) > imapMaxIdleClientAge {
+				logoutQuietly(pc.client)
+				continue
+			}
+			if err := pc.client.Noop(); err != nil {
+				log.Println("⚠️ IMAP NOOP failed, dropping pooled session:", err)
+				logoutQuietly(pc.client)
+				continue
+			}
+			alive = append(alive, pc)
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			for _, pc := range alive {
+				logoutQuietly(pc.client)
+			}
+			return
+		}
+		p.idle = append(p.idle, alive...)
+		p.mu.Unlock()
+	}
+}
+
+func isIMAPClientHealthy(pc *pooledIMAPClient) bool {
+	if pc.client.State() == imap.LogoutState {
+		return false
+	}
+	if time.Since(pc.lastUsed) < imapHealthCheckAfter {
+		return true
+	}
+	return pc.client.Noop() == nil
+}
+
+func logoutQuietly(c *client.Client) {
+	if err := c.Logout(); err != nil && c.State() != imap.LogoutState {
+		log.Printf("⚠️ IMAP logout error: %v", err)
+	}
+}
+
+var (
+	imapPoolsMu   sync.Mutex
+	imapPools     = make(map[string]*IMAPPool) // one pool per mail account
+	imapPoolSize  int
+	imapPoolsOnce sync.Once
+)
+
+// ✅ Call this in main.go
+func InitIMAPPool() {
+	imapPoolsOnce.Do(func() {
+		size, err := strconv.Atoi(os.Getenv("IMAP_POOL_SIZE"))
+		if err != nil || size <= 0 {
+			size = defaultIMAPPoolSize
+		}
+		imapPoolSize = size
+		log.Printf("✅ IMAP pools initialized (size %d per account)", size)
+	})
+}
+
+// imapPoolFor returns the account's pool, creating it on first use
+func imapPoolFor(account *MailAccount) *IMAPPool {
+	InitIMAPPool()
+
+	imapPoolsMu.Lock()
+	defer imapPoolsMu.Unlock()
+
+	p, ok := imapPools[account.ID]
+	if !ok {
+		p = NewIMAPPool(imapPoolSize, func() (*client.Client, error) {
+			return ConnectIMAP(account)
+		})
+		imapPools[account.ID] = p
+	}
+	return p
+}
+
+// AcquireIMAP borrows a client from the account's pool
+func AcquireIMAP(account *MailAccount) (*client.Client, error) {
+	return imapPoolFor(account).Acquire()
+}
+
+// ReleaseIMAP hands a client back to the account's pool
+func ReleaseIMAP(account *MailAccount, c *client.Client) {
+	imapPoolFor(account).Release(c)
+}
+
+// DiscardIMAP drops a client that hit a connection-level error
+func DiscardIMAP(account *MailAccount, c *client.Client) {
+	imapPoolFor(account).Discard(c)
+}
+
+// CloseIMAPPool closes every account's pool
+func CloseIMAPPool() {
+	imapPoolsMu.Lock()
+	pools := imapPools
+	imapPools = make(map[string]*IMAPPool)
+	imapPoolsMu.Unlock()
+
+	for _, p := range pools {
+		p.Close()
+	}
+}
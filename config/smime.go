@@ -0,0 +1,39 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// SMIMEIdentity is a certificate reports are S/MIME-signed with: a doctor's
+// own (Address) or the clinic's, used for every sender in Domain
+type SMIMEIdentity struct {
+	Address         string `json:"address,omitempty"`
+	Domain          string `json:"domain,omitempty"`
+	CertificatePath string `json:"certificate_path"` // PEM, signer first, then any intermediates
+	PrivateKeyPath  string `json:"private_key_path"` // PEM, RSA or ECDSA
+}
+
+// LoadSMIMEIdentities reads the JSON list of signing certificates from
+// SMIME_CERTS_FILE. Without the variable reports are not signed.
+func LoadSMIMEIdentities() ([]SMIMEIdentity, error) {
+	path := os.Getenv("SMIME_CERTS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("❌ Failed to read S/MIME certificates file: %w", err)
+	}
+	var identities []SMIMEIdentity
+	if err := json.Unmarshal(data, &identities); err != nil {
+		return nil, fmt.Errorf("❌ Invalid S/MIME certificates file %s: %w", path, err)
+	}
+	for _, id := range identities {
+		if (id.Address == "") == (id.Domain == "") || id.CertificatePath == "" || id.PrivateKeyPath == "" {
+			return nil, fmt.Errorf("❌ S/MIME certificates file %s: each entry needs an address or a domain, certificate_path and private_key_path", path)
+		}
+	}
+	return identities, nil
+}
@@ -13,13 +13,14 @@ import (
 
 // SMTPConfig holds SMTP configuration
 type SMTPConfig struct {
-	From         string
-	Password     string
-	SMTPHost_ALT string
-	SMTPHost     string
-	SMTPPort     string
-	SMTPSecurity string
-	Domain       string
+	From         string `json:"from" bson:"from"`
+	Password     string `json:"password" bson:"password"`
+	SMTPHost_ALT string `json:"host_alt" bson:"host_alt"`
+	SMTPHost     string `json:"host" bson:"host"`
+	SMTPPort     string `json:"port" bson:"port"`
+	SMTPSecurity string `json:"security" bson:"security"`           // "false" skips certificate checks, for InsecureHost only
+	InsecureHost string `json:"insecure_host" bson:"insecure_host"` // the one host SMTP_SECURITY=false applies to
+	Domain       string `json:"domain" bson:"domain"`               // vault domain, e.g. "@reportsofme.com"
 }
 
 var (
@@ -27,7 +28,8 @@ var (
 	once       sync.Once   // Ensures config loads only once
 )
 
-// LoadSMTPConfig loads SMTP environment variables ONCE and caches them
+// LoadSMTPConfig loads SMTP environment variables ONCE and caches them.
+// They make up the default mail account; services send through MailAccount.SMTP.
 func LoadSMTPConfig() (*SMTPConfig, error) {
 	var err error
 	once.Do(func() {
@@ -46,6 +48,7 @@ func LoadSMTPConfig() (*SMTPConfig, error) {
 			SMTPHost:     os.Getenv("SMTP_HOST"),
 			SMTPPort:     os.Getenv("SMTP_PORT"),
 			SMTPSecurity: os.Getenv("SMTP_SECURITY"),
+			InsecureHost: os.Getenv("SMTP_INSECURE_HOST"),
 			Domain:       os.Getenv("DOMAIN"),
 		}
 
@@ -4,10 +4,13 @@ import (
 	"email-client/config"
 	"email-client/models"
 	"email-client/services"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -38,6 +41,12 @@ func GeneratePDF(c *gin.Context) {
 		return
 	}
 
+	// ✅ The report can't be generated without a follow-up date
+	if strings.TrimSpace(request.FollowupDate) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": services.ErrMissingFollowupDate.Error()})
+		return
+	}
+
 	// ✅ Get the logged-in email from Gin context
 	loggedInEmailValue, exists := c.Get("loggedInEmail")
 	if !exists {
@@ -54,8 +63,16 @@ func GeneratePDF(c *gin.Context) {
 	}
 	fromName := fromNameValue.(string)
 
+	// ✅ Resolve the doctor's clinic account
+	account, err := sessionMailAccount(c)
+	if err != nil {
+		log.Printf("❌ No mail account for %s: %v", loggedInEmail, err)
+		c.JSON(http.StatusForbidden, gin.H{"error": "No mail account configured for this user"})
+		return
+	}
+
 	// ✅ Construct recipient email
-	recipientEmail := fmt.Sprintf("%s@reportsofme.com", request.Mobile)
+	recipientEmail := account.VaultAddress(request.Mobile)
 
 	// ✅ Construct OPD data model
 	opdData := models.OpdModel{
@@ -69,25 +86,60 @@ func GeneratePDF(c *gin.Context) {
 	}
 
 	// ✅ Log email generation
-	log.Printf("📧 Generating PDF and sending email from %s (name: %s) to %s", loggedInEmail, fromName, recipientEmail)
-
-	// ✅ Pass "loggedInEmail" as the "From" email
-	err := services.GeneratePDFAndSendEmail(opdData, recipientEmail, loggedInEmail, fromName)
+	log.Printf("📧 Queueing PDF report from %s (name: %s) to %s", loggedInEmail, fromName, recipientEmail)
 
+	// ✅ The outbox workers compile the PDF and send it with "loggedInEmail" as the "From" email
+	job, err := services.EnqueueOPDReport(account, opdData, recipientEmail, loggedInEmail, fromName)
 	if err != nil {
-		log.Println("❌ Error while generating PDF or sending email:", err)
+		log.Println("❌ Error while queueing the report:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "✅ PDF generated and emailed successfully!"})
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "✅ Report queued, it will be emailed shortly",
+		"job_id":  job.ID,
+		"status":  job.Status,
+	})
 }
 
 const (
-	OTPSubject     = "Your OTP Code"
-	SessionUserKey = "user" // Using consistently across controllers
+	OTPSubject        = "Your OTP Code"
+	SessionUserKey    = "user"         // Using consistently across controllers
+	SessionAccountKey = "mail_account" // MailAccount id of the doctor's clinic
 )
 
+var errNotLoggedIn = errors.New("user not logged in")
+
+// sessionMailAccount resolves the logged-in doctor's clinic account. Sessions
+// created before accounts were stored in them fall back to the email lookup.
+func sessionMailAccount(c *gin.Context) (*config.MailAccount, error) {
+	session := sessions.Default(c)
+	if id, ok := session.Get(SessionAccountKey).(string); ok && id != "" {
+		return config.MailAccountByID(id)
+	}
+	loggedInEmail, ok := session.Get(SessionUserKey).(string)
+	if !ok || loggedInEmail == "" {
+		return nil, errNotLoggedIn
+	}
+	return config.MailAccountForEmail(loggedInEmail)
+}
+
+// sessionIsAdmin reports whether the logged-in user is an administrator, see config.IsAdmin
+func sessionIsAdmin(c *gin.Context) bool {
+	loggedInEmail, _ := sessions.Default(c).Get(SessionUserKey).(string)
+	return config.IsAdmin(loggedInEmail)
+}
+
+// sessionMailStore returns the mail store of the logged-in doctor's clinic account
+func sessionMailStore(c *gin.Context) (services.MailStore, error) {
+	account, err := sessionMailAccount(c)
+	if err != nil {
+		return nil, err
+	}
+	return services.MailStoreFor(account)
+}
+
 var emailRegex = regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,}$`)
 var otpStore = sync.Map{}
 
@@ -139,10 +191,20 @@ func GetRecipientsHandler(c *gin.Context) {
 
 	log.Printf("✅ Fetching recipients for user: %s", userEmail)
 
-	// Step 1: Get unique mobile@reportsofme.com list
-	recipients, err := services.GetUniqueRecipients(userEmail.(string))
+	mailStore, err := sessionMailStore(c)
+	if err != nil {
+		log.Printf("❌ No mail account for %s: %v", userEmail, err)
+		c.JSON(http.StatusForbidden, gin.H{"error": "No mail account configured for this user"})
+		return
+	}
+
+	// Step 1: Get unique mobile@<vault domain> list
+	recipients, err := services.GetUniqueRecipients(mailStore, userEmail.(string))
 	if err != nil {
 		log.Println("❌ Error fetching recipients:", err)
+		if respondMailUnavailable(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch emails"})
 		return
 	}
@@ -202,8 +264,29 @@ func LoginHandler(c *gin.Context) {
 				return
 			}
 
+			// 🏥 Resolve the clinic account that serves this doctor
+			account, err := config.MailAccountForEmail(email)
+			if err != nil {
+				data.ErrorMessage = fmt.Sprintf("⚠️ The email '%s' is not registered. Please try again with a registered one.", email)
+				c.HTML(http.StatusOK, "login.html", data)
+				return
+			}
+			mailStore, err := services.MailStoreFor(account)
+			if err != nil {
+				log.Printf("❌ No mail store for account %s: %v", account.ID, err)
+				data.ErrorMessage = "Mailbox unavailable. Please try again later."
+				c.HTML(http.StatusOK, "login.html", data)
+				return
+			}
+
 			// 🔍 Check if email exists in FROM
-			fromName, err := services.FetchFromNameByEmail(email)
+			fromName, err := services.FetchFromNameByEmail(mailStore, email)
+			if setRetryAfter(c, err) {
+				log.Printf("⚠️ Mail server unavailable during login for %s: %v", email, err)
+				data.ErrorMessage = "⚠️ The mail server is temporarily unavailable. Please try again in a moment."
+				c.HTML(http.StatusServiceUnavailable, "login.html", data)
+				return
+			}
 			if err != nil || fromName == "" || fromName == email {
 				data.ErrorMessage = fmt.Sprintf("⚠️ The email '%s' is not registered. Please try again with a registered one.", email)
 				c.HTML(http.StatusOK, "login.html", data)
@@ -222,10 +305,15 @@ func LoginHandler(c *gin.Context) {
 			})
 
 			// 📤 Send OTP
-			if err := services.SendEmail(otp, email, fromName); err != nil {
+			if err := services.SendEmail(account, otp, email, fromName); err != nil {
 				log.Printf("❌ Failed to send OTP to %s: %v", email, err)
 				data.ErrorMessage = "Failed to send OTP. Please try again."
-				c.HTML(http.StatusOK, "login.html", data)
+				status := http.StatusOK
+				if setRetryAfter(c, err) {
+					data.ErrorMessage = "⚠️ The mail server is temporarily unavailable. Please try again in a moment."
+					status = http.StatusServiceUnavailable
+				}
+				c.HTML(status, "login.html", data)
 				return
 			}
 
@@ -268,13 +356,23 @@ func LoginHandler(c *gin.Context) {
 			}
 
 			// 🎉 OTP verified — create session
-			fromName, err := services.FetchFromNameByEmail(email)
-			if err != nil || fromName == "" {
-				fromName = email
+			account, err := config.MailAccountForEmail(email)
+			if err != nil {
+				data.ErrorMessage = "No mail account configured for this user."
+				c.HTML(http.StatusOK, "login.html", data)
+				return
+			}
+
+			fromName := email
+			if mailStore, err := services.MailStoreFor(account); err == nil {
+				if name, err := services.FetchFromNameByEmail(mailStore, email); err == nil && name != "" {
+					fromName = name
+				}
 			}
 
 			session := sessions.Default(c)
 			session.Set(SessionUserKey, email)
+			session.Set(SessionAccountKey, account.ID)
 			session.Set("from_name", fromName)
 			session.Options(sessions.Options{
 				MaxAge:   3000, // 50 min
@@ -421,10 +519,20 @@ func GetEmailIDs(c *gin.Context) {
 	loggedInEmail := userEmail.(string)
 	log.Printf("✅ Fetching recipients for logged-in email: %s", loggedInEmail)
 
+	mailStore, err := sessionMailStore(c)
+	if err != nil {
+		log.Printf("❌ No mail account for %s: %v", loggedInEmail, err)
+		c.JSON(http.StatusForbidden, gin.H{"error": "No mail account configured for this user"})
+		return
+	}
+
 	// Fetch unique recipients
-	recipients, err := services.GetUniqueRecipients(loggedInEmail)
+	recipients, err := services.GetUniqueRecipients(mailStore, loggedInEmail)
 	if err != nil {
 		log.Printf("❌ Failed to fetch recipients: %v", err)
+		if respondMailUnavailable(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -447,6 +555,45 @@ func GetEmailIDs(c *gin.Context) {
 	})
 }
 
+// parseMessageQuery reads page, limit, since and before (YYYY-MM-DD) and
+// group=thread from the query string. A cursor from a previous response replaces them all.
+func parseMessageQuery(c *gin.Context) (services.MessageQuery, error) {
+	if cursor := c.Query("cursor"); cursor != "" {
+		return services.DecodePageCursor(cursor)
+	}
+
+	var query services.MessageQuery
+	var err error
+	if v := c.Query("page"); v != "" {
+		if query.Page, err = strconv.Atoi(v); err != nil || query.Page < 1 {
+			return query, fmt.Errorf("invalid page %q", v)
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if query.Limit, err = strconv.Atoi(v); err != nil || query.Limit < 1 {
+			return query, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	if v := c.Query("since"); v != "" {
+		if query.Since, err = time.Parse("2006-01-02", v); err != nil {
+			return query, fmt.Errorf("invalid since date %q, expected YYYY-MM-DD", v)
+		}
+	}
+	if v := c.Query("before"); v != "" {
+		if query.Before, err = time.Parse("2006-01-02", v); err != nil {
+			return query, fmt.Errorf("invalid before date %q, expected YYYY-MM-DD", v)
+		}
+	}
+	switch v := c.Query("group"); v {
+	case "":
+	case "thread":
+		query.Threads = true
+	default:
+		return query, fmt.Errorf("invalid group %q, expected thread", v)
+	}
+	return query, nil
+}
+
 // EmailHandler handles email fetching and rendering
 // EmailHandler processes email-related requests.
 func EmailHandler(c *gin.Context) {
@@ -463,8 +610,21 @@ func EmailHandler(c *gin.Context) {
 		return
 	}
 
+	mailStore, err := sessionMailStore(c)
+	if err != nil {
+		log.Printf("❌ No mail account for %s: %v", loggedInEmail, err)
+		c.JSON(http.StatusForbidden, gin.H{"error": "No mail account configured for this user"})
+		return
+	}
+
 	selectedRecipient := c.Query("to")
 
+	query, err := parseMessageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// ✅ AJAX Request: JSON return
 	if c.GetHeader("X-Requested-With") == "XMLHttpRequest" {
 		if selectedRecipient == "" {
@@ -481,52 +641,59 @@ func EmailHandler(c *gin.Context) {
 			return
 		}
 
-		var emailList []models.Message
+		var page *services.MessagePage
 
 		if access == "Y" {
 			log.Println("🔓 Access = Y: Fetching full doctor view")
-			emailList, err = services.FetchAllDoctorsOfPatient(selectedRecipient)
+			page, err = services.FetchAllDoctorsOfPatient(mailStore, selectedRecipient, query)
 		} else {
 			log.Printf("🔒 Access not granted or not found (access=%s): Fetching limited view", access)
-			emailList, err = services.FetchEmails(loggedInEmail, selectedRecipient)
+			page, err = services.FetchEmails(mailStore, loggedInEmail, selectedRecipient, query)
 		}
 
 		if err != nil {
 			log.Printf("❌ Error fetching emails: %v", err)
+			if respondMailUnavailable(c, err) {
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch emails"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"emails": emailList})
+		c.JSON(http.StatusOK, page)
 		log.Printf("✅ AJAX EmailHandler completed in %v ms", time.Since(startTime).Milliseconds())
 		return
 	}
 
 	// 🌐 Full page render
-	recipientList, err := services.FetchEmailIDs(loggedInEmail)
+	recipientList, err := services.FetchEmailIDs(mailStore, loggedInEmail)
 	if err != nil {
 		log.Printf("❌ Error fetching recipient list: %v", err)
+		if respondMailUnavailable(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch recipients"})
 		return
 	}
 
-	var emailList []models.Message
+	emailList := []models.Message{}
 	if selectedRecipient != "" {
+		var page *services.MessagePage
 		access, err := services.CheckAccessValue(loggedInEmail, selectedRecipient)
 		if err != nil {
 			log.Printf("⚠️ Access check failed: %v", err)
-			emailList = []models.Message{}
 		} else if access == "Y" {
 			log.Println("🔓 Full page access = Y")
-			emailList, err = services.FetchAllDoctorsOfPatient(selectedRecipient)
+			page, err = services.FetchAllDoctorsOfPatient(mailStore, selectedRecipient, query)
 		} else {
 			log.Println("🔒 Full page access != Y")
-			emailList, err = services.FetchEmails(loggedInEmail, selectedRecipient)
+			page, err = services.FetchEmails(mailStore, loggedInEmail, selectedRecipient, query)
 		}
 
 		if err != nil {
 			log.Printf("❌ Email fetch error: %v", err)
-			emailList = []models.Message{}
+		} else if page != nil {
+			emailList = page.Messages
 		}
 	}
 
@@ -542,50 +709,155 @@ func EmailHandler(c *gin.Context) {
 }
 
 type EmailResponse struct {
-	PlainTextBody string              `json:"plainTextBody"`
-	Attachments   []map[string]string `json:"attachments"`
+	PlainTextBody       string              `json:"plainTextBody"` // sanitized HTML
+	Attachments         []map[string]string `json:"attachments"`
+	RemoteImagesBlocked bool                `json:"remoteImagesBlocked"` // the body has remote images left out
 }
 
-func GetPlainTextEmailBody(c *gin.Context) {
-	startTime := time.Now()
+// requestFolder reads the optional "folder" query parameter, defaulting to INBOX
+func requestFolder(c *gin.Context) (string, bool) {
+	folder := c.DefaultQuery("folder", config.DefaultMailFolder)
+	return folder, config.IsMailFolder(folder)
+}
 
-	uid := c.Query("uid")
-	if uid == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "UID is required"})
-		return
+// requestDocument resolves the "id" query parameter to a folder and UID of store.
+// Links from before document IDs carry a bare UID in legacyParam plus "folder".
+func requestDocument(c *gin.Context, store services.MailStore, legacyParam string) (string, uint32, error) {
+	if id := c.Query("id"); id != "" {
+		return services.ResolveDocument(store, id)
+	}
+
+	uid, err := strconv.ParseUint(c.Query(legacyParam), 10, 32)
+	if err != nil || uid == 0 {
+		return "", 0, services.ErrInvalidDocumentID
+	}
+	folder, ok := requestFolder(c)
+	if !ok {
+		return "", 0, fmt.Errorf("%w: unknown folder %q", services.ErrInvalidDocumentID, folder)
+	}
+	return folder, uint32(uid), nil
+}
+
+// requestAttachmentPart reads the attachment's MIME part path from the "part"
+// parameter, or resolves an attachment name from links made before parts
+func requestAttachmentPart(c *gin.Context, store services.MailStore, folder string, uid uint32, attachmentName string) (string, error) {
+	if part := c.Query("part"); part != "" {
+		return part, nil
+	}
+	return services.ResolveAttachmentPart(store, folder, uid, attachmentName)
+}
+
+// documentQuery repeats how the request addressed its document, for links to its attachments
+func documentQuery(c *gin.Context) url.Values {
+	query := url.Values{}
+	if id := c.Query("id"); id != "" {
+		query.Set("id", id)
+		return query
+	}
+	query.Set("uid", c.Query("uid"))
+	if folder := c.Query("folder"); folder != "" {
+		query.Set("folder", folder)
+	}
+	return query
+}
+
+// documentErrorStatus maps document lookup and fetch errors to an HTTP status.
+// Mail server outages become 503 with a Retry-After header.
+func documentErrorStatus(c *gin.Context, err error) int {
+	switch {
+	case setRetryAfter(c, err):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, services.ErrScannerUnavailable):
+		c.Header("Retry-After", "60")
+		return http.StatusServiceUnavailable
+	case errors.Is(err, services.ErrInvalidDocumentID), errors.Is(err, services.ErrInvalidPart):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrQuarantined):
+		return http.StatusForbidden
+	case errors.Is(err, services.ErrDocumentNotFound), errors.Is(err, services.ErrMessageNotFound),
+		errors.Is(err, services.ErrAttachmentNotFound), errors.Is(err, services.ErrNoPreview),
+		errors.Is(err, services.ErrFrameNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
 	}
+}
 
-	uidInt, err := strconv.ParseUint(uid, 10, 32)
+// setRetryAfter adds a Retry-After header when err is a mail server outage
+func setRetryAfter(c *gin.Context, err error) bool {
+	retryAfter, ok := services.MailRetryAfter(err)
+	if !ok {
+		return false
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	return true
+}
+
+// respondMailUnavailable answers 503 with Retry-After when err is a mail server outage
+func respondMailUnavailable(c *gin.Context, err error) bool {
+	if !setRetryAfter(c, err) {
+		return false
+	}
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":       "Mail server is temporarily unavailable. Please try again shortly.",
+		"retry_after": c.Writer.Header().Get("Retry-After"),
+	})
+	return true
+}
+
+func GetPlainTextEmailBody(c *gin.Context) {
+	startTime := time.Now()
+
+	mailStore, err := sessionMailStore(c)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid UID format: %v", err)})
+		c.JSON(http.StatusForbidden, gin.H{"error": "No mail account configured for this user"})
 		return
 	}
 
-	// ✅ Start IMAP connection and fetch email in one go
-	log.Println("⏳ Connecting to IMAP server...")
-	imapStart := time.Now()
-	imapClient, err := config.ConnectIMAP()
+	folder, uid, err := requestDocument(c, mailStore, "uid")
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to IMAP server"})
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": fmt.Sprintf("Document lookup failed: %v", err)})
 		return
 	}
-	defer imapClient.Logout()
-	log.Printf("✅ IMAP connected in %v ms", time.Since(imapStart).Milliseconds())
 
-	// ✅ Fetch email content (this depends on active IMAP connection)
+	// ✅ Fetch email content from the mail store
 	log.Println("📩 Fetching email content...")
 	fetchStart := time.Now()
-	plainTextBody, attachments, fetchErr := services.FetchPlainTextEmailBody(imapClient, uint32(uidInt))
+	inlineURL := func(contentID string) string {
+		query := documentQuery(c)
+		query.Set("cid", contentID)
+		return "/inline-image?" + query.Encode()
+	}
+	// ✅ Remote images are only kept once the user asked for them
+	remoteImages := c.Query("remoteImages") == "true"
+	email, fetchErr := services.FetchSanitizedEmailBody(mailStore, folder, uid, remoteImages, inlineURL)
 	if fetchErr != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch email content: %v", fetchErr)})
+		c.JSON(documentErrorStatus(c, fetchErr), gin.H{"error": fmt.Sprintf("Failed to fetch email content: %v", fetchErr)})
 		return
 	}
 	log.Printf("✅ Email fetched in %v ms", time.Since(fetchStart).Milliseconds())
 
+	// ✅ Link image, PDF and DICOM attachments to their thumbnail instead of embedding them
+	for _, att := range email.Attachments {
+		if att["quarantined"] == "true" {
+			continue // served to administrators only
+		}
+		query := documentQuery(c)
+		query.Set("part", att["part"])
+		query.Set("attachmentName", att["name"])
+		att["thumbnail"] = "/attachment-preview?" + query.Encode()
+		att["url"] = "/get-attachment?" + query.Encode()
+	}
+
 	// ✅ Send response
 	c.JSON(http.StatusOK, EmailResponse{
-		PlainTextBody: plainTextBody,
-		Attachments:   attachments,
+		PlainTextBody:       email.Body,
+		Attachments:         email.Attachments,
+		RemoteImagesBlocked: email.RemoteImagesBlocked,
 	})
 
 	log.Printf("✅ GetPlainTextEmailBody executed in %v ms", time.Since(startTime).Milliseconds())
@@ -594,70 +866,309 @@ func GetPlainTextEmailBody(c *gin.Context) {
 // GetAttachment handles attachment retrieval via API
 func GetAttachment(c *gin.Context) {
 	// ✅ Read query parameters
-	emailIDStr := c.Query("email_id")
 	attachmentName := c.Query("attachment_name")
-
-	if emailIDStr == "" || attachmentName == "" {
+	if c.Query("part") == "" && attachmentName == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required parameters"})
 		return
 	}
 
-	// ✅ Convert email ID to uint32
-	emailID, err := strconv.ParseUint(emailIDStr, 10, 32)
+	mailStore, err := sessionMailStore(c)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No mail account configured for this user"})
+		return
+	}
+
+	// ✅ Resolve the document ID
+	folder, uid, err := requestDocument(c, mailStore, "email_id")
+	if err != nil {
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": "Document lookup failed: " + err.Error()})
+		return
+	}
+
+	// ✅ Locate and fetch the attachment
+	part, err := requestAttachmentPart(c, mailStore, folder, uid, attachmentName)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email ID format"})
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": "Attachment lookup failed: " + err.Error()})
 		return
 	}
 
-	// ✅ Fetch the attachment
-	attachmentData, filename, err := services.FetchAttachment(uint32(emailID), attachmentName)
+	file, err := openAttachmentForSession(c, mailStore, folder, uid, part)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attachment: " + err.Error()})
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": "Failed to fetch attachment: " + err.Error()})
+		return
+	}
+	defer file.Close()
+
+	if file.Quarantined {
+		serveQuarantinedAttachment(c, file)
 		return
 	}
 
 	// ✅ Return the file as a downloadable response
-	c.Header("Content-Disposition", "attachment; filename=\""+filename+"\"")
-	c.Header("Content-Type", "application/octet-stream")
-	c.Data(http.StatusOK, "application/octet-stream", attachmentData)
+	setUntrustedContentHeaders(c, "attachment", file.Filename, "application/octet-stream")
+	serveAttachment(c, file)
+}
+
+// PreviewAttachmentHandler serves the JPEG thumbnail of an image, PDF or DICOM attachment
+func PreviewAttachmentHandler(c *gin.Context) {
+	attachmentName := c.Query("attachmentName")
+	if c.Query("part") == "" && attachmentName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required parameters"})
+		return
+	}
+
+	mailStore, err := sessionMailStore(c)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No mail account configured for this user"})
+		return
+	}
+
+	folder, uid, err := requestDocument(c, mailStore, "uid")
+	if err != nil {
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": "Document lookup failed: " + err.Error()})
+		return
+	}
+
+	part, err := requestAttachmentPart(c, mailStore, folder, uid, attachmentName)
+	if err != nil {
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": "Attachment lookup failed: " + err.Error()})
+		return
+	}
+
+	file, err := services.OpenPreview(mailStore, folder, uid, part)
+	if err != nil {
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": "Failed to render preview: " + err.Error()})
+		return
+	}
+	defer file.Close()
+
+	c.Header("Content-Type", file.MIMEType)
+	serveAttachment(c, file)
+}
+
+// InlineImageHandler serves an image the HTML body references by cid:
+func InlineImageHandler(c *gin.Context) {
+	contentID := c.Query("cid")
+	if contentID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required parameters"})
+		return
+	}
+
+	mailStore, err := sessionMailStore(c)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No mail account configured for this user"})
+		return
+	}
+
+	folder, uid, err := requestDocument(c, mailStore, "uid")
+	if err != nil {
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": "Document lookup failed: " + err.Error()})
+		return
+	}
+
+	file, err := services.OpenInlineImage(mailStore, folder, uid, contentID)
+	if err != nil {
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": "Failed to fetch inline image: " + err.Error()})
+		return
+	}
+	defer file.Close()
+
+	// ✅ Sender-supplied content: never sniffed into something executable
+	c.Header("Content-Type", file.MIMEType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", untrustedContentCSP)
+	serveAttachment(c, file)
+}
+
+// DICOMInfoHandler returns the patient, study and frame count of a DICOM attachment
+func DICOMInfoHandler(c *gin.Context) {
+	attachmentName := c.Query("attachmentName")
+	if c.Query("part") == "" && attachmentName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required parameters"})
+		return
+	}
+
+	mailStore, err := sessionMailStore(c)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No mail account configured for this user"})
+		return
+	}
+
+	folder, uid, err := requestDocument(c, mailStore, "uid")
+	if err != nil {
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": "Document lookup failed: " + err.Error()})
+		return
+	}
+
+	part, err := requestAttachmentPart(c, mailStore, folder, uid, attachmentName)
+	if err != nil {
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": "Attachment lookup failed: " + err.Error()})
+		return
+	}
+
+	info, err := services.DICOMInfoFor(mailStore, folder, uid, part)
+	if err != nil {
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": "Failed to read DICOM file: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// DICOMFrameHandler serves one frame of a DICOM attachment as a PNG (frame is 0-based)
+func DICOMFrameHandler(c *gin.Context) {
+	attachmentName := c.Query("attachmentName")
+	frame, err := strconv.Atoi(c.DefaultQuery("frame", "0"))
+	if (c.Query("part") == "" && attachmentName == "") || err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing or invalid parameters"})
+		return
+	}
+
+	mailStore, err := sessionMailStore(c)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No mail account configured for this user"})
+		return
+	}
+
+	folder, uid, err := requestDocument(c, mailStore, "uid")
+	if err != nil {
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": "Document lookup failed: " + err.Error()})
+		return
+	}
+
+	part, err := requestAttachmentPart(c, mailStore, folder, uid, attachmentName)
+	if err != nil {
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": "Attachment lookup failed: " + err.Error()})
+		return
+	}
+
+	file, err := services.OpenDICOMFrame(mailStore, folder, uid, part, frame)
+	if err != nil {
+		c.JSON(documentErrorStatus(c, err), gin.H{"error": "Failed to render DICOM frame: " + err.Error()})
+		return
+	}
+	defer file.Close()
+
+	c.Header("Content-Type", file.MIMEType)
+	serveAttachment(c, file)
+}
+
+// serveAttachment streams a cached attachment with Content-Length, answering
+// Range and If-Range requests so viewers can load large files piecewise
+func serveAttachment(c *gin.Context, file *services.AttachmentFile) {
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("Cache-Control", "private, max-age=3600")
+	http.ServeContent(c.Writer, c.Request, file.Filename, file.ModTime, file)
+}
+
+// openAttachmentForSession opens an attachment, including quarantined ones when
+// an administrator asks
+func openAttachmentForSession(c *gin.Context, store services.MailStore, folder string, uid uint32, part string) (*services.AttachmentFile, error) {
+	if sessionIsAdmin(c) {
+		return services.OpenQuarantinedAttachment(store, folder, uid, part)
+	}
+	return services.OpenAttachment(store, folder, uid, part)
+}
+
+// serveQuarantinedAttachment sends an infected file as an opaque download the
+// browser won't display or sniff
+func serveQuarantinedAttachment(c *gin.Context, file *services.AttachmentFile) {
+	loggedInEmail, _ := sessions.Default(c).Get(SessionUserKey).(string)
+	log.Printf("🛡️ Admin %s downloaded quarantined attachment '%s' (%s)", loggedInEmail, file.Filename, file.Threat)
+
+	setUntrustedContentHeaders(c, "attachment", file.Filename+".quarantined", "application/octet-stream")
+	serveAttachment(c, file)
+}
+
+// untrustedContentCSP keeps a sender's file from running script or loading
+// anything should the browser render it as a page. No sandbox directive: it
+// stops Chrome's built-in viewer from showing PDFs.
+const untrustedContentCSP = "default-src 'none'"
+
+// inlineViewableTypes are the attachment types the browser may show in a tab.
+// SVG is an image that can carry script, so it is downloaded like HTML.
+var inlineViewableTypes = map[string]bool{
+	"application/pdf": true,
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/bmp":       true,
+}
+
+// setUntrustedContentHeaders labels a sender-supplied file: its disposition
+// and type, no MIME sniffing, and a CSP that forbids script
+func setUntrustedContentHeaders(c *gin.Context, disposition, filename, contentType string) {
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	c.Header("Content-Type", contentType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", untrustedContentCSP)
 }
 
 // DownloadAttachmentHandler serves attachments for viewing/downloading
 func DownloadAttachmentHandler(c *gin.Context) {
 	// ✅ Read query parameters
-	emailIDStr := c.Query("uid")
 	attachmentName := c.Query("attachmentName")
+	if c.Query("part") == "" && attachmentName == "" {
+		c.Data(http.StatusBadRequest, "text/html", []byte("<h3>Missing required parameters: id and part.</h3>"))
+		return
+	}
 
-	if emailIDStr == "" || attachmentName == "" {
-		c.Data(http.StatusBadRequest, "text/html", []byte("<h3>Missing required parameters: uid and attachmentName.</h3>"))
+	mailStore, err := sessionMailStore(c)
+	if err != nil {
+		c.Data(http.StatusForbidden, "text/html", []byte("<h3>No mail account configured for this user.</h3>"))
 		return
 	}
 
-	// ✅ Convert email ID to uint32
-	emailID, err := strconv.ParseUint(emailIDStr, 10, 32)
+	// ✅ Resolve the document ID
+	folder, uid, err := requestDocument(c, mailStore, "uid")
 	if err != nil {
-		c.Data(http.StatusBadRequest, "text/html", []byte("<h3>Invalid Email ID format.</h3>"))
+		switch status := documentErrorStatus(c, err); status {
+		case http.StatusNotFound:
+			c.Data(status, "text/html", []byte("<h3>This document no longer exists.</h3>"))
+		case http.StatusServiceUnavailable:
+			c.Data(status, "text/html", []byte("<h3>The mail server is temporarily unavailable. Please try again shortly.</h3>"))
+		default:
+			c.Data(status, "text/html", []byte(fmt.Sprintf("<h3>Invalid document link.</h3><p>Error: %v</p>", err)))
+		}
 		return
 	}
 
-	// ✅ Fetch the attachment
-	attachmentData, filename, err := services.FetchAttachment(uint32(emailID), attachmentName)
+	// ✅ Locate and fetch the attachment
+	part, err := requestAttachmentPart(c, mailStore, folder, uid, attachmentName)
 	if err != nil {
-		c.Data(http.StatusInternalServerError, "text/html", []byte(fmt.Sprintf(
+		c.Data(documentErrorStatus(c, err), "text/html", []byte(fmt.Sprintf(
 			"<h3>Attachment not found or failed to load.</h3><p>Error: %v</p>", err)))
 		return
 	}
+	file, err := openAttachmentForSession(c, mailStore, folder, uid, part)
+	if err != nil {
+		switch status := documentErrorStatus(c, err); status {
+		case http.StatusForbidden:
+			c.Data(status, "text/html", []byte("<h3>This attachment was quarantined by the malware scanner.</h3><p>Ask an administrator if you need it.</p>"))
+		case http.StatusServiceUnavailable:
+			c.Data(status, "text/html", []byte("<h3>Attachments can't be checked for malware right now. Please try again shortly.</h3>"))
+		default:
+			c.Data(status, "text/html", []byte(fmt.Sprintf(
+				"<h3>Attachment not found or failed to load.</h3><p>Error: %v</p>", err)))
+		}
+		return
+	}
+	defer file.Close()
 
-	// ✅ Determine MIME type
-	ext := filepath.Ext(filename)
-	mimeType := mime.TypeByExtension(ext)
-	if mimeType == "" {
-		mimeType = http.DetectContentType(attachmentData)
+	// ✅ Quarantined files reach admins only, and only as a download
+	if file.Quarantined {
+		serveQuarantinedAttachment(c, file)
+		return
 	}
 
-	// ✅ Set headers for inline display (view in browser)
-	c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, filename))
-	c.Data(http.StatusOK, mimeType, attachmentData)
+	// ✅ PDFs and images open in the browser; anything else (HTML, SVG, scripts) is only downloaded
+	mediaType, _, _ := mime.ParseMediaType(file.MIMEType)
+	if inlineViewableTypes[strings.ToLower(mediaType)] {
+		setUntrustedContentHeaders(c, "inline", file.Filename, file.MIMEType)
+	} else {
+		setUntrustedContentHeaders(c, "attachment", file.Filename, "application/octet-stream")
+	}
+	serveAttachment(c, file)
 }
 
 // CheckEmailExistsHandler checks if the email pair exists in MongoDB
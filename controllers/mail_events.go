@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"email-client/services"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+const sseHeartbeatInterval = 30 * time.Second
+
+// MailEventsHandler streams reports newly arrived in the doctor's clinic mailbox
+// as Server-Sent Events. Only messages the logged-in doctor sent, or that belong
+// to a patient who granted them access in RecordAccessRights, are forwarded.
+func MailEventsHandler(c *gin.Context) {
+	session := sessions.Default(c)
+	loggedInEmail, ok := session.Get(SessionUserKey).(string)
+	if !ok || loggedInEmail == "" {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	account, err := sessionMailAccount(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	events, unsubscribe := services.SubscribeMailEvents()
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	log.Printf("📡 Mail event stream opened for %s", loggedInEmail)
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			log.Printf("📡 Mail event stream closed for %s", loggedInEmail)
+			return false
+		case <-heartbeat.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		case event, open := <-events:
+			if !open {
+				return false
+			}
+			if event.Account != account.ID {
+				return true // another clinic's mailbox
+			}
+			mobile, visible := eventVisibleTo(loggedInEmail, event)
+			if visible {
+				c.SSEvent("new-report", gin.H{
+					"patient": mobile,
+					"email":   event.Message,
+				})
+			}
+			return true
+		}
+	})
+}
+
+// eventVisibleTo returns the patient mobile the event belongs to and whether the doctor may see it
+func eventVisibleTo(doctorEmail string, event services.MailEvent) (string, bool) {
+	for _, recipient := range event.Recipients {
+		mobile, err := services.ExtractMobileNumber(recipient)
+		if err != nil || len(mobile) != 10 {
+			continue
+		}
+
+		if strings.EqualFold(event.Message.From, doctorEmail) {
+			return mobile, true
+		}
+
+		access, err := services.CheckAccessValue(doctorEmail, mobile)
+		if err != nil {
+			log.Printf("⚠️ Access check failed for event (%s → %s): %v", doctorEmail, mobile, err)
+			continue
+		}
+		if access == "Y" {
+			return mobile, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"email-client/services"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// OutboxListHandler lists the logged-in doctor's queued and sent reports,
+// newest first: /outbox[?status=queued|sending|sent|failed][&limit=]
+func OutboxListHandler(c *gin.Context) {
+	loggedInEmail, ok := sessions.Default(c).Get(SessionUserKey).(string)
+	if !ok || loggedInEmail == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not logged in"})
+		return
+	}
+
+	status := c.Query("status")
+	switch status {
+	case "", services.OutboxQueued, services.OutboxSending, services.OutboxSent, services.OutboxFailed:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown status " + strconv.Quote(status)})
+		return
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+
+	jobs, err := services.ListOutboxJobs(loggedInEmail, status, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": jobs})
+}
+
+// OutboxJobHandler returns the status of one of the doctor's jobs, for polling
+func OutboxJobHandler(c *gin.Context) {
+	loggedInEmail, ok := sessions.Default(c).Get(SessionUserKey).(string)
+	if !ok || loggedInEmail == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not logged in"})
+		return
+	}
+
+	job, err := services.OutboxJobFor(loggedInEmail, c.Param("id"))
+	if err != nil {
+		c.JSON(outboxErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// ResendOutboxJobHandler queues a failed job again
+func ResendOutboxJobHandler(c *gin.Context) {
+	loggedInEmail, ok := sessions.Default(c).Get(SessionUserKey).(string)
+	if !ok || loggedInEmail == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not logged in"})
+		return
+	}
+
+	job, err := services.ResendOutboxJob(loggedInEmail, c.Param("id"))
+	if err != nil {
+		c.JSON(outboxErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, job)
+}
+
+func outboxErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrJobNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrJobNotFailed):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
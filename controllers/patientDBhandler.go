@@ -5,11 +5,11 @@ import (
 	"email-client/config"
 	"email-client/models"
 	"email-client/services"
-	"fmt"
 	"log"
 
 	"net/http"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -56,6 +56,8 @@ func SavePatientHandler(c *gin.Context) {
 		Mobile    string `json:"mobile"`
 		DoctorId  string `json:"doctorId"`
 		HasAccess string `json:"hasAccess"` // "Y" or "N"
+
+		SMIMECertificate string `json:"smimeCertificate"` // optional PEM, reports are encrypted to it
 	}
 
 	if err := c.BindJSON(&input); err != nil {
@@ -78,21 +80,35 @@ func SavePatientHandler(c *gin.Context) {
 		return
 	}
 
+	// ✅ Only store a certificate reports can actually be encrypted to
+	input.SMIMECertificate = strings.TrimSpace(input.SMIMECertificate)
+	if input.SMIMECertificate != "" {
+		if _, err := services.PatientEncryptionCertificate(input.SMIMECertificate); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid S/MIME certificate: " + err.Error()})
+			return
+		}
+	}
+
 	patientCol := config.GetPatientCollection()
 	accessCol := config.GetDoctorPatientAccessCollection()
 
 	// Raw mobile number as PatientId
 	patientId := input.Mobile
-	// ✅ Corrected domain load from config
-	smtpConfig, err := config.LoadSMTPConfig()
+	// ✅ Vault domain comes from the doctor's clinic account
+	account, err := sessionMailAccount(c)
 	if err != nil {
-		log.Printf("❌ Failed to load SMTP config: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to load SMTP config"})
+		log.Printf("❌ Failed to resolve mail account: %v", err)
+		c.JSON(http.StatusForbidden, gin.H{"success": false, "message": "No mail account configured for this user"})
+		return
+	}
+	mailStore, err := services.MailStoreFor(account)
+	if err != nil {
+		log.Printf("❌ Failed to open mail store: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Mailbox unavailable"})
 		return
 	}
-	domain := smtpConfig.Domain
 
-	patientEmailId := fmt.Sprintf("%s%s", patientId, domain)
+	patientEmailId := account.VaultAddress(patientId)
 
 	var message string
 
@@ -114,6 +130,9 @@ func SavePatientHandler(c *gin.Context) {
 			"Mobile":    input.Mobile,
 			"CreatedAt": time.Now(),
 		}
+		if input.SMIMECertificate != "" {
+			newPatient["SMIMECertificate"] = input.SMIMECertificate
+		}
 
 		_, err := patientCol.InsertOne(context.TODO(), newPatient)
 		if err != nil {
@@ -136,6 +155,17 @@ func SavePatientHandler(c *gin.Context) {
 		message = "Patient and access saved"
 	} else {
 		// Existing patient
+		if input.SMIMECertificate != "" && input.SMIMECertificate != existingPatient["SMIMECertificate"] {
+			_, err := patientCol.UpdateOne(context.TODO(), bson.M{"Mobile": input.Mobile}, bson.M{
+				"$set": bson.M{"SMIMECertificate": input.SMIMECertificate},
+			})
+			if err != nil {
+				log.Printf("❌ Failed to update patient certificate: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to update patient certificate"})
+				return
+			}
+		}
+
 		var existingAccess bson.M
 		accessFilter := bson.M{"DoctorId": input.DoctorId, "PatientId": patientId}
 		err = accessCol.FindOne(context.TODO(), accessFilter).Decode(&existingAccess)
@@ -176,13 +206,18 @@ func SavePatientHandler(c *gin.Context) {
 	}
 
 	// Check if email communication exists (using email-like ID)
-	exists, err := services.CheckEmailExists(input.DoctorId, patientEmailId)
+	exists, err := services.CheckEmailExists(mailStore, input.DoctorId, patientEmailId)
 	if err != nil {
 		log.Printf("❌ Error checking email server: %v", err)
+		if setRetryAfter(c, err) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"success": false, "message": "Mail server temporarily unavailable. Please try again shortly."})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Error checking email server"})
 		return
 	} else if !exists {
 		err = services.SendEmailNewPatientRegistration(
+			account,
 			models.PatientDataModel{
 				PatientName: input.Name,
 				Email:       input.Email,
@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"email-client/services"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// SearchHandler runs a full-text search over report subjects, bodies and PDF
+// attachment text: /search?q=HbA1c[&to=<mobile>][&page=&limit=&since=&before=]
+func SearchHandler(c *gin.Context) {
+	startTime := time.Now()
+
+	session := sessions.Default(c)
+	loggedInEmail, ok := session.Get(SessionUserKey).(string)
+	if !ok || loggedInEmail == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not logged in"})
+		return
+	}
+
+	text := strings.TrimSpace(c.Query("q"))
+	if text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Search text is required"})
+		return
+	}
+
+	query, err := parseMessageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	mailStore, err := sessionMailStore(c)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No mail account configured for this user"})
+		return
+	}
+
+	results, err := services.SearchMail(mailStore, services.SearchQuery{
+		Text:    text,
+		Doctor:  loggedInEmail,
+		Patient: strings.TrimSpace(c.Query("to")),
+		Page:    query,
+	})
+	if err != nil {
+		log.Printf("❌ Search for %q failed: %v", text, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+		return
+	}
+
+	log.Printf("🔎 Search %q by %s: %d results in %v ms", text, loggedInEmail, results.Total, time.Since(startTime).Milliseconds())
+	c.JSON(http.StatusOK, results)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"email-client/config"
 	"email-client/routes"
+	"email-client/services"
 	"fmt"
 	"log"
 	"net/http"
@@ -33,6 +34,58 @@ func main() {
 	config.InitMongoClient()
 	defer config.CloseMongoClient()
 
+	// ✅ Load the per-clinic mail accounts
+	if err := config.InitMailAccounts(); err != nil {
+		log.Fatalf("❌ Failed to load mail accounts: %v", err)
+	}
+
+	// ✅ Load the DKIM keys outgoing mail is signed with
+	if err := services.InitDKIMSigners(); err != nil {
+		log.Fatalf("❌ Failed to load DKIM keys: %v", err)
+	}
+	if err := services.InitSMIMEIdentities(); err != nil {
+		log.Fatalf("❌ Failed to load S/MIME certificates: %v", err)
+	}
+
+	// ✅ Initialize pooled IMAP sessions
+	config.InitIMAPPool()
+	defer config.CloseIMAPPool()
+
+	// ✅ Open every account's mail store (imap, maildir or memory)
+	mailStores, err := services.InitMailStores()
+	if err != nil {
+		log.Fatalf("❌ Failed to open mail store: %v", err)
+	}
+
+	// ✅ Keep the on-disk attachment cache within its size limit
+	stopCacheCleanup := services.StartAttachmentCacheCleanup()
+	defer stopCacheCleanup()
+
+	// ✅ Sanitized report bodies are looked up per document and expire after a while
+	if err := services.EnsureSanitizedBodyIndexes(); err != nil {
+		log.Printf("⚠️ Could not create SanitizedBodies indexes: %v", err)
+	}
+
+	// ✅ Send queued reports in the background, retrying while SMTP is down
+	stopOutbox := services.StartOutboxWorkers()
+	defer stopOutbox()
+
+	// ✅ Keep the local mail index in sync with the mailboxes
+	stopIndexSync := services.StartMailIndexSync(mailStores)
+	defer stopIndexSync()
+
+	// ✅ Scan attachments of indexed messages so listings flag infected ones
+	stopAttachmentScanner := services.StartAttachmentScanner(mailStores)
+	defer stopAttachmentScanner()
+
+	// ✅ Watch each INBOX with IMAP IDLE for live report updates
+	for _, store := range mailStores {
+		if _, ok := store.(*services.IMAPStore); ok {
+			stopWatcher := services.StartMailWatcher(store)
+			defer stopWatcher()
+		}
+	}
+
 	// ✅ Setup Gin router
 	router := routes.InitializeRoutes()
 
@@ -5,8 +5,9 @@ import (
 )
 
 type Message struct {
-	ID  string `json:"id"`
-	UID uint32 `json:"uid"`
+	ID     string `json:"id"` // opaque document ID, see services.EncodeDocumentID
+	UID    uint32 `json:"uid"`
+	Folder string `json:"folder"` // mailbox the UID belongs to
 
 	Subject         string   `json:"subject"`
 	From            string   `json:"from"`
@@ -14,6 +15,142 @@ type Message struct {
 	To              string   `json:"to"`
 	Date            string   `json:"date"`
 	AttachmentNames []string `json:"attachment_names"` // ✅ Store attachment names
+
+	MessageID  string   `json:"message_id,omitempty"`
+	InReplyTo  string   `json:"in_reply_to,omitempty"`
+	References []string `json:"references,omitempty"`
+	ThreadID   string   `json:"thread_id,omitempty"` // Message-ID of the conversation's first message
+
+	Attachments []AttachmentInfo `json:"attachments,omitempty"`
+	DICOM       []DICOMInfo      `json:"dicom,omitempty"` // one entry per DICOM attachment
+}
+
+// AttachmentInfo locates one attachment in its message's MIME structure
+type AttachmentInfo struct {
+	Part     string `json:"part" bson:"part"` // IMAP part path, e.g. "2.1"
+	Name     string `json:"name" bson:"name"`
+	MIMEType string `json:"mime_type" bson:"mime_type"`
+	Size     int64  `json:"size" bson:"size"` // decoded bytes; estimated from the encoded size for IMAP
+
+	Quarantined bool   `json:"quarantined,omitempty" bson:"quarantined,omitempty"` // flagged by the malware scanner
+	Threat      string `json:"threat,omitempty" bson:"threat,omitempty"`           // what the scanner found
+}
+
+// DICOMInfo is the listing metadata of one DICOM attachment
+type DICOMInfo struct {
+	Attachment  string `json:"attachment" bson:"attachment"`
+	PatientName string `json:"patient_name" bson:"patient_name"`
+	StudyDate   string `json:"study_date" bson:"study_date"` // YYYY-MM-DD, empty when unknown
+	Modality    string `json:"modality" bson:"modality"`     // e.g. CT, MR, US
+	BodyPart    string `json:"body_part" bson:"body_part"`
+	Frames      int    `json:"frames" bson:"frames"`
+}
+
+// Thread is one conversation of a grouped listing, e.g. a report and its corrections
+type Thread struct {
+	ID         string    `json:"id"`
+	Subject    string    `json:"subject"`     // subject of the earliest message
+	Latest     Message   `json:"latest"`      // most recent message of the thread
+	Messages   []Message `json:"messages"`    // every message of the thread, newest first
+	ReplyCount int       `json:"reply_count"` // messages after the first
+}
+
+// IndexedMessage is the envelope of one mailbox message as stored in the local MailIndex collection
+type IndexedMessage struct {
+	Account         string    `bson:"account"` // MailAccount id
+	Mailbox         string    `bson:"mailbox"`
+	UIDValidity     uint32    `bson:"uid_validity"`
+	UID             uint32    `bson:"uid"`
+	MessageID       string    `bson:"message_id"` // without angle brackets
+	InReplyTo       string    `bson:"in_reply_to"`
+	References      []string  `bson:"references"`
+	ThreadID        string    `bson:"thread_id"` // see services.threadIDFor
+	Subject         string    `bson:"subject"`
+	From            string    `bson:"from"`
+	FromName        string    `bson:"from_name"`
+	To              string    `bson:"to"`
+	Recipients      []string  `bson:"recipients"` // all To addresses, lower-cased
+	Date            time.Time `bson:"date"`
+	AttachmentNames []string  `bson:"attachment_names"`
+	IndexedAt       time.Time `bson:"indexed_at"`
+	IndexVersion    int       `bson:"index_version"`          // see services.mailIndexVersion
+	SearchIndexed   bool      `bson:"search_indexed"`         // body and attachment text are in MailSearch
+	MalwareScan     string    `bson:"malware_scan,omitempty"` // verdict on the attachments, see services.StartAttachmentScanner
+
+	Attachments []AttachmentInfo `bson:"attachments"`
+	DICOM       []DICOMInfo      `bson:"dicom,omitempty"` // filled in by the search pass
+}
+
+// SearchDocument is the full-text entry of one message in the MailSearch collection
+type SearchDocument struct {
+	IndexedMessage `bson:",inline"`
+	Body           string `bson:"body"`            // plain text of the message body
+	AttachmentText string `bson:"attachment_text"` // text of PDF attachments and DICOM metadata
+}
+
+// MailIndexMeta records the MailIndex migrations that have run: one document
+// per account, plus services.legacyMigrationID for the layout before accounts
+type MailIndexMeta struct {
+	ID           string    `bson:"_id"`
+	IndexVersion int       `bson:"index_version"` // see services.mailIndexVersion
+	MigratedAt   time.Time `bson:"migrated_at"`
+}
+
+// MailSyncState tracks how far the MailIndex has caught up with a mailbox
+type MailSyncState struct {
+	Account     string    `bson:"account"`
+	Mailbox     string    `bson:"mailbox"`
+	UIDValidity uint32    `bson:"uid_validity"`
+	UIDNext     uint32    `bson:"uid_next"`
+	SyncedAt    time.Time `bson:"synced_at"`
+}
+
+// CachedAttachment indexes one decoded attachment in the on-disk cache. The
+// file is stored under the SHA-256 of its content, so identical attachments
+// of different messages share it.
+type CachedAttachment struct {
+	Account    string    `bson:"account"`
+	Document   string    `bson:"document"` // document ID of the message, without Message-ID
+	Part       string    `bson:"part"`     // "part:2.1" for attachments, "cid:<Content-ID>" for inline images
+	SHA256     string    `bson:"sha256"`
+	Size       int64     `bson:"size"`
+	Filename   string    `bson:"filename"`
+	MIMEType   string    `bson:"mime_type"`
+	CreatedAt  time.Time `bson:"created_at"`
+	LastAccess time.Time `bson:"last_access"`
+
+	ScannedAt   time.Time `bson:"scanned_at"`       // entries without it predate malware scanning and are fetched again
+	Quarantined bool      `bson:"quarantined"`      // stored under quarantine/, served to admins only
+	Threat      string    `bson:"threat,omitempty"` // signature the scanner reported
+}
+
+// SanitizedBody caches the sanitized HTML of one message, in the SanitizedBodies collection
+type SanitizedBody struct {
+	Document            string              `bson:"document"` // document ID of the message, without Message-ID
+	RemoteImages        bool                `bson:"remote_images"`
+	PolicyVersion       int                 `bson:"policy_version"`
+	Body                string              `bson:"body"`
+	Attachments         []map[string]string `bson:"attachments"`
+	RemoteImagesBlocked bool                `bson:"remote_images_blocked"` // the body referenced remote images that were dropped
+	CreatedAt           time.Time           `bson:"created_at"`
+}
+
+// OutboxJob is one OPD report waiting to be generated and mailed, in the Outbox collection
+type OutboxJob struct {
+	ID          string    `json:"id" bson:"_id"`
+	Account     string    `json:"-" bson:"account"`
+	Doctor      string    `json:"doctor" bson:"doctor"` // logged-in email the report is sent from
+	FromName    string    `json:"-" bson:"from_name"`
+	Recipient   string    `json:"recipient" bson:"recipient"`
+	OPD         OpdModel  `json:"-" bson:"opd"`
+	Status      string    `json:"status" bson:"status"` // queued, sending, sent or failed
+	Attempts    int       `json:"attempts" bson:"attempts"`
+	LastError   string    `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	NextAttempt time.Time `json:"next_attempt" bson:"next_attempt"`
+	LeaseUntil  time.Time `json:"-" bson:"lease_until"` // a worker owns a sending job until then
+	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" bson:"updated_at"`
+	SentAt      time.Time `json:"sent_at" bson:"sent_at"`
 }
 
 // Attachment represents an email attachment
@@ -68,6 +205,8 @@ type PatientDataModel struct {
 	Gender      string `json:"gender" bson:"Gender"`
 	DoctorID    string `json:"doctorId" bson:"DoctorID"`
 	DoctorName  string `json:"doctorName" bson:"DoctorName"`
+
+	SMIMECertificate string `json:"smimeCertificate,omitempty" bson:"SMIMECertificate,omitempty"` // PEM; reports are encrypted to it when set
 }
 
 type RecipientInfo struct {
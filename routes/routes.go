@@ -58,7 +58,16 @@ func InitializeRoutes() *gin.Engine {
 	authRoutes.GET("/get-email-body", controllers.GetPlainTextEmailBody)
 	authRoutes.GET("/attachment", controllers.GetAttachment)
 	authRoutes.GET("/get-attachment", controllers.DownloadAttachmentHandler)
+	authRoutes.GET("/attachment-preview", controllers.PreviewAttachmentHandler)
+	authRoutes.GET("/inline-image", controllers.InlineImageHandler)
+	authRoutes.GET("/dicom-info", controllers.DICOMInfoHandler)
+	authRoutes.GET("/dicom-frame", controllers.DICOMFrameHandler)
 	authRoutes.GET("/attachments/:filename", controllers.AttachmentHandler)
+	authRoutes.GET("/mail-events", controllers.MailEventsHandler)
+	authRoutes.GET("/search", controllers.SearchHandler)
+	authRoutes.GET("/outbox", controllers.OutboxListHandler)
+	authRoutes.GET("/outbox/:id", controllers.OutboxJobHandler)
+	authRoutes.POST("/outbox/:id/resend", controllers.ResendOutboxJobHandler)
 
 	// 🔐 PDF generation route with middleware
 	router.POST("/generate-pdf", middleware.AuthMiddleware(), controllers.GeneratePDF)
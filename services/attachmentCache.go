@@ -0,0 +1,429 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"email-client/config"
+	"email-client/models"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultAttachmentCacheMaxMB    = 1024
+	attachmentCacheCleanupInterval = 1 * time.Hour
+	attachmentSpoolGracePeriod     = 1 * time.Hour // temp files younger than this may belong to a running download
+)
+
+// attachmentCacheMu serializes blob writes, index updates and eviction, so a
+// blob is never removed while a new entry starts pointing at it
+var attachmentCacheMu sync.Mutex
+
+// attachmentCacheDir is where decoded attachments are kept, ATTACHMENT_CACHE_DIR or ./attachments/cache
+func attachmentCacheDir() string {
+	if dir := os.Getenv("ATTACHMENT_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join("attachments", "cache")
+}
+
+// attachmentCacheMaxBytes is the size the cache is evicted down to, ATTACHMENT_CACHE_MAX_MB
+func attachmentCacheMaxBytes() int64 {
+	mb, err := strconv.ParseInt(os.Getenv("ATTACHMENT_CACHE_MAX_MB"), 10, 64)
+	if err != nil || mb <= 0 {
+		mb = defaultAttachmentCacheMaxMB
+	}
+	return mb << 20
+}
+
+// attachmentBlobPath is where the attachment with the given SHA-256 is stored
+func attachmentBlobPath(sum string) string {
+	return filepath.Join(attachmentCacheDir(), "blobs", sum[:2], sum)
+}
+
+// attachmentQuarantinePath is where an infected attachment is kept. Quarantined
+// files are never evicted; they stay until removed by hand.
+func attachmentQuarantinePath(sum string) string {
+	return filepath.Join(attachmentCacheDir(), "quarantine", sum[:2], sum)
+}
+
+func cachedAttachmentPath(entry *models.CachedAttachment) string {
+	if entry.Quarantined {
+		return attachmentQuarantinePath(entry.SHA256)
+	}
+	return attachmentBlobPath(entry.SHA256)
+}
+
+func ensureAttachmentCacheIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := config.GetAttachmentCacheCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "document", Value: 1}, {Key: "part", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "sha256", Value: 1}}},
+		{Keys: bson.D{{Key: "last_access", Value: 1}}},
+	})
+	return err
+}
+
+// lookupCachedAttachment opens the cached copy of a document's attachment and
+// marks it as recently used. Entries cached before malware scanning are
+// treated as missing, so they are fetched and scanned again.
+func lookupCachedAttachment(document, part string) (*AttachmentFile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	col := config.GetAttachmentCacheCollection()
+	key := bson.M{"document": document, "part": part}
+	scanned := bson.M{"document": document, "part": part, "scanned_at": bson.M{"$exists": true}}
+
+	var entry models.CachedAttachment
+	if err := col.FindOneAndUpdate(ctx, scanned, bson.M{"$set": bson.M{"last_access": time.Now()}}).Decode(&entry); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(cachedAttachmentPath(&entry))
+	if err != nil {
+		// ✅ Blob is gone (evicted or deleted by hand): forget the entry and fetch again
+		col.DeleteOne(ctx, key)
+		return nil, err
+	}
+	return attachmentFileFromEntry(f, &entry), nil
+}
+
+// cacheAttachment streams a decoded attachment into a blob named by its
+// SHA-256, scans it for malware, indexes it under the document and part and
+// returns it opened. Infected attachments go to quarantine instead of blobs.
+func cacheAttachment(entry models.CachedAttachment, part *MessagePart) (*AttachmentFile, error) {
+	tmpDir := filepath.Join(attachmentCacheDir(), "tmp")
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create attachment cache: %w", err)
+	}
+	tmp, err := os.CreateTemp(tmpDir, "spool-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), part.Body)
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("error reading attachment body: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write cache file: %w", err)
+	}
+
+	// ✅ Nothing is cached or served before the scanner has seen it
+	scanStart := time.Now()
+	verdict, err := scanFile(tmp.Name())
+	if err != nil {
+		log.Printf("❌ Malware scan of attachment '%s' failed: %v", part.Filename, err)
+		return nil, fmt.Errorf("malware scan failed: %w", err)
+	}
+	if verdict.Infected {
+		log.Printf("🛡️ Attachment '%s' of %s quarantined: %s", part.Filename, entry.Document, verdict.Signature)
+	} else {
+		log.Printf("🛡️ Attachment '%s' scanned clean in %v ms", part.Filename, time.Since(scanStart).Milliseconds())
+	}
+
+	now := time.Now()
+	entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	entry.Size = size
+	entry.Filename = part.Filename
+	entry.MIMEType = attachmentMIMEType(part, tmp.Name())
+	entry.CreatedAt = now
+	entry.LastAccess = now
+	entry.ScannedAt = now
+	entry.Quarantined = verdict.Infected
+	entry.Threat = verdict.Signature
+
+	attachmentCacheMu.Lock()
+	defer attachmentCacheMu.Unlock()
+
+	// ✅ Identical content is stored once
+	blob := cachedAttachmentPath(&entry)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(blob), os.ModePerm); err != nil {
+			return nil, fmt.Errorf("failed to create attachment cache: %w", err)
+		}
+		if err := os.Rename(tmp.Name(), blob); err != nil {
+			return nil, fmt.Errorf("failed to store cached attachment: %w", err)
+		}
+	}
+
+	// Open before evicting: an attachment larger than the whole cache is still served once
+	f, err := os.Open(blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cached attachment: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err = config.GetAttachmentCacheCollection().ReplaceOne(ctx,
+		bson.M{"document": entry.Document, "part": entry.Part},
+		entry,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		log.Printf("⚠️ Failed to index cached attachment %s: %v", entry.Filename, err)
+	} else if err := evictAttachmentCache(ctx); err != nil {
+		log.Printf("⚠️ Attachment cache eviction failed: %v", err)
+	}
+
+	return attachmentFileFromEntry(f, &entry), nil
+}
+
+func attachmentFileFromEntry(f *os.File, entry *models.CachedAttachment) *AttachmentFile {
+	return &AttachmentFile{
+		File:     f,
+		Filename: entry.Filename,
+		MIMEType: entry.MIMEType,
+		SHA256:   entry.SHA256,
+		Size:     entry.Size,
+		ModTime:  entry.CreatedAt,
+
+		Quarantined: entry.Quarantined,
+		Threat:      entry.Threat,
+	}
+}
+
+// attachmentCacheSize sums the size of every distinct blob, quarantine aside.
+// Callers must hold attachmentCacheMu.
+func attachmentCacheSize(ctx context.Context) (int64, error) {
+	cursor, err := config.GetAttachmentCacheCollection().Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"quarantined": bson.M{"$ne": true}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$sha256", "size": bson.M{"$first": "$size"}}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$size"}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var result []struct {
+		Total int64 `bson:"total"`
+	}
+	if err := cursor.All(ctx, &result); err != nil {
+		return 0, err
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return result[0].Total, nil
+}
+
+// evictAttachmentCache drops least recently used entries, and the blobs no
+// entry uses any more, until the cache fits in its maximum size. Callers must
+// hold attachmentCacheMu.
+func evictAttachmentCache(ctx context.Context) error {
+	total, err := attachmentCacheSize(ctx)
+	if err != nil {
+		return err
+	}
+	limit := attachmentCacheMaxBytes()
+	if total <= limit {
+		return nil
+	}
+
+	col := config.GetAttachmentCacheCollection()
+	cursor, err := col.Find(ctx,
+		bson.M{"quarantined": bson.M{"$ne": true}},
+		options.Find().SetSort(bson.D{{Key: "last_access", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	evicted := 0
+	for total > limit && cursor.Next(ctx) {
+		var entry models.CachedAttachment
+		if err := cursor.Decode(&entry); err != nil {
+			return err
+		}
+		if _, err := col.DeleteOne(ctx, bson.M{"document": entry.Document, "part": entry.Part}); err != nil {
+			return err
+		}
+		evicted++
+
+		shared, err := col.CountDocuments(ctx, bson.M{"sha256": entry.SHA256, "quarantined": bson.M{"$ne": true}})
+		if err != nil {
+			return err
+		}
+		if shared == 0 {
+			removeAttachmentBlob(entry.SHA256)
+			total -= entry.Size
+		}
+	}
+
+	log.Printf("🧹 Evicted %d cached attachment(s), cache now %d MB of %d MB", evicted, total>>20, limit>>20)
+	return cursor.Err()
+}
+
+// removeAttachmentBlob deletes a cached attachment and its preview. Callers must hold attachmentCacheMu.
+func removeAttachmentBlob(sum string) {
+	if err := os.Remove(attachmentBlobPath(sum)); err != nil && !os.IsNotExist(err) {
+		log.Printf("⚠️ Failed to remove cached attachment %s: %v", sum, err)
+	}
+	// ✅ Thumbnail and rendered DICOM frames
+	previews, _ := filepath.Glob(filepath.Join(attachmentCacheDir(), "previews", sum[:2], sum+"-*"))
+	for _, path := range previews {
+		os.Remove(path)
+	}
+}
+
+// StartAttachmentCacheCleanup runs CleanAttachmentCache now and then every
+// hour until the returned stop function is called
+func StartAttachmentCacheCleanup() (stop func()) {
+	if err := ensureAttachmentCacheIndexes(); err != nil {
+		log.Printf("⚠️ Could not create AttachmentCache indexes: %v", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(attachmentCacheCleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := CleanAttachmentCache(); err != nil {
+				log.Printf("❌ Attachment cache cleanup failed: %v", err)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	log.Printf("✅ Attachment cache cleanup started (every %v, max %d MB)", attachmentCacheCleanupInterval, attachmentCacheMaxBytes()>>20)
+	return func() {
+		close(done)
+		wg.Wait()
+		log.Println("✅ Attachment cache cleanup stopped")
+	}
+}
+
+// CleanAttachmentCache brings the index and the files on disk back in line:
+// entries whose blob is missing are dropped, blobs, quarantined files and
+// previews no entry points at are deleted, abandoned temp files are removed,
+// and the cache is evicted down to its maximum size.
+func CleanAttachmentCache() error {
+	attachmentCacheMu.Lock()
+	defer attachmentCacheMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	// ✅ Entries whose blob was lost
+	known, err := knownAttachmentSums(ctx, false)
+	if err != nil {
+		return err
+	}
+	quarantined, err := knownAttachmentSums(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	root := attachmentCacheDir()
+	removed := 0
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		switch parent := filepath.Dir(filepath.Dir(path)); {
+		case filepath.Base(filepath.Dir(path)) == "tmp":
+			// ✅ Spool files left behind by a crash
+			if info, err := d.Info(); err != nil || time.Since(info.ModTime()) < attachmentSpoolGracePeriod {
+				return nil
+			}
+		case parent == filepath.Join(root, "blobs"):
+			if known[d.Name()] {
+				return nil
+			}
+		case parent == filepath.Join(root, "quarantine"):
+			if quarantined[d.Name()] {
+				return nil
+			}
+		case parent == filepath.Join(root, "previews"):
+			if sum, _, _ := strings.Cut(d.Name(), "-"); known[sum] {
+				return nil
+			}
+		}
+		// ✅ Orphaned blobs and previews, and files from before the content-addressed layout
+		if err := os.Remove(path); err == nil {
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan attachment cache: %w", err)
+	}
+	if removed > 0 {
+		log.Printf("🧹 Removed %d stale file(s) from the attachment cache", removed)
+	}
+
+	return evictAttachmentCache(ctx)
+}
+
+// knownAttachmentSums returns the SHA-256 of every cached (or quarantined)
+// file that is still on disk, dropping the entries of files that are not.
+// Callers must hold attachmentCacheMu.
+func knownAttachmentSums(ctx context.Context, quarantined bool) (map[string]bool, error) {
+	filter := bson.M{"quarantined": bson.M{"$ne": true}}
+	if quarantined {
+		filter = bson.M{"quarantined": true}
+	}
+
+	col := config.GetAttachmentCacheCollection()
+	sums, err := col.Distinct(ctx, "sha256", filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cached attachments: %w", err)
+	}
+
+	known := make(map[string]bool, len(sums))
+	for _, v := range sums {
+		sum, ok := v.(string)
+		if !ok || sum == "" {
+			continue
+		}
+		entry := models.CachedAttachment{SHA256: sum, Quarantined: quarantined}
+		if _, err := os.Stat(cachedAttachmentPath(&entry)); os.IsNotExist(err) {
+			filter["sha256"] = sum
+			col.DeleteMany(ctx, filter)
+			continue
+		}
+		known[sum] = true
+	}
+	return known, nil
+}
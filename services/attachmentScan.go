@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"email-client/config"
+	"email-client/models"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Verdicts stored in IndexedMessage.MalwareScan
+const (
+	malwareScanClean    = "clean"
+	malwareScanInfected = "infected"
+	malwareScanFailed   = "failed" // unreadable parts; they are scanned again when opened
+)
+
+const (
+	defaultAttachmentScanInterval = 2 * time.Minute
+	attachmentScanBatch           = 50
+	attachmentScanBudget          = 1 * time.Minute // per tick and account
+)
+
+// StartAttachmentScanner scans the attachments of newly indexed messages in the
+// background, so listings can flag infected ones before anyone opens them. It
+// runs apart from the index sync: while the scanner is down, listings and
+// search keep working and the scan catches up once it is back.
+func StartAttachmentScanner(stores []MailStore) (stop func()) {
+	interval := defaultAttachmentScanInterval
+	if v, err := time.ParseDuration(os.Getenv("ATTACHMENT_SCAN_INTERVAL")); err == nil && v > 0 {
+		interval = v
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			for _, store := range stores {
+				err := ScanAttachmentBacklog(store)
+				if errors.Is(err, ErrScannerUnavailable) {
+					log.Printf("⚠️ Attachment scan for account %s paused, scanner unavailable: %v", store.Account().ID, err)
+					break // the scanner is shared, the other accounts would fail too
+				}
+				if err != nil {
+					log.Printf("❌ Attachment scan for account %s failed: %v", store.Account().ID, err)
+				}
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	log.Printf("✅ Attachment scanner started (every %v)", interval)
+	return func() {
+		close(done)
+		wg.Wait()
+		log.Println("✅ Attachment scanner stopped")
+	}
+}
+
+// ScanAttachmentBacklog scans the messages with attachments that are in the
+// MailIndex but haven't been scanned yet, newest first
+func ScanAttachmentBacklog(store MailStore) error {
+	account := store.Account().ID
+	deadline := time.Now().Add(attachmentScanBudget)
+	scanned := 0
+
+	for time.Now().Before(deadline) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		docs, err := pendingScanDocs(ctx, account)
+		if err != nil {
+			cancel()
+			return err
+		}
+		if len(docs) == 0 {
+			cancel()
+			break
+		}
+
+		for _, doc := range docs {
+			if err := scanIndexedMessage(ctx, store, doc); err != nil {
+				cancel()
+				return err
+			}
+			scanned++
+		}
+		cancel()
+	}
+
+	if scanned > 0 {
+		log.Printf("🛡️ Attachment scan: %d messages scanned for account %s", scanned, account)
+	}
+	return nil
+}
+
+func pendingScanDocs(ctx context.Context, account string) ([]models.IndexedMessage, error) {
+	cursor, err := config.GetMailIndexCollection().Find(ctx,
+		bson.M{
+			"account":       account,
+			"mailbox":       bson.M{"$in": config.MailFolders()},
+			"attachments.0": bson.M{"$exists": true},
+			"malware_scan":  bson.M{"$in": bson.A{nil, ""}},
+		},
+		options.Find().SetSort(bson.D{{Key: "date", Value: -1}}).SetLimit(attachmentScanBatch),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list unscanned messages: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var docs []models.IndexedMessage
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to decode unscanned messages: %w", err)
+	}
+	return docs, nil
+}
+
+// scanIndexedMessage scans one message's attachments and records the verdict.
+// A clean message goes back to the search indexer so its attachment text,
+// which is only extracted from clean attachments, becomes searchable.
+func scanIndexedMessage(ctx context.Context, store MailStore, doc models.IndexedMessage) error {
+	key := bson.M{"account": doc.Account, "mailbox": doc.Mailbox, "uid_validity": doc.UIDValidity, "uid": doc.UID}
+
+	set := bson.M{"malware_scan": malwareScanFailed}
+	raw, err := store.FetchRaw(doc.Mailbox, doc.UID)
+	switch {
+	case errors.Is(err, ErrMessageNotFound):
+		log.Printf("⚠️ Message %s/%d vanished before it could be scanned", doc.Mailbox, doc.UID)
+	case err != nil:
+		return fmt.Errorf("failed to fetch message %d: %w", doc.UID, err)
+	default:
+		infected, scanErr := scanMessageAttachments(raw)
+		switch {
+		case errors.Is(scanErr, ErrScannerUnavailable):
+			return scanErr // retried next tick
+		case scanErr != nil:
+			log.Printf("⚠️ Malware scan of message %s/%d failed, its attachments are scanned when opened: %v", doc.Mailbox, doc.UID, scanErr)
+		case len(infected) > 0:
+			log.Printf("🛡️ Message %s/%d has %d infected attachment(s)", doc.Mailbox, doc.UID, len(infected))
+			flagAttachmentThreats(doc.Attachments, infected)
+			set["attachments"] = doc.Attachments
+			set["malware_scan"] = malwareScanInfected
+			set["search_indexed"] = false // MailSearch carries the flags too
+		default:
+			set["malware_scan"] = malwareScanClean
+			set["search_indexed"] = false
+		}
+	}
+
+	if _, err := config.GetMailIndexCollection().UpdateOne(ctx, key, bson.M{"$set": set}); err != nil {
+		return err
+	}
+
+	// ✅ The cached body still lists the infected attachments as they were before the scan
+	if set["malware_scan"] == malwareScanInfected {
+		document := EncodeDocumentID(DocumentRef{Account: doc.Account, Mailbox: doc.Mailbox, UIDValidity: doc.UIDValidity, UID: doc.UID})
+		if err := dropSanitizedBodies(ctx, document); err != nil {
+			log.Printf("⚠️ Could not drop the cached body of %s/%d: %v", doc.Mailbox, doc.UID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/charset"
+)
+
+// fallbackCharset is assumed for 8-bit text that declares no charset. Lab
+// systems on Windows write windows-1252, which is also a superset of the
+// printable ISO-8859-1 range.
+const fallbackCharset = "windows-1252"
+
+var headerWordDecoder = &mime.WordDecoder{CharsetReader: charset.Reader}
+
+var metaCharsetPattern = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([-\w.:]+)`)
+
+func init() {
+	// ✅ Encoded words in IMAP envelopes and BODYSTRUCTURE; importing the
+	// charset package already does the same for go-message
+	imap.CharsetReader = charset.Reader
+}
+
+// decodeHeaderText turns a header value into UTF-8: RFC 2047 encoded words in
+// any charset are decoded, and raw 8-bit text is read as fallbackCharset.
+// Values that can't be decoded are returned as they are.
+func decodeHeaderText(s string) string {
+	if strings.Contains(s, "=?") {
+		if decoded, err := headerWordDecoder.DecodeHeader(s); err == nil {
+			s = decoded
+		}
+	}
+	if !utf8.ValidString(s) {
+		s = decodeCharset(fallbackCharset, []byte(s))
+	}
+	return strings.TrimSpace(s)
+}
+
+// decodeCharset converts text in the named charset to UTF-8
+func decodeCharset(name string, data []byte) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || name == "utf-8" || name == "utf8" || name == "us-ascii" {
+		if utf8.Valid(data) {
+			return string(data)
+		}
+		name = fallbackCharset
+	}
+
+	r, err := charset.Reader(name, bytes.NewReader(data))
+	if err != nil {
+		if name != fallbackCharset {
+			return decodeCharset(fallbackCharset, data)
+		}
+		return strings.ToValidUTF8(string(data), "�")
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return strings.ToValidUTF8(string(data), "�")
+	}
+	return string(decoded)
+}
+
+// decodeBodyText makes sure a text part is UTF-8. go-message already converts
+// parts that declare a charset; this handles the ones that don't, using an HTML
+// <meta> charset when there is one.
+func decodeBodyText(data []byte) string {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	name := fallbackCharset
+	if m := metaCharsetPattern.FindSubmatch(data); m != nil {
+		name = string(m[1])
+	}
+	return decodeCharset(name, data)
+}
+
+// partFilename returns the file name of a MIME part from the raw
+// Content-Disposition filename or, failing that, the Content-Type name
+// parameter, decoded to UTF-8
+func partFilename(contentDisposition, contentType string) string {
+	if name := decodedParam(rawMIMEParams(contentDisposition), "filename"); name != "" {
+		return name
+	}
+	return decodedParam(rawMIMEParams(contentType), "name")
+}
+
+// rawMIMEParams splits the parameters of a header like Content-Type without
+// decoding them; keys are lower-cased. mime.ParseMediaType would drop RFC 2231
+// values in charsets other than UTF-8, which is why this exists.
+func rawMIMEParams(header string) map[string]string {
+	params := make(map[string]string)
+	_, rest, found := strings.Cut(header, ";")
+	for found {
+		var param string
+		param, rest, found = cutParam(rest)
+		key, value, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`)
+		}
+		if key != "" {
+			params[key] = value
+		}
+	}
+	return params
+}
+
+// cutParam returns the text before the next ';' outside quotes
+func cutParam(s string) (param, rest string, found bool) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				return s[:i], s[i+1:], true
+			}
+		}
+	}
+	return s, "", s != ""
+}
+
+// decodedParam returns parameter name from raw params, joining RFC 2231
+// continuations (name*0*, name*1, ...), decoding RFC 2231 extended values in
+// their declared charset and RFC 2047 encoded words in plain ones
+func decodedParam(params map[string]string, name string) string {
+	if len(params) == 0 {
+		return ""
+	}
+	lower := make(map[string]string, len(params))
+	for k, v := range params {
+		lower[strings.ToLower(k)] = v
+	}
+
+	if v, ok := lower[name+"*"]; ok {
+		charsetName, value := splitExtendedValue(v)
+		return strings.TrimSpace(decodeCharset(charsetName, percentDecode(value)))
+	}
+
+	_, extended := lower[name+"*0*"]
+	if _, plain := lower[name+"*0"]; extended || plain {
+		var buf bytes.Buffer
+		charsetName := ""
+		for i := 0; ; i++ {
+			key := name + "*" + strconv.Itoa(i)
+			if v, ok := lower[key+"*"]; ok {
+				if i == 0 {
+					charsetName, v = splitExtendedValue(v)
+				}
+				buf.Write(percentDecode(v))
+			} else if v, ok := lower[key]; ok {
+				buf.WriteString(v)
+			} else {
+				break
+			}
+		}
+		if charsetName == "" {
+			return decodeHeaderText(buf.String())
+		}
+		return strings.TrimSpace(decodeCharset(charsetName, buf.Bytes()))
+	}
+
+	return decodeHeaderText(lower[name])
+}
+
+// splitExtendedValue splits an RFC 2231 value charset'language'text
+func splitExtendedValue(v string) (string, string) {
+	parts := strings.SplitN(v, "'", 3)
+	if len(parts) != 3 {
+		return "", v
+	}
+	return parts[0], parts[2]
+}
+
+func percentDecode(s string) []byte {
+	if decoded, err := url.PathUnescape(s); err == nil {
+		return []byte(decoded)
+	}
+	return []byte(s)
+}
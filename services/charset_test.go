@@ -0,0 +1,74 @@
+package services
+
+import "testing"
+
+func TestDecodeHeaderText(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain ascii", "OPD report", "OPD report"},
+		{"utf-8 base64 word", "=?UTF-8?B?UmFwcG9ydCDDqWNobw==?=", "Rapport écho"},
+		{"iso-8859-1 q word", "=?ISO-8859-1?Q?R=E9sultat_h=E9matologie?=", "Résultat hématologie"},
+		{"windows-1252 q word", "=?windows-1252?Q?=93HbA1c=94?=", "“HbA1c”"},
+		{"adjacent words join", "=?UTF-8?Q?Rapport_?= =?UTF-8?Q?=C3=A9cho?=", "Rapport écho"},
+		{"word between text", "Re: =?UTF-8?B?w6ljaG8=?= 12/03", "Re: écho 12/03"},
+		{"raw latin-1 bytes", "R\xe9sultat", "Résultat"},
+		{"unknown charset kept", "=?x-unknown?Q?abc?=", "=?x-unknown?Q?abc?="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeHeaderText(tt.in); got != tt.want {
+				t.Errorf("decodeHeaderText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeBodyText(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"utf-8 untouched", "Dose: 5 µg", "Dose: 5 µg"},
+		{"undeclared latin-1", "Dose: 5 \xb5g", "Dose: 5 µg"},
+		{"html meta charset", `<meta charset="iso-8859-7"><p>` + "\xe1\xe9\xec\xe1</p>", `<meta charset="iso-8859-7"><p>αιμα</p>`},
+		{"http-equiv meta charset", `<meta http-equiv="Content-Type" content="text/html; charset=koi8-r">` + "\xd4\xc5\xd3\xd4", `<meta http-equiv="Content-Type" content="text/html; charset=koi8-r">тест`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeBodyText([]byte(tt.in)); got != tt.want {
+				t.Errorf("decodeBodyText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartFilename(t *testing.T) {
+	tests := []struct {
+		name               string
+		contentDisposition string
+		contentType        string
+		want               string
+	}{
+		{"quoted filename", `attachment; filename="OPD report.pdf"`, "application/pdf", "OPD report.pdf"},
+		{"falls back to name", "attachment", `application/pdf; name="scan.pdf"`, "scan.pdf"},
+		{"rfc 2231 utf-8", `attachment; filename*=UTF-8''%C3%A9chographie.pdf`, "", "échographie.pdf"},
+		{"rfc 2231 latin-1", `attachment; filename*=iso-8859-1'fr'r%E9sultat.pdf`, "", "résultat.pdf"},
+		{"rfc 2231 continuations", `attachment; filename*0*=UTF-8''%C3%A9cho; filename*1="_2024"; filename*2=".pdf"`, "", "écho_2024.pdf"},
+		{"plain continuations", `attachment; filename*0="long_"; filename*1="name.pdf"`, "", "long_name.pdf"},
+		{"rfc 2047 in a quoted name", "attachment", `application/pdf; name="=?UTF-8?B?w6ljaG8ucGRm?="`, "écho.pdf"},
+		{"semicolon inside quotes", `attachment; filename="a;b.pdf"; size=10`, "", "a;b.pdf"},
+		{"upper-case parameter", `attachment; FILENAME="X-ray.dcm"`, "", "X-ray.dcm"},
+		{"none", "inline", "text/plain", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := partFilename(tt.contentDisposition, tt.contentType); got != tt.want {
+				t.Errorf("partFilename(%q, %q) = %q, want %q", tt.contentDisposition, tt.contentType, got, tt.want)
+			}
+		})
+	}
+}
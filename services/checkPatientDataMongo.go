@@ -21,9 +21,9 @@ import (
 // GetEnrichedRecipients returns recipient list with name or fallback to mobile
 
 // GetEnrichedRecipients returns a list of RecipientInfo with names fetched from MongoDB
-func GetEnrichedRecipients(loggedInEmail string) ([]models.RecipientInfo, error) {
+func GetEnrichedRecipients(store MailStore, loggedInEmail string) ([]models.RecipientInfo, error) {
 	// Fetch the raw list of unique recipient emails
-	rawEmails, err := GetUniqueRecipients(loggedInEmail)
+	rawEmails, err := GetUniqueRecipients(store, loggedInEmail)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch unique recipients: %w", err)
 	}
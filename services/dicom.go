@@ -0,0 +1,404 @@
+package services
+
+import (
+	"bytes"
+	"email-client/models"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/frame"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+const (
+	dicomMaxSize   = 200 << 20 // larger DICOM attachments are listed without metadata
+	dicomMaxFrames = 500       // frames rendered per file; the rest of a long cine loop is skipped
+)
+
+// ErrFrameNotFound is returned for a frame index past the end of the DICOM file
+var ErrFrameNotFound = errors.New("DICOM frame not found")
+
+// dicomRenderMu serialises frame rendering: decoding a multi-frame file takes a lot of memory
+var dicomRenderMu sync.Mutex
+
+// isDICOM tells DICOM attachments apart by name or Content-Type
+func isDICOM(mimeType, filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return strings.EqualFold(mimeType, "application/dicom") || ext == ".dcm" || ext == ".dicom"
+}
+
+// hasDICOMPreamble checks for the "DICM" magic that follows the 128-byte preamble
+func hasDICOMPreamble(head []byte) bool {
+	return len(head) >= 132 && string(head[128:132]) == "DICM"
+}
+
+// parseDICOMInfo reads the listing metadata of a DICOM file without decoding its pixel data
+func parseDICOMInfo(r io.Reader, size int64, attachment string) (*models.DICOMInfo, error) {
+	dataset, err := dicom.Parse(r, size, nil, dicom.SkipPixelData())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DICOM: %w", err)
+	}
+
+	info := &models.DICOMInfo{
+		Attachment:  attachment,
+		PatientName: formatPersonName(dicomString(&dataset, tag.PatientName)),
+		StudyDate:   formatDICOMDate(dicomString(&dataset, tag.StudyDate)),
+		Modality:    dicomString(&dataset, tag.Modality),
+		BodyPart:    dicomString(&dataset, tag.BodyPartExamined),
+		Frames:      1,
+	}
+	if n, err := strconv.Atoi(dicomString(&dataset, tag.NumberOfFrames)); err == nil && n > 0 {
+		info.Frames = n
+	}
+	return info, nil
+}
+
+// DICOMInfoFor returns the metadata of a DICOM attachment
+func DICOMInfoFor(store MailStore, folder string, emailUID uint32, part string) (*models.DICOMInfo, error) {
+	src, err := OpenAttachment(store, folder, emailUID, part)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	if src.MIMEType != "application/dicom" {
+		return nil, fmt.Errorf("%w: %s is not a DICOM file", ErrNoPreview, src.Filename)
+	}
+	return parseDICOMInfo(src, src.Size, src.Filename)
+}
+
+// OpenDICOMFrame returns one frame of a DICOM attachment as a PNG. The first
+// request decodes the file once and stores every frame in the attachment
+// cache next to the thumbnails. Callers must close the file.
+func OpenDICOMFrame(store MailStore, folder string, emailUID uint32, part string, index int) (*AttachmentFile, error) {
+	src, err := OpenAttachment(store, folder, emailUID, part)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	if src.MIMEType != "application/dicom" {
+		return nil, fmt.Errorf("%w: %s is not a DICOM file", ErrNoPreview, src.Filename)
+	}
+	if index < 0 || index >= dicomMaxFrames {
+		return nil, fmt.Errorf("%w: %d", ErrFrameNotFound, index)
+	}
+
+	path := dicomFramePath(src.SHA256, index)
+	if file, err := openDICOMFrameFile(path, src.Filename, index); err == nil {
+		return file, nil
+	}
+
+	dicomRenderMu.Lock()
+	defer dicomRenderMu.Unlock()
+
+	// ✅ Another request may have rendered the file while this one waited
+	if file, err := openDICOMFrameFile(path, src.Filename, index); err == nil {
+		return file, nil
+	}
+
+	startTime := time.Now()
+	frames, err := renderDICOMFrames(src.File.Name(), dicomMaxFrames)
+	if err != nil {
+		log.Printf("⚠️ Rendering DICOM '%s' failed: %v", src.Filename, err)
+		return nil, fmt.Errorf("%w: %v", ErrNoPreview, err)
+	}
+	for i, img := range frames {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, fmt.Errorf("failed to encode frame %d: %w", i, err)
+		}
+		if err := writeFileAtomic(dicomFramePath(src.SHA256, i), buf.Bytes()); err != nil {
+			return nil, fmt.Errorf("failed to store frame %d: %w", i, err)
+		}
+	}
+	log.Printf("🖼️ DICOM '%s': %d frames rendered in %v ms", src.Filename, len(frames), time.Since(startTime).Milliseconds())
+
+	if index >= len(frames) {
+		return nil, fmt.Errorf("%w: %d of %d", ErrFrameNotFound, index, len(frames))
+	}
+	return openDICOMFrameFile(path, src.Filename, index)
+}
+
+// dicomFramePath is where a rendered frame of the attachment with the given SHA-256 is stored
+func dicomFramePath(sum string, index int) string {
+	return filepath.Join(attachmentCacheDir(), "previews", sum[:2], sum+"-frame-"+strconv.Itoa(index)+".png")
+}
+
+func openDICOMFrameFile(path, filename string, index int) (*AttachmentFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &AttachmentFile{
+		File:     f,
+		Filename: fmt.Sprintf("%s-frame-%d.png", strings.TrimSuffix(filename, filepath.Ext(filename)), index+1),
+		MIMEType: "image/png",
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	}, nil
+}
+
+// renderDICOMPreview turns the first frame into a thumbnail for the attachment list
+func renderDICOMPreview(path string) ([]byte, error) {
+	dicomRenderMu.Lock()
+	frames, err := renderDICOMFrames(path, 1)
+	dicomRenderMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return encodeThumbnail(frames[0])
+}
+
+// renderDICOMFrames decodes up to limit frames of a DICOM file into 8-bit images.
+// The parser keeps every frame it decodes, so frames are taken off its frame
+// channel as they come and reading stops once limit of them are in: a preview
+// doesn't decode a whole cine loop.
+func renderDICOMFrames(path string, limit int) ([]image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > dicomMaxSize {
+		return nil, fmt.Errorf("DICOM file is larger than %d MB", dicomMaxSize>>20)
+	}
+
+	// ✅ Read the display settings and frame count first, without the pixel data
+	dataset, err := dicom.Parse(f, info.Size(), nil, dicom.SkipPixelData())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DICOM: %w", err)
+	}
+	if _, err := dataset.FindElementByTag(tag.PixelData); err != nil {
+		return nil, errors.New("DICOM file has no pixel data")
+	}
+	if n, err := strconv.Atoi(dicomString(&dataset, tag.NumberOfFrames)); err == nil && n > limit && limit > 1 {
+		log.Printf("⚠️ DICOM has %d frames, only the first %d are rendered", n, limit)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	src := &stoppableReader{r: f}
+	frames := make(chan *frame.Frame)
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("DICOM parser panicked: %v", r)
+			}
+		}()
+		_, err := dicom.Parse(src, info.Size(), frames)
+		done <- err
+	}()
+
+	w := dicomWindowFor(&dataset)
+	var images []image.Image
+	var renderErr error
+	for {
+		select {
+		case fr, ok := <-frames:
+			if !ok {
+				frames = nil // closed after the last frame; the result follows on done
+				continue
+			}
+			if src.stopped.Load() {
+				continue
+			}
+			img, err := renderDICOMFrame(fr, w, len(images))
+			if err != nil {
+				renderErr = err
+				src.stopped.Store(true)
+				continue
+			}
+			if images = append(images, img); len(images) >= limit {
+				src.stopped.Store(true)
+			}
+		case err := <-done:
+			// ✅ Frames are sent before Parse returns, so none are left on the channel
+			switch {
+			case renderErr != nil:
+				return nil, renderErr
+			case err != nil && !errors.Is(err, errDICOMReadStopped):
+				return nil, fmt.Errorf("failed to parse DICOM: %w", err)
+			case len(images) == 0:
+				return nil, errors.New("DICOM file has no frames")
+			}
+			return images, nil
+		}
+	}
+}
+
+// renderDICOMFrame turns frame i into an 8-bit image
+func renderDICOMFrame(fr *frame.Frame, w dicomWindow, i int) (image.Image, error) {
+	if fr.IsEncapsulated() {
+		// ✅ Only baseline JPEG decodes here; JPEG 2000 and JPEG-LS files can't be shown
+		img, err := fr.GetImage()
+		if err != nil {
+			return nil, fmt.Errorf("unsupported compressed frame %d: %w", i, err)
+		}
+		return img, nil
+	}
+	native, err := fr.GetNativeFrame()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read frame %d: %w", i, err)
+	}
+	img, err := w.render(native)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render frame %d: %w", i, err)
+	}
+	return img, nil
+}
+
+// errDICOMReadStopped ends a parse once the frames needed are in
+var errDICOMReadStopped = errors.New("DICOM read stopped")
+
+// stoppableReader fails every read once stopped is set
+type stoppableReader struct {
+	r       io.Reader
+	stopped atomic.Bool
+}
+
+func (s *stoppableReader) Read(p []byte) (int, error) {
+	if s.stopped.Load() {
+		return 0, errDICOMReadStopped
+	}
+	return s.r.Read(p)
+}
+
+// dicomWindow maps stored pixel values to display grey levels
+type dicomWindow struct {
+	slope, intercept float64 // Rescale Slope/Intercept, e.g. to Hounsfield units
+	center, width    float64 // from the file; width 0 means stretch each frame's min..max
+	invert           bool    // MONOCHROME1: low values are white
+}
+
+func dicomWindowFor(dataset *dicom.Dataset) dicomWindow {
+	w := dicomWindow{slope: 1}
+	if v, err := strconv.ParseFloat(dicomString(dataset, tag.RescaleSlope), 64); err == nil && v != 0 {
+		w.slope = v
+	}
+	if v, err := strconv.ParseFloat(dicomString(dataset, tag.RescaleIntercept), 64); err == nil {
+		w.intercept = v
+	}
+	center, errC := strconv.ParseFloat(dicomString(dataset, tag.WindowCenter), 64)
+	width, errW := strconv.ParseFloat(dicomString(dataset, tag.WindowWidth), 64)
+	if errC == nil && errW == nil && width > 1 {
+		w.center, w.width = center, width
+	}
+	w.invert = dicomString(dataset, tag.PhotometricInterpretation) == "MONOCHROME1"
+	return w
+}
+
+func (w dicomWindow) render(native *frame.NativeFrame) (image.Image, error) {
+	if native.Rows <= 0 || native.Cols <= 0 {
+		return nil, fmt.Errorf("invalid frame size %dx%d", native.Cols, native.Rows)
+	}
+	rect := image.Rect(0, 0, native.Cols, native.Rows)
+	if len(native.Data) > 0 && len(native.Data[0]) >= 3 {
+		// ✅ RGB ultrasound and photos are already display values
+		img := image.NewRGBA(rect)
+		for i, px := range native.Data {
+			img.Set(i%native.Cols, i/native.Cols, color.RGBA{clampByte(px[0]), clampByte(px[1]), clampByte(px[2]), 255})
+		}
+		return img, nil
+	}
+
+	low, high := w.center-w.width/2, w.center+w.width/2
+	if w.width == 0 {
+		low, high = math.Inf(1), math.Inf(-1)
+		for _, px := range native.Data {
+			v := float64(px[0])*w.slope + w.intercept
+			low, high = math.Min(low, v), math.Max(high, v)
+		}
+	}
+
+	img := image.NewGray(rect)
+	for i, px := range native.Data {
+		if i >= len(img.Pix) {
+			break
+		}
+		v := float64(px[0])*w.slope + w.intercept
+		grey := 0.0
+		if high > low {
+			grey = (v - low) / (high - low) * 255
+		}
+		g := clampByte(int(math.Round(grey)))
+		if w.invert {
+			g = 255 - g
+		}
+		img.Pix[i] = g
+	}
+	return img, nil
+}
+
+func clampByte(v int) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+// dicomString returns the first value of a string element, or "" when it is missing
+func dicomString(dataset *dicom.Dataset, t tag.Tag) string {
+	el, err := dataset.FindElementByTag(t)
+	if err != nil {
+		return ""
+	}
+	values, ok := el.Value.GetValue().([]string)
+	if !ok || len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(strings.Trim(values[0], "\x00"))
+}
+
+// formatPersonName turns a DICOM name "Family^Given^Middle^Prefix^Suffix" into "Prefix Given Middle Family Suffix"
+func formatPersonName(name string) string {
+	name, _, _ = strings.Cut(name, "=") // drop ideographic and phonetic representations
+	parts := strings.Split(name, "^")
+	for len(parts) < 5 {
+		parts = append(parts, "")
+	}
+	var ordered []string
+	for _, p := range []string{parts[3], parts[1], parts[2], parts[0], parts[4]} {
+		if p = strings.TrimSpace(p); p != "" {
+			ordered = append(ordered, p)
+		}
+	}
+	return strings.Join(ordered, " ")
+}
+
+// formatDICOMDate turns a DICOM DA value (YYYYMMDD) into YYYY-MM-DD
+func formatDICOMDate(value string) string {
+	t, err := time.Parse("20060102", value)
+	if err != nil {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/frame"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// writeTestDICOM writes an 8-bit greyscale file of the given size
+func writeTestDICOM(t *testing.T, rows, cols, frames int) string {
+	t.Helper()
+	pixels := testPixelData(rows, cols, frames)
+	var elements []*dicom.Element
+	for _, e := range []struct {
+		tag   tag.Tag
+		value interface{}
+	}{
+		{tag.MediaStorageSOPClassUID, []string{"1.2.840.10008.5.1.4.1.1.7"}},
+		{tag.MediaStorageSOPInstanceUID, []string{"1.2.3.4"}},
+		{tag.TransferSyntaxUID, []string{"1.2.840.10008.1.2.1"}},
+		{tag.Modality, []string{"OT"}},
+		{tag.SamplesPerPixel, []int{1}},
+		{tag.PhotometricInterpretation, []string{"MONOCHROME2"}},
+		{tag.NumberOfFrames, []string{strconv.Itoa(frames)}},
+		{tag.Rows, []int{rows}},
+		{tag.Columns, []int{cols}},
+		{tag.BitsAllocated, []int{8}},
+		{tag.BitsStored, []int{8}},
+		{tag.HighBit, []int{7}},
+		{tag.PixelRepresentation, []int{0}},
+		{tag.PixelData, pixels},
+	} {
+		el, err := dicom.NewElement(e.tag, e.value)
+		if err != nil {
+			t.Fatalf("NewElement(%v): %v", e.tag, err)
+		}
+		elements = append(elements, el)
+	}
+
+	path := filepath.Join(t.TempDir(), "test.dcm")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := dicom.Write(f, dicom.Dataset{Elements: elements}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return path
+}
+
+// testPixelData fills frame n with the value n
+func testPixelData(rows, cols, frames int) dicom.PixelDataInfo {
+	var info dicom.PixelDataInfo
+	for n := 0; n < frames; n++ {
+		data := make([][]int, rows*cols)
+		for i := range data {
+			data[i] = []int{n}
+		}
+		info.Frames = append(info.Frames, &frame.Frame{NativeData: frame.NativeFrame{BitsPerSample: 8, Rows: rows, Cols: cols, Data: data}})
+	}
+	return info
+}
+
+func TestRenderDICOMFrames(t *testing.T) {
+	path := writeTestDICOM(t, 4, 3, 5)
+
+	tests := []struct {
+		name  string
+		limit int
+		want  int
+	}{
+		{"preview renders the first frame", 1, 1},
+		{"stops at the limit", 3, 3},
+		{"limit past the end", 10, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames, err := renderDICOMFrames(path, tt.limit)
+			if err != nil {
+				t.Fatalf("renderDICOMFrames: %v", err)
+			}
+			if len(frames) != tt.want {
+				t.Fatalf("got %d frames, want %d", len(frames), tt.want)
+			}
+			if b := frames[0].Bounds(); b.Dx() != 3 || b.Dy() != 4 {
+				t.Errorf("frame size = %v, want 3x4", b)
+			}
+		})
+	}
+}
+
+func TestRenderDICOMFramesRejects(t *testing.T) {
+	notDICOM := filepath.Join(t.TempDir(), "note.dcm")
+	if err := os.WriteFile(notDICOM, []byte("not a DICOM file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tooLarge := filepath.Join(t.TempDir(), "large.dcm")
+	if err := os.WriteFile(tooLarge, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(tooLarge, dicomMaxSize+1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{notDICOM, tooLarge} {
+		if _, err := renderDICOMFrames(path, 1); err == nil {
+			t.Errorf("renderDICOMFrames(%s) succeeded", filepath.Base(path))
+		}
+	}
+}
+
+func TestDICOMWindowRenderInvalidSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		rows, cols int
+	}{
+		{"no columns", 2, 0},
+		{"no rows", 0, 2},
+		{"negative", -1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			native := &frame.NativeFrame{Rows: tt.rows, Cols: tt.cols, Data: [][]int{{1, 2, 3}, {4, 5, 6}}}
+			if _, err := (dicomWindow{slope: 1}).render(native); err == nil {
+				t.Error("render succeeded")
+			}
+		})
+	}
+}
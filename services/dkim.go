@@ -0,0 +1,163 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"email-client/config"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// dkimSignedHeaders are signed when present; From is always signed
+var dkimSignedHeaders = []string{
+	"From", "Sender", "To", "Cc", "Subject", "Date", "Message-Id",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// dkimSigner signs mail for one domain
+type dkimSigner struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+}
+
+var (
+	dkimSignersMu sync.RWMutex
+	dkimSigners   map[string]*dkimSigner // by lower-case domain
+)
+
+// ✅ Call this in main.go; without DKIM_KEYS_FILE outgoing mail is not signed
+func InitDKIMSigners() error {
+	domains, err := config.LoadDKIMDomains()
+	if err != nil {
+		return err
+	}
+
+	signers := make(map[string]*dkimSigner, len(domains))
+	for _, d := range domains {
+		data, err := os.ReadFile(d.PrivateKeyPath)
+		if err != nil {
+			return fmt.Errorf("❌ Failed to read DKIM key for %s: %w", d.Domain, err)
+		}
+		key, err := ParseDKIMPrivateKey(data)
+		if err != nil {
+			return fmt.Errorf("❌ Invalid DKIM key for %s: %w", d.Domain, err)
+		}
+		record, err := DKIMRecord(key.Public())
+		if err != nil {
+			return fmt.Errorf("❌ Invalid DKIM key for %s: %w", d.Domain, err)
+		}
+
+		domain := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d.Domain), "@"))
+		signers[domain] = &dkimSigner{domain: domain, selector: d.Selector, key: key}
+		log.Printf("✅ DKIM signing for %s, DNS TXT %s._domainkey.%s: %s", domain, d.Selector, domain, record)
+	}
+
+	dkimSignersMu.Lock()
+	dkimSigners = signers
+	dkimSignersMu.Unlock()
+	return nil
+}
+
+// ParseDKIMPrivateKey reads a PEM RSA (PKCS#1 or PKCS#8) or Ed25519 (PKCS#8) private key
+func ParseDKIMPrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key: %w", err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// DKIMRecord returns the DNS TXT record that publishes a DKIM public key
+func DKIMRecord(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(k), nil
+	default:
+		return "", fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// dkimSignerFor picks the key for the From domain, so the signature aligns
+// with what the patient sees, and falls back to the domain of the account's
+// own address for doctors whose domain has no key
+func dkimSignerFor(from, accountAddress string) *dkimSigner {
+	dkimSignersMu.RLock()
+	defer dkimSignersMu.RUnlock()
+
+	for _, addr := range []string{from, accountAddress} {
+		if _, domain, ok := strings.Cut(addr, "@"); ok {
+			if s := dkimSigners[strings.ToLower(strings.TrimSpace(domain))]; s != nil {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// signDKIM adds a DKIM-Signature to a built message when a key is configured
+// for its From domain or the account's domain; otherwise raw is returned as is
+func signDKIM(raw []byte, accountAddress string) ([]byte, error) {
+	h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message header: %w", err)
+	}
+	var from string
+	if addrs, err := (&mail.Header{Header: message.Header{Header: h}}).AddressList("From"); err == nil && len(addrs) > 0 {
+		from = addrs[0].Address
+	}
+
+	signer := dkimSignerFor(from, accountAddress)
+	if signer == nil {
+		return raw, nil
+	}
+
+	var signed bytes.Buffer
+	err = dkim.Sign(&signed, bytes.NewReader(raw), &dkim.SignOptions{
+		Domain:                 signer.domain,
+		Selector:               signer.selector,
+		Signer:                 signer.key,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             dkimSignedHeaders,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DKIM signing for %s failed: %w", signer.domain, err)
+	}
+	return signed.Bytes(), nil
+}
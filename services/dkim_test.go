@@ -0,0 +1,188 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"email-client/config"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// withDKIMSigners swaps the configured signers for the duration of a test
+func withDKIMSigners(t *testing.T, signers map[string]*dkimSigner) {
+	t.Helper()
+	dkimSignersMu.Lock()
+	previous := dkimSigners
+	dkimSigners = signers
+	dkimSignersMu.Unlock()
+	t.Cleanup(func() {
+		dkimSignersMu.Lock()
+		dkimSigners = previous
+		dkimSignersMu.Unlock()
+	})
+}
+
+// verifyDKIM checks every signature of raw against the public keys in records, keyed by "<selector>._domainkey.<domain>"
+func verifyDKIM(t *testing.T, raw []byte, records map[string]string) []*dkim.Verification {
+	t.Helper()
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{
+		LookupTXT: func(name string) ([]string, error) {
+			if record, ok := records[name]; ok {
+				return []string{record}, nil
+			}
+			return nil, fmt.Errorf("no TXT record for %s", name)
+		},
+	})
+	if err != nil {
+		t.Fatalf("dkim.Verify: %v", err)
+	}
+	return verifications
+}
+
+func TestSignDKIMVerifies(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account := &config.MailAccount{ID: "clinic", SMTP: config.SMTPConfig{From: "reports@clinic.example"}}
+
+	tests := []struct {
+		name       string
+		key        crypto.Signer
+		keyDomain  string
+		from       string
+		wantDomain string
+	}{
+		{"rsa key for the From domain", rsaKey, "doctors.example", "dr.rao@doctors.example", "doctors.example"},
+		{"ed25519 key for the From domain", edKey, "doctors.example", "dr.rao@doctors.example", "doctors.example"},
+		{"falls back to the account domain", rsaKey, "clinic.example", "dr.rao@elsewhere.example", "clinic.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withDKIMSigners(t, map[string]*dkimSigner{
+				tt.keyDomain: {domain: tt.keyDomain, selector: "s1", key: tt.key},
+			})
+			record, err := DKIMRecord(tt.key.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			raw, err := BuildSignedMessage(account, &OutgoingMessage{
+				Class:    MessageClassReport,
+				From:     tt.from,
+				FromName: "Dr. Rao",
+				To:       []string{"9876543210@vault.example"},
+				Subject:  "OPD report – follow-up",
+				HTMLBody: "<p>Take rest.</p>",
+				Attachments: []OutgoingAttachment{
+					{Filename: "OPD_Asha.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4 test")},
+				},
+			})
+			if err != nil {
+				t.Fatalf("BuildSignedMessage: %v", err)
+			}
+
+			verifications := verifyDKIM(t, raw, map[string]string{"s1._domainkey." + tt.keyDomain: record})
+			if len(verifications) != 1 {
+				t.Fatalf("got %d signatures, want 1", len(verifications))
+			}
+			v := verifications[0]
+			if v.Err != nil {
+				t.Fatalf("signature does not verify: %v", v.Err)
+			}
+			if v.Domain != tt.wantDomain {
+				t.Errorf("signed for %s, want %s", v.Domain, tt.wantDomain)
+			}
+		})
+	}
+}
+
+func TestSignDKIMDetectsTampering(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withDKIMSigners(t, map[string]*dkimSigner{"clinic.example": {domain: "clinic.example", selector: "s1", key: key}})
+	record, _ := DKIMRecord(key.Public())
+
+	account := &config.MailAccount{SMTP: config.SMTPConfig{From: "reports@clinic.example"}}
+	raw, err := BuildSignedMessage(account, &OutgoingMessage{To: []string{"p@vault.example"}, Subject: "Report", TextBody: "Dose: 5 mg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := bytes.Replace(raw, []byte("Dose: 5 mg"), []byte("Dose: 50 mg"), 1)
+	verifications := verifyDKIM(t, tampered, map[string]string{"s1._domainkey.clinic.example": record})
+	if len(verifications) != 1 || verifications[0].Err == nil {
+		t.Fatal("tampered body still verifies")
+	}
+}
+
+func TestSignDKIMWithoutKeyLeavesMessageAlone(t *testing.T) {
+	withDKIMSigners(t, map[string]*dkimSigner{})
+
+	account := &config.MailAccount{SMTP: config.SMTPConfig{From: "reports@clinic.example"}}
+	raw, err := BuildSignedMessage(account, &OutgoingMessage{To: []string{"p@vault.example"}, Subject: "Report", TextBody: "Hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("DKIM-Signature")) {
+		t.Fatal("message signed without a configured key")
+	}
+}
+
+func TestParseDKIMPrivateKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	pkcs8RSA, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	pkcs8Ed, _ := x509.MarshalPKCS8PrivateKey(edKey)
+
+	tests := []struct {
+		name    string
+		pem     []byte
+		wantErr bool
+	}{
+		{"rsa pkcs1", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), false},
+		{"rsa pkcs8", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8RSA}), false},
+		{"ed25519 pkcs8", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Ed}), false},
+		{"not pem", []byte("not a key"), true},
+		{"garbage der", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1, 2, 3}}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParseDKIMPrivateKey(tt.pem)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if _, err := DKIMRecord(key.Public()); err != nil {
+					t.Fatalf("DKIMRecord: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestDKIMRecord(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	record, err := DKIMRecord(edKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(record, "v=DKIM1; k=ed25519; p=") {
+		t.Errorf("record = %q", record)
+	}
+}
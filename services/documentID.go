@@ -0,0 +1,169 @@
+package services
+
+import (
+	"context"
+	"email-client/config"
+	"email-client/models"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const documentIDPrefix = "d1."
+
+var (
+	// ErrInvalidDocumentID is returned for IDs that aren't document IDs at all
+	ErrInvalidDocumentID = errors.New("invalid document ID")
+	// ErrDocumentNotFound is returned when a document ID no longer points at a message
+	ErrDocumentNotFound = errors.New("document not found")
+)
+
+// DocumentRef is what a document ID encodes: where the message lived when the
+// ID was issued, and its Message-ID to find it again after a UIDVALIDITY reset
+// or a move to another folder.
+type DocumentRef struct {
+	Account     string `json:"a"`
+	Mailbox     string `json:"m"`
+	UIDValidity uint32 `json:"v"`
+	UID         uint32 `json:"u"`
+	MessageID   string `json:"i,omitempty"`
+}
+
+// EncodeDocumentID turns a DocumentRef into the opaque token used in URLs
+func EncodeDocumentID(ref DocumentRef) string {
+	data, _ := json.Marshal(ref)
+	return documentIDPrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeDocumentID parses a token produced by EncodeDocumentID
+func DecodeDocumentID(id string) (*DocumentRef, error) {
+	if !strings.HasPrefix(id, documentIDPrefix) {
+		return nil, ErrInvalidDocumentID
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(id, documentIDPrefix))
+	if err != nil {
+		return nil, ErrInvalidDocumentID
+	}
+	var ref DocumentRef
+	if err := json.Unmarshal(data, &ref); err != nil || ref.Mailbox == "" || ref.UID == 0 {
+		return nil, ErrInvalidDocumentID
+	}
+	return &ref, nil
+}
+
+// documentIDFromIndex builds the document ID of an indexed message
+func documentIDFromIndex(doc models.IndexedMessage) string {
+	return EncodeDocumentID(DocumentRef{
+		Account:     doc.Account,
+		Mailbox:     doc.Mailbox,
+		UIDValidity: doc.UIDValidity,
+		UID:         doc.UID,
+		MessageID:   doc.MessageID,
+	})
+}
+
+// ResolveDocument finds the folder and current UID of a document in store. The
+// MailIndex answers first: its entries are dropped when a folder's UIDVALIDITY
+// changes, so an entry under the encoded UID, or failing that under the
+// Message-ID, is current as of the last sync. Only on a miss does it ask the
+// server, using the encoded UID while its UIDVALIDITY still holds and the
+// message is still there, and otherwise searching by Message-ID.
+func ResolveDocument(store MailStore, id string) (string, uint32, error) {
+	ref, err := DecodeDocumentID(id)
+	if err != nil {
+		return "", 0, err
+	}
+	if ref.Account != store.Account().ID {
+		return "", 0, fmt.Errorf("%w: issued for another mail account", ErrDocumentNotFound)
+	}
+
+	folder, uid, err := resolveDocumentFromIndex(ref)
+	if err != nil {
+		log.Printf("⚠️ Resolving document from the index failed, asking the mail server: %v", err)
+	} else if uid != 0 {
+		return folder, uid, nil
+	}
+
+	if config.IsMailFolder(ref.Mailbox) {
+		status, err := store.Status(ref.Mailbox)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to read mailbox status: %w", err)
+		}
+		if status.UIDValidity == ref.UIDValidity {
+			envelopes, err := store.Envelopes(ref.Mailbox, []uint32{ref.UID})
+			if err != nil {
+				return "", 0, fmt.Errorf("failed to look up document: %w", err)
+			}
+			if len(envelopes) > 0 {
+				return ref.Mailbox, ref.UID, nil
+			}
+		}
+	}
+
+	// ✅ UID is stale: find the message again by Message-ID
+	if ref.MessageID != "" {
+		folder, uids, err := firstFolderWithMatches(store, MailFilter{MessageID: ref.MessageID})
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to look up document: %w", err)
+		}
+		if len(uids) > 0 {
+			return folder, uids[len(uids)-1], nil
+		}
+	}
+	return "", 0, ErrDocumentNotFound
+}
+
+// resolveDocumentFromIndex looks ref up in the MailIndex; a zero UID means it isn't there
+func resolveDocumentFromIndex(ref *DocumentRef) (string, uint32, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	col := config.GetMailIndexCollection()
+
+	if config.IsMailFolder(ref.Mailbox) {
+		var doc models.IndexedMessage
+		err := col.FindOne(ctx, bson.M{"account": ref.Account, "mailbox": ref.Mailbox, "uid_validity": ref.UIDValidity, "uid": ref.UID}).Decode(&doc)
+		if err == nil {
+			return doc.Mailbox, doc.UID, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return "", 0, fmt.Errorf("index lookup failed: %w", err)
+		}
+	}
+	if ref.MessageID == "" {
+		return "", 0, nil
+	}
+
+	// ✅ Moved or renumbered: same folder order and UID choice as firstFolderWithMatches
+	cursor, err := col.Find(ctx, bson.M{"account": ref.Account, "message_id": ref.MessageID, "mailbox": bson.M{"$in": config.MailFolders()}})
+	if err != nil {
+		return "", 0, fmt.Errorf("index lookup failed: %w", err)
+	}
+	var docs []models.IndexedMessage
+	if err := cursor.All(ctx, &docs); err != nil {
+		return "", 0, fmt.Errorf("index lookup failed: %w", err)
+	}
+	for _, folder := range config.MailFolders() {
+		var uid uint32
+		for _, doc := range docs {
+			if doc.Mailbox == folder && doc.UID > uid {
+				uid = doc.UID
+			}
+		}
+		if uid != 0 {
+			return folder, uid, nil
+		}
+	}
+	return "", 0, nil
+}
+
+// normalizeMessageID strips the angle brackets and whitespace around a Message-ID
+func normalizeMessageID(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
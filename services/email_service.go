@@ -1,16 +1,13 @@
 package services
 
 import (
-	"email-client/config"
-
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 
 	"strings"
 	"time"
-
-	"github.com/emersion/go-imap"
 )
 
 // DateService provides current date functionality
@@ -40,78 +37,52 @@ func (os *OTPService) GenerateOTP() string {
 }
 
 // FetchFromNameByEmail retrieves the sender's name from the email header.
-func FetchFromNameByEmail(loggedInEmail string) (string, error) {
+func FetchFromNameByEmail(store MailStore, loggedInEmail string) (string, error) {
 	startTime := time.Now()
 	log.Println("🔄 [Service - Name] Checking if entered email exists and fetching name...")
 
-	// ✅ Connect to IMAP
-	imapStart := time.Now()
-	imapClient, err := config.ConnectIMAP()
-	if err != nil {
-		log.Printf("❌ IMAP connection failed: %v", err)
-		return "", fmt.Errorf("IMAP connection error: %w", err)
+	// ✅ Search for emails FROM loggedInEmail
+	searchStart := time.Now()
+	senderFolder, uids, err := firstFolderWithMatches(store, MailFilter{From: loggedInEmail})
+	if errors.Is(err, ErrMailUnavailable) {
+		// ✅ Server down: the local index still knows who has sent mail before
+		if name, indexErr := indexedFromName(store.Account().ID, loggedInEmail); indexErr == nil && name != "" {
+			log.Printf("⚠️ Mail server unavailable, using indexed name for %s", loggedInEmail)
+			return strings.Title(strings.ToLower(name)), nil
+		}
 	}
-	defer imapClient.Logout()
-	log.Printf("✅ IMAP connected in %v ms", time.Since(imapStart).Milliseconds())
-
-	// ✅ Select INBOX in read-only mode
-	inboxStart := time.Now()
-	_, err = imapClient.Select("INBOX", true)
 	if err != nil {
-		log.Printf("❌ Failed to select INBOX: %v", err)
-		return "", fmt.Errorf("failed to select INBOX: %w", err)
+		log.Printf("❌ Mail search failed: %v", err)
+		return "", fmt.Errorf("mail search error: %w", err)
 	}
-	log.Printf("📂 INBOX selected in %v ms", time.Since(inboxStart).Milliseconds())
-
-	// ✅ Search for emails FROM loggedInEmail
-	searchStart := time.Now()
-	searchCriteria := imap.NewSearchCriteria()
-	searchCriteria.Header.Add("FROM", loggedInEmail)
-
-	seqNums, err := imapClient.Search(searchCriteria)
-	if err != nil || len(seqNums) == 0 {
+	if len(uids) == 0 {
 		log.Printf("⚠️ No matching emails found from: %s", loggedInEmail)
 		log.Printf("🕒 Total execution time: %v ms", time.Since(startTime).Milliseconds())
 		return "", nil // Only return empty string if not found
 	}
-	log.Printf("📊 Found %d matching emails in %v ms", len(seqNums), time.Since(searchStart).Milliseconds())
+	log.Printf("📊 Found %d matching emails in %s in %v ms", len(uids), senderFolder, time.Since(searchStart).Milliseconds())
 
 	// ✅ Fetch headers from latest 10 emails only
-	if len(seqNums) > 10 {
-		seqNums = seqNums[len(seqNums)-10:]
+	if len(uids) > 10 {
+		uids = uids[len(uids)-10:]
 	}
 
-	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(seqNums...)
-
-	messages := make(chan *imap.Message, 10)
-	done := make(chan error, 1)
-
-	go func() {
-		done <- imapClient.Fetch(seqSet, []imap.FetchItem{imap.FetchEnvelope}, messages)
-	}()
+	envelopes, err := store.Envelopes(senderFolder, uids)
+	if err != nil {
+		log.Printf("❌ Error fetching headers: %v", err)
+		return "", fmt.Errorf("fetch error: %w", err)
+	}
 
 	// ✅ Check for name in From field
-	for msg := range messages {
-		if msg.Envelope != nil {
-			for _, from := range msg.Envelope.From {
-				emailAddr := from.MailboxName + "@" + from.HostName
-				if strings.EqualFold(emailAddr, loggedInEmail) && from.PersonalName != "" {
-					senderName := strings.Title(strings.ToLower(from.PersonalName))
-					log.Printf("✅ Found name: '%s' for %s", senderName, emailAddr)
-					log.Printf("🕒 Total execution time: %v ms", time.Since(startTime).Milliseconds())
-					return senderName, nil
-				}
-			}
+	for _, env := range envelopes {
+		if strings.EqualFold(env.From, loggedInEmail) && env.FromName != "" {
+			senderName := strings.Title(strings.ToLower(env.FromName))
+			log.Printf("✅ Found name: '%s' for %s", senderName, env.From)
+			log.Printf("🕒 Total execution time: %v ms", time.Since(startTime).Milliseconds())
+			return senderName, nil
 		}
 	}
 
-	// ✅ Wait for fetch to complete
-	if err := <-done; err != nil {
-		log.Printf("❌ Error fetching headers: %v", err)
-		return "", fmt.Errorf("fetch error: %w", err)
-	}
-
 	log.Printf("⚠️ Email found but name missing. Returning empty.")
 	log.Printf("🕒 Total execution time: %v ms", time.Since(startTime).Milliseconds())
 	return "", nil
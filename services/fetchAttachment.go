@@ -1,15 +1,16 @@
 package services
 
 import (
-	"email-client/timeConfig"
+	"email-client/models"
 	"fmt"
 	"io"
 	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
-
-	"github.com/emersion/go-imap"
-	"github.com/emersion/go-message"
 )
 
 type Attachment struct {
@@ -18,94 +19,176 @@ type Attachment struct {
 	URL  string `json:"url"`
 }
 
-// FetchAttachment retrieves an email attachment by UID and attachment name
-func FetchAttachment(emailUID uint32, attachmentName string) ([]byte, string, error) {
-	startTime := time.Now()
+// AttachmentFile is a decoded attachment in the local cache. It is an
+// io.ReadSeeker, so handlers can serve it with http.ServeContent, which takes
+// care of Content-Length and Range requests.
+type AttachmentFile struct {
+	*os.File
+	Filename string
+	MIMEType string
+	SHA256   string // of the decoded content; empty for previews
+	Size     int64
+	ModTime  time.Time
+
+	Quarantined bool   // flagged by the malware scanner, see OpenQuarantinedAttachment
+	Threat      string // what the scanner found
+}
 
-	// ✅ Step 1: Reuse IMAP connection (No need to reconnect every time)
-	imapClient, err := timeConfig.ConnectIMAP()
+// OpenAttachment returns the attachment at the given MIME part path (e.g.
+// "2.1") from the local cache, fetching just that part into the cache first if
+// needed. Attachments the malware scanner flagged give ErrQuarantined. Callers
+// must close the file.
+func OpenAttachment(store MailStore, folder string, emailUID uint32, part string) (*AttachmentFile, error) {
+	file, err := OpenQuarantinedAttachment(store, folder, emailUID, part)
 	if err != nil {
-		log.Printf("❌ IMAP connection error: %v", err)
-		return nil, "", fmt.Errorf("IMAP connection error: %v", err)
+		return nil, err
 	}
+	if file.Quarantined {
+		file.Close()
+		return nil, fmt.Errorf("%w: %s (%s)", ErrQuarantined, file.Filename, file.Threat)
+	}
+	return file, nil
+}
 
-	// ✅ Step 2: Select Mailbox (Avoid reselecting if already selected)
-	_, err = imapClient.Select("INBOX", false)
+// OpenQuarantinedAttachment is OpenAttachment that also returns quarantined
+// files, for administrators. Check file.Quarantined before serving it.
+func OpenQuarantinedAttachment(store MailStore, folder string, emailUID uint32, part string) (*AttachmentFile, error) {
+	if _, err := parsePartPath(part); err != nil {
+		return nil, err
+	}
+	file, err := openMessagePart(store, folder, emailUID, "part:"+part, "part "+part, func() (*MessagePart, error) {
+		return store.OpenPart(folder, emailUID, part)
+	})
 	if err != nil {
-		log.Printf("❌ Failed to select INBOX: %v", err)
-		return nil, "", fmt.Errorf("failed to select INBOX: %v", err)
+		return nil, err
 	}
+	if file.Quarantined {
+		flagQuarantinedAttachment(store, folder, emailUID, part, file.Threat)
+	}
+	return file, nil
+}
 
-	// ✅ Step 3: Setup Async Fetch for Faster Processing
-	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(emailUID)
-	section := &imap.BodySectionName{}
+// ResolveAttachmentPart finds the part path of the first attachment named
+// attachmentName, for links made before attachments were addressed by part
+func ResolveAttachmentPart(store MailStore, folder string, emailUID uint32, attachmentName string) (string, error) {
+	envelopes, err := store.Envelopes(folder, []uint32{emailUID})
+	if err != nil {
+		return "", err
+	}
+	if len(envelopes) == 0 {
+		return "", fmt.Errorf("%w: UID %d in %s", ErrMessageNotFound, emailUID, folder)
+	}
+	for _, info := range envelopes[0].Attachments {
+		if strings.EqualFold(info.Name, attachmentName) {
+			return info.Part, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrAttachmentNotFound, attachmentName)
+}
 
-	messages := make(chan *imap.Message, 1)
-	errChan := make(chan error, 1)
+// OpenInlineImage returns the image a cid: reference of the HTML body points
+// at, through the same cache as attachments. Callers must close the file.
+func OpenInlineImage(store MailStore, folder string, emailUID uint32, contentID string) (*AttachmentFile, error) {
+	file, err := openMessagePart(store, folder, emailUID, "cid:"+contentID, "cid:"+contentID, func() (*MessagePart, error) {
+		raw, err := store.OpenRaw(folder, emailUID)
+		if err != nil {
+			return nil, err
+		}
+		part, err := findInlinePart(raw, contentID)
+		if err != nil {
+			raw.Close()
+			return nil, err
+		}
+		part.closer = raw
+		return part, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if file.Quarantined {
+		file.Close()
+		return nil, fmt.Errorf("%w: cid:%s (%s)", ErrQuarantined, contentID, file.Threat)
+	}
+	if !isInlineImageType(file.MIMEType) {
+		file.Close()
+		return nil, fmt.Errorf("%w: cid:%s is not an image", ErrAttachmentNotFound, contentID)
+	}
+	return file, nil
+}
 
-	// ⚡ Concurrent Fetch
-	go func() {
-		errChan <- imapClient.UidFetch(seqSet, []imap.FetchItem{section.FetchItem()}, messages)
-	}()
+// openMessagePart serves a part of a message from the cache under the given
+// key, fetching and decoding it with open on a cache miss
+func openMessagePart(store MailStore, folder string, emailUID uint32, key, label string, open func() (*MessagePart, error)) (*AttachmentFile, error) {
+	startTime := time.Now()
 
-	msg := <-messages
-	if fetchErr := <-errChan; fetchErr != nil {
-		log.Printf("❌ Fetch error for UID %d: %v", emailUID, fetchErr)
-		return nil, "", fmt.Errorf("fetch error: %v", fetchErr)
+	document, err := cacheDocumentID(store, folder, emailUID)
+	if err != nil {
+		return nil, err
 	}
-
-	if msg == nil {
-		log.Printf("❌ No email found with UID: %d", emailUID)
-		return nil, "", fmt.Errorf("no message found with UID %d", emailUID)
+	entry := models.CachedAttachment{
+		Account:  store.Account().ID,
+		Document: document,
+		Part:     key,
 	}
 
-	// ✅ Step 4: Use Streaming to Read Email Faster
-	r := msg.GetBody(section)
-	if r == nil {
-		log.Printf("❌ No body found for UID %d", emailUID)
-		return nil, "", fmt.Errorf("failed to get body for UID %d", emailUID)
+	if file, err := lookupCachedAttachment(entry.Document, entry.Part); err == nil {
+		log.Printf("📎 Attachment '%s' served from cache in %v ms", file.Filename, time.Since(startTime).Milliseconds())
+		return file, nil
 	}
 
-	m, err := message.Read(r)
+	part, err := open()
 	if err != nil {
-		log.Printf("❌ Failed to parse email UID %d: %v", emailUID, err)
-		return nil, "", fmt.Errorf("failed to parse email: %v", err)
+		log.Printf("❌ Failed to fetch attachment '%s' from email UID %d (%s): %v", label, emailUID, folder, err)
+		return nil, err
 	}
+	defer part.Close()
 
-	mr := m.MultipartReader()
-	if mr == nil {
-		log.Printf("❌ Email UID %d is not multipart; no attachments found", emailUID)
-		return nil, "", fmt.Errorf("email is not multipart; no attachments found")
+	file, err := cacheAttachment(entry, part)
+	if err != nil {
+		return nil, err
 	}
 
-	// ✅ Step 5: Extract Attachment (Fastest Processing)
-	for {
-		p, err := mr.NextPart()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Printf("❌ Error reading multipart part: %v", err)
-			return nil, "", fmt.Errorf("error reading multipart part: %v", err)
-		}
-
-		// Check attachment properties
-		disposition, params, _ := p.Header.ContentDisposition()
-		filename := params["filename"]
+	log.Printf("📎 Attachment '%s' fetched successfully in %v ms!", file.Filename, time.Since(startTime).Milliseconds())
+	return file, nil
+}
 
-		if (disposition == "attachment" || disposition == "inline") && strings.EqualFold(filename, attachmentName) {
-			data, err := io.ReadAll(p.Body)
-			if err != nil {
-				log.Printf("❌ Error reading attachment body: %v", err)
-				return nil, "", fmt.Errorf("error reading attachment body: %v", err)
-			}
+// cacheDocumentID names a message in the local caches: its document ID
+// without Message-ID, which needs only the mailbox's UIDVALIDITY
+func cacheDocumentID(store MailStore, folder string, emailUID uint32) (string, error) {
+	status, err := store.Status(folder)
+	if err != nil {
+		return "", fmt.Errorf("failed to read mailbox status: %w", err)
+	}
+	return EncodeDocumentID(DocumentRef{
+		Account:     store.Account().ID,
+		Mailbox:     folder,
+		UIDValidity: status.UIDValidity,
+		UID:         emailUID,
+	}), nil
+}
 
-			log.Printf("📎 Attachment '%s' fetched successfully in %v ms!", filename, time.Since(startTime).Milliseconds())
-			return data, filename, nil
-		}
+// attachmentMIMEType prefers the file extension, then the part's Content-Type,
+// then sniffs the decoded data
+func attachmentMIMEType(part *MessagePart, path string) string {
+	if t := mime.TypeByExtension(filepath.Ext(part.Filename)); t != "" {
+		return t
+	}
+	if isDICOM("", part.Filename) {
+		return "application/dicom"
+	}
+	if part.MIMEType != "" && part.MIMEType != "application/octet-stream" {
+		return part.MIMEType
 	}
 
-	log.Printf("❌ Attachment '%s' not found in email UID %d", attachmentName, emailUID)
-	return nil, "", fmt.Errorf("attachment %s not found in email UID %d", attachmentName, emailUID)
+	f, err := os.Open(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	if hasDICOMPreamble(head[:n]) {
+		return "application/dicom" // e.g. DICOMDIR exports named IM000001
+	}
+	return http.DetectContentType(head[:n])
 }
@@ -1,15 +1,12 @@
 package services
 
 import (
-	"email-client/config"
+	"email-client/models"
 	"fmt"
 	"log"
 	"regexp"
-	"sort"
 	"strings"
 	"time"
-
-	"github.com/emersion/go-imap"
 )
 
 // ✅ Struct to store recipient emails and sender names FetchEmailIDs
@@ -34,83 +31,51 @@ func ExtractMobileNumber(email string) (string, error) {
 	return mobileNumber, nil
 }
 
-// FetchEmailIDs retrieves unique recipient emails sorted by latest date first
+// Regular expression for 10-digit email format
+var validRecipientFormat = regexp.MustCompile(`^\d{10}@[\w\.-]+$`)
+
 // FetchEmailIDs retrieves unique recipient emails in the format 10-digit@domain.com, sorted by latest date first
-func FetchEmailIDs(loggedInEmail string) ([]string, error) {
-	imapClient, err := config.ConnectIMAP()
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to IMAP: %w", err)
+func FetchEmailIDs(store MailStore, loggedInEmail string) ([]string, error) {
+	if !mailIndexReady(store.Account().ID) {
+		return fetchEmailIDsLive(store, loggedInEmail)
 	}
-	defer imapClient.Logout()
 
-	_, err = imapClient.Select("INBOX", true)
+	// ✅ Index results are already sorted latest first
+	indexed, err := QueryMailIndex(store.Account().ID, loggedInEmail, "")
 	if err != nil {
-		return nil, fmt.Errorf("failed to select INBOX: %w", err)
+		return nil, err
 	}
+	return uniqueValidRecipients(indexed), nil
+}
 
-	searchCriteria := imap.NewSearchCriteria()
-	searchCriteria.Header.Add("FROM", loggedInEmail)
-
-	seqNums, err := imapClient.Search(searchCriteria)
+func fetchEmailIDsLive(store MailStore, loggedInEmail string) ([]string, error) {
+	// ✅ fetchMessagesLive already sorts by date (latest first)
+	messages, err := fetchMessagesLive(store, MailFilter{From: loggedInEmail})
 	if err != nil {
-		return nil, fmt.Errorf("search failed: %w", err)
+		return nil, err
 	}
+	return uniqueValidRecipients(messages), nil
+}
 
-	if len(seqNums) == 0 {
-		return []string{}, nil
-	}
-
-	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(seqNums...)
-
-	messages := make(chan *imap.Message, len(seqNums))
-	go func() {
-		_ = imapClient.Fetch(seqSet, []imap.FetchItem{imap.FetchEnvelope}, messages)
-	}()
-
-	var emailList []EmailInfo
+// uniqueValidRecipients keeps the first 10-digit@domain recipient of each message, in order
+func uniqueValidRecipients(messages []models.Message) []string {
+	recipients := []string{}
 	uniqueRecipients := make(map[string]bool)
-
-	// Regular expression for 10-digit email format
-	validFormat := regexp.MustCompile(`^\d{10}@[\w\.-]+$`)
-
-	for msg := range messages {
-		if msg == nil || msg.Envelope == nil || len(msg.Envelope.To) == 0 {
-			continue
-		}
-
-		for _, recipient := range msg.Envelope.To {
-			toEmail := fmt.Sprintf("%s@%s", recipient.MailboxName, recipient.HostName)
-			toEmail = strings.ToLower(strings.TrimSpace(toEmail))
-
-			if validFormat.MatchString(toEmail) && !uniqueRecipients[toEmail] {
-				uniqueRecipients[toEmail] = true
-				emailList = append(emailList, EmailInfo{
-					Email: toEmail,
-					Date:  msg.Envelope.Date.UTC(),
-				})
-			}
+	for _, msg := range messages {
+		toEmail := strings.ToLower(strings.TrimSpace(msg.To))
+		if validRecipientFormat.MatchString(toEmail) && !uniqueRecipients[toEmail] {
+			uniqueRecipients[toEmail] = true
+			recipients = append(recipients, toEmail)
 		}
 	}
-
-	// Sort by date (latest first)
-	sort.Slice(emailList, func(i, j int) bool {
-		return emailList[i].Date.After(emailList[j].Date)
-	})
-
-	var recipients []string
-	for _, email := range emailList {
-		recipients = append(recipients, email.Email)
-	}
-
-	return recipients, nil
+	return recipients
 }
 
-func GetUniqueRecipients(loggedInEmail string) ([]string, error) {
+func GetUniqueRecipients(store MailStore, loggedInEmail string) ([]string, error) {
 	log.Printf("📩 Fetching unique recipients for logged-in email: %s", loggedInEmail)
 
 	// ✅ Fetch recipients using logged-in email
-	emails, err := FetchEmailIDs(loggedInEmail)
+	emails, err := FetchEmailIDs(store, loggedInEmail)
 	if err != nil {
 		return nil, fmt.Errorf("❌ Failed to fetch emails: %w", err)
 	}
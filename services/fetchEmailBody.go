@@ -2,127 +2,112 @@ package services
 
 import (
 	"bytes"
-	"email-client/config"
-	"encoding/base64"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"mime"
+	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
-	"github.com/emersion/go-imap"
-	"github.com/emersion/go-imap/client"
-	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message"
 )
 
-func FetchPlainTextEmailBody(imapClient *client.Client, emailUID uint32) (string, []map[string]string, error) {
-	startTime := time.Now() // Track execution time
-
-	// ✅ Skip re-selecting INBOX if already selected
-	if imapClient.Mailbox() == nil || imapClient.Mailbox().Name != "INBOX" {
-		_, err := imapClient.Select("INBOX", false)
-		if err != nil {
-			return "", nil, fmt.Errorf("failed to select mailbox: %w", err)
-		}
-	}
-
-	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(emailUID)
-
-	// ✅ Fetch only the required parts
-	section := &imap.BodySectionName{}
-	messages := make(chan *imap.Message, 1)
+var cidRefPattern = regexp.MustCompile(`(?i)\bcid:([^"'\s<>)]+)`)
 
-	if err := imapClient.UidFetch(seqSet, []imap.FetchItem{section.FetchItem()}, messages); err != nil {
-		return "", nil, fmt.Errorf("fetch error: %w", err)
-	}
-
-	msg := <-messages
-	if msg == nil {
-		return "", nil, fmt.Errorf("email not found for UID %d", emailUID)
-	}
-
-	body := msg.GetBody(section)
-	if body == nil {
-		return "", nil, fmt.Errorf("email body empty for UID %d", emailUID)
-	}
+// FetchPlainTextEmailBody returns the message's HTML (or plain text) body and
+// its previewable attachments. cid: references of the body are resolved to
+// inlineURL(contentID), which serves the image only once the malware scanner
+// has passed it, like every other attachment.
+func FetchPlainTextEmailBody(store MailStore, folder string, emailUID uint32, inlineURL func(contentID string) string) (string, []map[string]string, error) {
+	startTime := time.Now() // Track execution time
 
-	rawBody, err := io.ReadAll(body)
+	rawBody, err := store.FetchRaw(folder, emailUID)
 	if err != nil {
-		return "", nil, fmt.Errorf("error reading body: %w", err)
+		return "", nil, err
 	}
 
 	// ✅ Skip MIME processing if not needed
 	if !bytes.Contains(rawBody, []byte("Content-Type:")) {
 		log.Println("✅ No MIME structure found. Returning plain text body.")
-		return string(rawBody), nil, nil
-	}
-
-	reader, err := mail.CreateReader(bytes.NewReader(rawBody))
-	if err != nil {
-		return "", nil, fmt.Errorf("failed to parse MIME email: %w", err)
+		return html.EscapeString(decodeBodyText(rawBody)), nil, nil
 	}
 
 	var emailBody, plainTextBody string
 	var attachments []map[string]string
+	inlineImages := make(map[string]bool) // Content-IDs of the images the body may show
 
-	for {
-		part, err := reader.NextPart()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Printf("⚠️ Error reading email part: %v", err)
-			continue
-		}
-
+	// ✅ Walk every part, however deeply nested, keeping its IMAP part path
+	err = walkMIMEParts(bytes.NewReader(rawBody), func(path string, part *message.Entity) (bool, error) {
 		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
-		disp, dispParams, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		disp, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+
+		// ✅ Get filename from Content-Disposition OR Content-Type, decoded to UTF-8
+		filename := partFilename(part.Header.Get("Content-Disposition"), part.Header.Get("Content-Type"))
 
-		// ✅ Get filename from Content-Disposition OR Content-Type
-		filename := dispParams["filename"]
-		if filename == "" {
-			_, cParams, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
-			filename = cParams["name"]
+		// ✅ Images with a Content-ID may be referenced from the HTML body
+		contentID := partContentID(part.Header.Get("Content-ID"))
+		if contentID != "" && isInlineImageType(contentType) {
+			inlineImages[contentID] = true
 		}
 
+		isAttachment := isAttachmentPart(disp, filename, contentID)
+
 		// ✅ Prefer HTML if available
-		if strings.HasPrefix(contentType, "text/html") {
+		if strings.HasPrefix(contentType, "text/html") && !isAttachment {
 			htmlBytes, err := io.ReadAll(part.Body)
 			if err == nil {
-				emailBody = string(htmlBytes)
+				emailBody = decodeBodyText(htmlBytes)
 			}
-		} else if strings.HasPrefix(contentType, "text/plain") {
+		} else if strings.HasPrefix(contentType, "text/plain") && !isAttachment {
 			textBytes, err := io.ReadAll(part.Body)
 			if err == nil {
-				plainTextBody = string(textBytes)
+				plainTextBody = decodeBodyText(textBytes)
 			}
-		} else if (strings.EqualFold(disp, "attachment") || strings.EqualFold(disp, "inline")) && strings.Contains(contentType, "image") {
-			data, err := io.ReadAll(part.Body)
-			if err != nil {
-				log.Printf("⚠️ Failed to read attachment %s: %v", filename, err)
-				continue
+		} else if isAttachment || (strings.EqualFold(disp, "inline") && filename != "") {
+			// ✅ Images and PDFs are listed for thumbnails; the data itself is fetched on demand
+			kind := PreviewKind(contentType, filename)
+			if kind == "" {
+				return false, nil
 			}
-			if len(data) == 0 {
-				log.Printf("⚠️ Attachment %s is empty", filename)
-				continue
-			}
-
-			base64Img := base64.StdEncoding.EncodeToString(data)
-			log.Printf("📎 Processed attachment: %s (size: %d bytes)", filename, len(data))
+			name := attachmentDisplayName(filename, path)
+			log.Printf("📎 Listed attachment for preview: %s (%s, part %s)", name, kind, path)
 
 			attachments = append(attachments, map[string]string{
-				"type":   "image",
-				"name":   filename,
-				"base64": fmt.Sprintf("data:%s;base64,%s", contentType, base64Img),
+				"type":      kind,
+				"name":      name,
+				"part":      path,
+				"mimeType":  contentType,
+				"contentId": contentID,
 			})
 		}
+		return false, nil
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse MIME email: %w", err)
+	}
+
+	// ✅ Point cid: references at the images; those shown in the body aren't listed again
+	if emailBody != "" && len(inlineImages) > 0 {
+		var shown map[string]bool
+		emailBody, shown = resolveInlineImages(emailBody, inlineImages, inlineURL)
+		listed := attachments[:0]
+		for _, att := range attachments {
+			if !shown[att["contentId"]] {
+				listed = append(listed, att)
+			}
+		}
+		attachments = listed
+	}
+	for _, att := range attachments {
+		delete(att, "contentId")
 	}
 
-	// ✅ Fallback to plain text if HTML not found
+	// ✅ Fallback to plain text if HTML not found, escaped so it can't be read as markup
 	if emailBody == "" && plainTextBody != "" {
-		emailBody = plainTextBody
+		emailBody = html.EscapeString(plainTextBody)
 	}
 
 	// ✅ Log missing content issues
@@ -137,32 +122,41 @@ func FetchPlainTextEmailBody(imapClient *client.Client, emailUID uint32) (string
 	return emailBody, attachments, nil
 }
 
-// CheckEmailExists checks if an email exists with doctorId as "From" and patientId as "To"
-func CheckEmailExists(doctorId, patientId string) (bool, error) {
-	start := time.Now()
-	log.Println("📨 Checking emails From:", doctorId, "| To:", patientId)
-
-	imapClient, err := config.ConnectIMAP()
-	if err != nil {
-		log.Println("❌ IMAP connection error:", err)
-		return false, err
+// isInlineImageType allows raster images only: an SVG could carry script
+func isInlineImageType(contentType string) bool {
+	switch strings.ToLower(contentType) {
+	case "image/png", "image/jpeg", "image/gif", "image/webp", "image/bmp":
+		return true
 	}
-	defer imapClient.Logout()
+	return false
+}
 
-	_, err = imapClient.Select("INBOX", false)
-	if err != nil {
-		log.Println("❌ Failed to select INBOX:", err)
-		return false, err
-	}
+// resolveInlineImages rewrites the body's cid: references and reports which Content-IDs it used
+func resolveInlineImages(body string, images map[string]bool, inlineURL func(string) string) (string, map[string]bool) {
+	shown := make(map[string]bool)
+	body = cidRefPattern.ReplaceAllStringFunc(body, func(ref string) string {
+		contentID := ref[len("cid:"):]
+		if unescaped, err := url.PathUnescape(contentID); err == nil {
+			contentID = unescaped
+		}
+		if !images[contentID] {
+			return ref // ✅ Unknown references stay broken rather than pointing elsewhere
+		}
+		shown[contentID] = true
+		return html.EscapeString(inlineURL(contentID))
+	})
+	return body, shown
+}
 
-	// Use IMAP header filtering
-	criteria := imap.NewSearchCriteria()
-	criteria.Header.Add("From", doctorId)
-	criteria.Header.Add("To", patientId)
+// CheckEmailExists checks if an email exists with doctorId as "From" and patientId as "To"
+func CheckEmailExists(store MailStore, doctorId, patientId string) (bool, error) {
+	start := time.Now()
+	log.Println("📨 Checking emails From:", doctorId, "| To:", patientId)
 
-	uids, err := imapClient.Search(criteria)
+	// Use header filtering on the mail store
+	_, uids, err := firstFolderWithMatches(store, MailFilter{From: doctorId, To: patientId})
 	if err != nil {
-		log.Println("❌ IMAP search failed:", err)
+		log.Println("❌ Mail search failed:", err)
 		return false, err
 	}
 	log.Printf("🔍 Matched UIDs: %d", len(uids))
@@ -4,30 +4,34 @@ import (
 	"bytes"
 	"email-client/config"
 	"email-client/models"
+	"errors"
 
-	"encoding/base64"
 	"fmt"
 	"html/template"
 	"log"
-	"net/smtp"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
 	"time"
 )
 
-func GeneratePDFAndSendEmail(opdData models.OpdModel, recipientEmail, loggedInEmail, fromName string) error {
+// ErrMissingFollowupDate is returned for a report without a follow-up date,
+// which the template can't be filled in without
+var ErrMissingFollowupDate = errors.New("follow-up date is required")
+
+// GeneratePDFAndSendEmail renders the OPD report with Typst and mails it.
+// beforeSend, when set, runs right before the message goes out and can still
+// call the send off by returning an error.
+func GeneratePDFAndSendEmail(account *config.MailAccount, opdData models.OpdModel, recipientEmail, loggedInEmail, fromName string, beforeSend func() error) error {
 	// Step 1: Load Typst template
 	templateData, err := os.ReadFile("templates/template.typ")
 	if err != nil {
 		return fmt.Errorf("failed to read template file: %w", err)
 	}
 
-	// Step 2: Skip if follow-up date is missing
+	// Step 2: Refuse a report without a follow-up date, so the outbox marks it failed rather than sent
 	if strings.TrimSpace(opdData.FollowupDate) == "" {
-		log.Println("Follow-up date/time is empty — skipping PDF generation")
-		return nil
+		return ErrMissingFollowupDate
 	}
 
 	// Step 3: Replace placeholders in the template
@@ -45,17 +49,25 @@ func GeneratePDFAndSendEmail(opdData models.OpdModel, recipientEmail, loggedInEm
 		typstContent = strings.ReplaceAll(typstContent, key, value)
 	}
 
-	// Step 4: Write temporary Typst file
+	// Step 4: Write temporary Typst file, uniquely named since outbox workers run in parallel
 	safePatientName := strings.ReplaceAll(opdData.PatientName, " ", "_")
-	tempTypFile := fmt.Sprintf("attachments/%s-opd.typ", safePatientName)
-	if err := os.WriteFile(tempTypFile, []byte(typstContent), 0644); err != nil {
-		return fmt.Errorf("failed to write Typst file: %w", err)
+	typFile, err := os.CreateTemp("attachments", safePatientName+"-*-opd.typ")
+	if err != nil {
+		return fmt.Errorf("failed to create Typst file: %w", err)
 	}
+	tempTypFile := typFile.Name()
 	defer os.Remove(tempTypFile)
+	_, err = typFile.WriteString(typstContent)
+	if closeErr := typFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write Typst file: %w", err)
+	}
 
 	// Step 5: Generate PDF using typst CLI
 	pdfFileName := fmt.Sprintf("OPD_%s.pdf", safePatientName)
-	pdfFilePath := filepath.Join("attachments", pdfFileName)
+	pdfFilePath := strings.TrimSuffix(tempTypFile, ".typ") + ".pdf"
 	cmd := exec.Command("typst", "compile", tempTypFile, pdfFilePath)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -76,8 +88,15 @@ func GeneratePDFAndSendEmail(opdData models.OpdModel, recipientEmail, loggedInEm
 		return fmt.Errorf("failed to read generated PDF: %w", err)
 	}
 
+	if beforeSend != nil {
+		if err := beforeSend(); err != nil {
+			return err
+		}
+	}
+
 	// Step 8: Send email with PDF attachment (just call the function directly)
-	err = SendEmailWithAttachment(
+	sent, err := SendEmailWithAttachment(
+		account,
 		opdData.PatientName,
 		opdData.DoctorName,
 		opdData.OPDDate,
@@ -93,10 +112,13 @@ func GeneratePDFAndSendEmail(opdData models.OpdModel, recipientEmail, loggedInEm
 		loggedInEmail,
 		fromName,
 	)
-	if err != nil {
+	if err != nil && !errors.Is(err, errNotArchived) {
 		return fmt.Errorf("failed to send email with PDF: %w", err)
 	}
 
+	// Step 9: Keep a copy in the archive mailbox so the doctor sees it without waiting for the relay
+	archiveSentReport(account, sent, err)
+
 	log.Println("✅ PDF created and email sent to:", recipientEmail, "from display name:", fromName)
 	return nil
 }
@@ -116,25 +138,25 @@ func parseOPDTemplate(templatePath string, data models.OpdModel) (string, error)
 
 	return tpl.String(), nil
 }
+
+// truncate shortens s to at most max characters
 func truncate(s string, max int) string {
-	if len(s) <= max {
+	runes := []rune(s)
+	if len(runes) <= max {
 		return s
 	}
-	return s[:max]
+	return string(runes[:max])
 }
 
+// SendEmailWithAttachment mails the OPD report and returns the copy to archive.
+// If the report went out but that copy couldn't be built, the error wraps errNotArchived.
 func SendEmailWithAttachment(
+	account *config.MailAccount,
 	patientName, doctorName, opdDate, opdNotes, prescription, followupDate, followupTime, createdOn,
 	subject, recipient, filename string, attachment []byte, loggedInEmail, fromName string,
-) error {
+) ([]byte, error) {
 	start := time.Now()
 
-	// Load SMTP configuration
-	smtpConfig, err := config.LoadSMTPConfig()
-	if err != nil {
-		return fmt.Errorf("failed to load SMTP config: %w", err)
-	}
-
 	// Prepare OPD data
 	opdData := models.OpdModel{
 		PatientName:  strings.TrimSpace(patientName),
@@ -150,59 +172,41 @@ func SendEmailWithAttachment(
 	// Parse HTML email body
 	emailBody, err := parseOPDTemplate("templates/opdmodal.html", opdData)
 	if err != nil {
-		return fmt.Errorf("failed to parse email body template: %v", err)
-	}
-
-	// Define boundary
-	const boundary = "boundary-opd-email-12345"
-	var sb strings.Builder
-
-	// Build email headers
-	sb.WriteString(fmt.Sprintf("From: \"%s\" <%s>\r\n", fromName, loggedInEmail))
-	sb.WriteString(fmt.Sprintf("To: %s\r\n", recipient))
-	sb.WriteString(fmt.Sprintf("Subject: %s\r\n", truncate(opdNotes, 30)))
-	sb.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
-	sb.WriteString("MIME-Version: 1.0\r\n")
-	sb.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=%s\r\n", boundary))
-	sb.WriteString("\r\n--" + boundary + "\r\n")
-
-	// Add HTML body
-	sb.WriteString("Content-Type: text/html; charset=\"utf-8\"\r\n")
-	sb.WriteString("Content-Transfer-Encoding: 7bit\r\n\r\n")
-	sb.WriteString(emailBody + "\r\n")
-	sb.WriteString("\r\n--" + boundary + "\r\n")
-
-	// Add PDF attachment
-	sb.WriteString(fmt.Sprintf("Content-Type: application/pdf; name=\"%s\"\r\n", filename))
-	sb.WriteString(fmt.Sprintf("Content-Disposition: attachment; filename=\"%s\"\r\n", filename))
-	sb.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
-
-	encoded := base64.StdEncoding.EncodeToString(attachment)
-	for i := 0; i < len(encoded); i += 76 {
-		end := i + 76
-		if end > len(encoded) {
-			end = len(encoded)
-		}
-		sb.WriteString(encoded[i:end] + "\r\n")
+		return nil, fmt.Errorf("failed to parse email body template: %v", err)
+	}
+
+	// ✅ Sign with the doctor's or clinic's certificate, encrypt to the patient's
+	smimeOpts, err := reportSMIMEOptions(account, loggedInEmail, recipient)
+	if err != nil {
+		return nil, err
 	}
-	sb.WriteString("--" + boundary + "--\r\n")
 
-	// Send the email
-	auth := smtp.PlainAuth("", smtpConfig.From, smtpConfig.Password, smtpConfig.SMTPHost_ALT)
+	// Send the email with the PDF attached
 	sendStart := time.Now()
-	err = smtp.SendMail(
-		fmt.Sprintf("%s:%s", smtpConfig.SMTPHost_ALT, smtpConfig.SMTPPort),
-		auth,
-		smtpConfig.From,
-		[]string{recipient},
-		[]byte(sb.String()),
-	)
+	msg := &OutgoingMessage{
+		Class:    MessageClassReport,
+		From:     loggedInEmail,
+		FromName: fromName,
+		To:       []string{recipient},
+		Subject:  truncate(opdNotes, 30),
+		HTMLBody: emailBody,
+		Attachments: []OutgoingAttachment{
+			{Filename: filename, ContentType: "application/pdf", Data: attachment},
+		},
+		SMIME: smimeOpts,
+	}
+	sent, err := GetMailer().Send(account, msg)
 	if err != nil {
-		return fmt.Errorf("failed to send email: %w", err)
+		return nil, err
 	}
 
 	log.Printf("✅ Email sent to %s (display: %s <%s>)", recipient, fromName, loggedInEmail)
 	log.Printf("⏱️ Send Time: %v ms | Total Time: %v ms", time.Since(sendStart).Milliseconds(), time.Since(start).Milliseconds())
 
-	return nil
+	// ✅ The copy to archive, readable by the doctor even when encrypted to the patient
+	archived, err := archiveCopy(sent, msg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotArchived, err)
+	}
+	return archived, nil
 }
@@ -0,0 +1,458 @@
+package services
+
+import (
+	"bytes"
+	"email-client/config"
+	"email-client/models"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message"
+)
+
+// imapFetchChunk is how much of a message or part OpenRaw and OpenPart fetch at a time
+const imapFetchChunk = 1 << 20
+
+// IMAPStore is the MailStore backed by the clinic's IMAP account
+type IMAPStore struct {
+	account *config.MailAccount
+}
+
+func NewIMAPStore(account *config.MailAccount) *IMAPStore {
+	return &IMAPStore{account: account}
+}
+
+func (s *IMAPStore) Account() *config.MailAccount {
+	return s.account
+}
+
+// withMailbox borrows a pooled session and selects the mailbox read-only.
+// Connection failures are retried on a fresh session, so fn may run more than
+// once and must reset whatever it collects.
+func (s *IMAPStore) withMailbox(mailbox string, fn func(c *client.Client, mbox *imap.MailboxStatus) error) error {
+	return withMailRetry("IMAP", s.account, func() error {
+		imapClient, err := config.AcquireIMAP(s.account)
+		if err != nil {
+			return fmt.Errorf("failed to connect to IMAP: %w", err)
+		}
+
+		mbox, err := imapClient.Select(mailbox, true)
+		if err == nil {
+			err = fn(imapClient, mbox)
+		} else {
+			err = fmt.Errorf("failed to select %s: %w", mailbox, err)
+		}
+
+		// ✅ A session that lost its connection must not go back to the pool
+		if isTransientMailError(err) {
+			config.DiscardIMAP(s.account, imapClient)
+		} else {
+			config.ReleaseIMAP(s.account, imapClient)
+		}
+		return err
+	})
+}
+
+func (s *IMAPStore) Status(mailbox string) (*MailboxStatus, error) {
+	var status *MailboxStatus
+	err := s.withMailbox(mailbox, func(_ *client.Client, mbox *imap.MailboxStatus) error {
+		status = &MailboxStatus{
+			Name:        mailbox,
+			UIDValidity: mbox.UidValidity,
+			UIDNext:     mbox.UidNext,
+			Messages:    mbox.Messages,
+		}
+		return nil
+	})
+	return status, err
+}
+
+func (s *IMAPStore) Search(mailbox string, filter MailFilter) ([]uint32, error) {
+	var uids []uint32
+	err := s.withMailbox(mailbox, func(c *client.Client, mbox *imap.MailboxStatus) error {
+		uids = nil
+		if mbox.Messages == 0 {
+			return nil
+		}
+
+		criteria := imap.NewSearchCriteria()
+		if filter.From != "" {
+			criteria.Header.Add("From", filter.From)
+		}
+		if filter.To != "" {
+			criteria.Header.Add("To", filter.To)
+		}
+		if filter.MessageID != "" {
+			criteria.Header.Add("Message-Id", normalizeMessageID(filter.MessageID))
+		}
+		if !filter.Since.IsZero() {
+			criteria.Since = filter.Since
+		}
+		if !filter.Before.IsZero() {
+			criteria.Before = filter.Before
+		}
+		if filter.MinUID > 1 {
+			criteria.Uid = new(imap.SeqSet)
+			criteria.Uid.AddRange(filter.MinUID, 0)
+		}
+
+		found, err := c.UidSearch(criteria)
+		if err != nil {
+			return fmt.Errorf("error searching emails: %w", err)
+		}
+		// "n:*" always matches the last message, even when its UID is below n
+		for _, uid := range found {
+			if uid >= filter.MinUID {
+				uids = append(uids, uid)
+			}
+		}
+		return nil
+	})
+	sortUIDs(uids)
+	return uids, err
+}
+
+func (s *IMAPStore) Envelopes(mailbox string, uids []uint32) ([]models.IndexedMessage, error) {
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	var envelopes []models.IndexedMessage
+	err := s.withMailbox(mailbox, func(c *client.Client, mbox *imap.MailboxStatus) error {
+		envelopes = nil
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uids...)
+
+		messages := make(chan *imap.Message, 50)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(seqSet, []imap.FetchItem{
+				imap.FetchEnvelope,
+				imap.FetchBodyStructure,
+				imap.FetchUid,
+				referencesSection.FetchItem(),
+			}, messages)
+		}()
+
+		for msg := range messages {
+			envelopes = append(envelopes, *indexedMessageFromIMAP(msg, mailbox, mbox.UidValidity))
+		}
+		if err := <-done; err != nil {
+			return fmt.Errorf("error while fetching emails: %w", err)
+		}
+		return nil
+	})
+	return envelopes, err
+}
+
+// FetchRaw reads the whole message in one fetch: its callers need all of it in memory anyway
+func (s *IMAPStore) FetchRaw(mailbox string, uid uint32) ([]byte, error) {
+	var raw []byte
+	err := s.withMailbox(mailbox, func(c *client.Client, _ *imap.MailboxStatus) error {
+		raw = nil
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uid)
+		section := &imap.BodySectionName{Peek: true}
+
+		messages := make(chan *imap.Message, 1)
+		if err := c.UidFetch(seqSet, []imap.FetchItem{section.FetchItem()}, messages); err != nil {
+			return fmt.Errorf("fetch error: %w", err)
+		}
+
+		msg := <-messages
+		if msg == nil {
+			return fmt.Errorf("%w: UID %d in %s", ErrMessageNotFound, uid, mailbox)
+		}
+		body := msg.GetBody(section)
+		if body == nil {
+			return fmt.Errorf("email body empty for UID %d", uid)
+		}
+		var err error
+		if raw, err = io.ReadAll(body); err != nil {
+			return fmt.Errorf("error reading body: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// OpenRaw spools the message to a temp file in imapFetchChunk pieces, since
+// go-imap buffers each literal in memory; the file is removed on Close
+func (s *IMAPStore) OpenRaw(mailbox string, uid uint32) (io.ReadCloser, error) {
+	f, err := s.spoolSection(mailbox, uid, imap.BodyPartName{})
+	if err != nil {
+		if errors.Is(err, errSectionMissing) {
+			return nil, fmt.Errorf("email body empty for UID %d", uid)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenPart fetches just the part's MIME header (BODY.PEEK[path.MIME]) and
+// spools its body (BODY.PEEK[path]) to a temp file like OpenRaw, instead of
+// the whole message
+func (s *IMAPStore) OpenPart(mailbox string, uid uint32, path string) (*MessagePart, error) {
+	numbers, err := parsePartPath(path)
+	if err != nil {
+		return nil, err
+	}
+	mimeSection := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.MIMESpecifier, Path: numbers}, Peek: true}
+	// ✅ Part 1 of a single-part message has no MIME header of its own: use the message header
+	headerSection := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier}, Peek: true}
+
+	var header imap.Literal
+	err = s.withMailbox(mailbox, func(c *client.Client, _ *imap.MailboxStatus) error {
+		header = nil
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uid)
+		items := []imap.FetchItem{mimeSection.FetchItem()}
+		if path == "1" {
+			items = append(items, headerSection.FetchItem())
+		}
+
+		messages := make(chan *imap.Message, 1)
+		if err := c.UidFetch(seqSet, items, messages); err != nil {
+			return fmt.Errorf("fetch error: %w", err)
+		}
+
+		msg := <-messages
+		if msg == nil {
+			return fmt.Errorf("%w: UID %d in %s", ErrMessageNotFound, uid, mailbox)
+		}
+		header = msg.GetBody(mimeSection)
+		if (header == nil || header.Len() == 0) && path == "1" {
+			header = msg.GetBody(headerSection)
+		}
+		if header == nil {
+			return fmt.Errorf("%w: part %s of UID %d", ErrAttachmentNotFound, path, uid)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := s.spoolSection(mailbox, uid, imap.BodyPartName{Path: numbers})
+	if err != nil {
+		if errors.Is(err, errSectionMissing) {
+			return nil, fmt.Errorf("%w: part %s of UID %d", ErrAttachmentNotFound, path, uid)
+		}
+		return nil, err
+	}
+
+	// ✅ Header and body together make a MIME entity; go-message undoes the transfer encoding
+	e, err := message.Read(io.MultiReader(header, body))
+	if err != nil && !message.IsUnknownCharset(err) {
+		body.Close()
+		return nil, fmt.Errorf("failed to parse part %s: %w", path, err)
+	}
+	part := messagePartFromEntity(path, e)
+	part.closer = body
+	return part, nil
+}
+
+// errSectionMissing means the server returned no data for a body section
+var errSectionMissing = errors.New("body section missing")
+
+// spoolSection copies a body section of the message into a temp file in the
+// attachment cache, fetching it as BODY.PEEK[section]<offset.imapFetchChunk>
+// so no more than one chunk is held in memory. The file is removed on Close.
+func (s *IMAPStore) spoolSection(mailbox string, uid uint32, part imap.BodyPartName) (*spooledFile, error) {
+	tmpDir := filepath.Join(attachmentCacheDir(), "tmp")
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create attachment cache: %w", err)
+	}
+	tmp, err := os.CreateTemp(tmpDir, "fetch-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	f := &spooledFile{File: tmp}
+
+	err = s.withMailbox(mailbox, func(c *client.Client, _ *imap.MailboxStatus) error {
+		// ✅ A retry starts the download over
+		if err := tmp.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uid)
+
+		for offset := 0; ; offset += imapFetchChunk {
+			section := &imap.BodySectionName{BodyPartName: part, Peek: true, Partial: []int{offset, imapFetchChunk}}
+			messages := make(chan *imap.Message, 1)
+			if err := c.UidFetch(seqSet, []imap.FetchItem{section.FetchItem()}, messages); err != nil {
+				return fmt.Errorf("fetch error: %w", err)
+			}
+
+			msg := <-messages
+			if msg == nil {
+				return fmt.Errorf("%w: UID %d in %s", ErrMessageNotFound, uid, mailbox)
+			}
+			chunk := msg.GetBody(section)
+			if chunk == nil {
+				if offset == 0 {
+					return errSectionMissing
+				}
+				return nil
+			}
+			n, err := io.Copy(tmp, chunk)
+			if err != nil {
+				return fmt.Errorf("failed to write spool file: %w", err)
+			}
+			switch {
+			case n > imapFetchChunk && offset > 0:
+				return fmt.Errorf("server ignored the partial fetch of UID %d", uid)
+			case n != imapFetchChunk:
+				return nil // the last chunk, or the whole section from a server that ignores partials
+			}
+		}
+	})
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// spooledFile is a temp file that is removed when closed
+type spooledFile struct {
+	*os.File
+}
+
+func (f *spooledFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// Append stores raw in mailbox. A server that answers NO because the mailbox
+// doesn't exist yet (TRYCREATE) gets a CREATE and a second APPEND. A dropped
+// connection is retried like every other call, which can leave a second copy
+// behind; the views collapse copies by Message-ID.
+func (s *IMAPStore) Append(mailbox string, flags []string, date time.Time, raw []byte) error {
+	return withMailRetry("IMAP", s.account, func() error {
+		imapClient, err := config.AcquireIMAP(s.account)
+		if err != nil {
+			return fmt.Errorf("failed to connect to IMAP: %w", err)
+		}
+
+		err = imapClient.Append(mailbox, flags, date, bytes.NewReader(raw))
+		if err != nil && !isTransientMailError(err) {
+			if createErr := imapClient.Create(mailbox); createErr == nil {
+				log.Printf("📁 Created mailbox %s for account %s", mailbox, s.account.ID)
+				err = imapClient.Append(mailbox, flags, date, bytes.NewReader(raw))
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to append to %s: %w", mailbox, err)
+		}
+
+		if isTransientMailError(err) {
+			config.DiscardIMAP(s.account, imapClient)
+		} else {
+			config.ReleaseIMAP(s.account, imapClient)
+		}
+		return err
+	})
+}
+
+// ensureMailbox creates mailbox unless the server already has it
+func (s *IMAPStore) ensureMailbox(mailbox string) error {
+	return withMailRetry("IMAP", s.account, func() error {
+		imapClient, err := config.AcquireIMAP(s.account)
+		if err != nil {
+			return fmt.Errorf("failed to connect to IMAP: %w", err)
+		}
+
+		if _, err = imapClient.Status(mailbox, []imap.StatusItem{imap.StatusUidValidity}); err != nil && !isTransientMailError(err) {
+			if err = imapClient.Create(mailbox); err == nil {
+				log.Printf("📁 Created mailbox %s for account %s", mailbox, s.account.ID)
+			} else {
+				err = fmt.Errorf("failed to create %s: %w", mailbox, err)
+			}
+		}
+
+		if isTransientMailError(err) {
+			config.DiscardIMAP(s.account, imapClient)
+		} else {
+			config.ReleaseIMAP(s.account, imapClient)
+		}
+		return err
+	})
+}
+
+// indexedMessageFromIMAP builds the index entry of a fetched message. Messages
+// without From or To are indexed too, with empty address fields, so the index
+// holds every message of the mailbox and its count can be checked against it.
+func indexedMessageFromIMAP(m *imap.Message, mailbox string, uidValidity uint32) *models.IndexedMessage {
+	envelope := m.Envelope
+	if envelope == nil {
+		envelope = &imap.Envelope{}
+	}
+
+	var from, fromName, to string
+	if len(envelope.From) > 0 {
+		from, fromName = strings.ToLower(envelope.From[0].Address()), decodeHeaderText(envelope.From[0].PersonalName)
+	}
+	if len(envelope.To) > 0 {
+		to = envelope.To[0].Address()
+	}
+
+	var recipients []string
+	for _, addr := range envelope.To {
+		recipients = append(recipients, strings.ToLower(addr.Address()))
+	}
+
+	attachments := attachmentsFromStructure(m.BodyStructure, "")
+
+	// ✅ ENVELOPE carries In-Reply-To but not References, which is fetched as a header field
+	var references []string
+	if body := m.GetBody(referencesSection); body != nil {
+		if data, err := io.ReadAll(body); err == nil {
+			references = parseMessageIDList(string(data))
+		}
+	}
+
+	env := &models.IndexedMessage{
+		Mailbox:         mailbox,
+		UIDValidity:     uidValidity,
+		UID:             m.Uid,
+		MessageID:       normalizeMessageID(envelope.MessageId),
+		InReplyTo:       firstMessageID(envelope.InReplyTo),
+		References:      references,
+		Subject:         decodeHeaderText(envelope.Subject),
+		From:            from,
+		FromName:        fromName,
+		To:              to,
+		Recipients:      recipients,
+		Date:            envelope.Date,
+		AttachmentNames: attachmentNamesOf(attachments),
+		Attachments:     attachments,
+		IndexedAt:       time.Now(),
+	}
+	env.ThreadID = threadIDFor(env)
+	return env
+}
+
+// referencesSection fetches just the References header without setting \Seen
+var referencesSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"References"}},
+	Peek:         true,
+}
@@ -0,0 +1,35 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestIndexedMessageFromIMAP(t *testing.T) {
+	lab := &imap.Address{PersonalName: "Lab", MailboxName: "Lab", HostName: "Example.com"}
+	clinic := &imap.Address{MailboxName: "clinic", HostName: "example.com"}
+
+	tests := []struct {
+		name     string
+		envelope *imap.Envelope
+		wantFrom string
+		wantTo   string
+	}{
+		{"addressed", &imap.Envelope{From: []*imap.Address{lab}, To: []*imap.Address{clinic}}, "lab@example.com", "clinic@example.com"},
+		{"no from", &imap.Envelope{To: []*imap.Address{clinic}}, "", "clinic@example.com"},
+		{"no to", &imap.Envelope{From: []*imap.Address{lab}}, "lab@example.com", ""},
+		{"no envelope", nil, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := indexedMessageFromIMAP(&imap.Message{Uid: 7, Envelope: tt.envelope}, "INBOX", 1)
+			if env == nil {
+				t.Fatal("message not indexed")
+			}
+			if env.UID != 7 || env.From != tt.wantFrom || env.To != tt.wantTo {
+				t.Errorf("got uid %d from %q to %q, want 7 %q %q", env.UID, env.From, env.To, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"email-client/config"
+	"fmt"
+	"log"
+	"sync"
+)
+
+var (
+	mailStoresMu sync.RWMutex
+	mailStores   = make(map[string]MailStore) // account id → store
+)
+
+// InitMailStores opens a MailStore for every configured clinic account
+func InitMailStores() ([]MailStore, error) {
+	var stores []MailStore
+	for _, account := range config.MailAccounts() {
+		store, err := NewMailStoreFromEnv(account)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open mail store for account %s: %w", account.ID, err)
+		}
+		// ✅ The archive is read like any other folder, so it has to exist before the first report lands in it
+		if imapStore, ok := store.(*IMAPStore); ok && config.ArchiveMailbox() != "" {
+			if err := imapStore.ensureMailbox(config.ArchiveMailbox()); err != nil {
+				log.Printf("⚠️ Archive mailbox %s unavailable for account %s: %v", config.ArchiveMailbox(), account.ID, err)
+			}
+		}
+		stores = append(stores, store)
+	}
+
+	mailStoresMu.Lock()
+	mailStores = make(map[string]MailStore, len(stores))
+	for _, store := range stores {
+		mailStores[store.Account().ID] = store
+	}
+	mailStoresMu.Unlock()
+
+	return stores, nil
+}
+
+// MailStoreFor returns the store of a clinic account
+func MailStoreFor(account *config.MailAccount) (MailStore, error) {
+	mailStoresMu.RLock()
+	defer mailStoresMu.RUnlock()
+
+	store, ok := mailStores[account.ID]
+	if !ok {
+		return nil, fmt.Errorf("%w: no mail store for %s", config.ErrNoMailAccount, account.ID)
+	}
+	return store, nil
+}
+
+// MailStoreForEmail resolves the doctor's clinic account and returns its store
+func MailStoreForEmail(email string) (MailStore, error) {
+	account, err := config.MailAccountForEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	return MailStoreFor(account)
+}
@@ -0,0 +1,60 @@
+package services
+
+import (
+	"email-client/models"
+	"log"
+	"sync"
+)
+
+// MailEvent is published for every message that newly lands in the mail index
+type MailEvent struct {
+	Account    string // MailAccount id the message arrived in
+	Message    models.Message
+	Recipients []string
+}
+
+var (
+	mailEventMu          sync.RWMutex
+	mailEventSubscribers = make(map[chan MailEvent]struct{})
+)
+
+// SubscribeMailEvents registers a listener for new-message events. The returned
+// function must be called to unsubscribe once the listener goes away.
+func SubscribeMailEvents() (<-chan MailEvent, func()) {
+	ch := make(chan MailEvent, 32)
+
+	mailEventMu.Lock()
+	mailEventSubscribers[ch] = struct{}{}
+	mailEventMu.Unlock()
+
+	return ch, func() {
+		mailEventMu.Lock()
+		if _, ok := mailEventSubscribers[ch]; ok {
+			delete(mailEventSubscribers, ch)
+			close(ch)
+		}
+		mailEventMu.Unlock()
+	}
+}
+
+// publishMailEvents fans new index entries out to every subscriber. Slow
+// subscribers miss events rather than block the sync.
+func publishMailEvents(account string, docs []models.IndexedMessage) {
+	if len(docs) == 0 {
+		return
+	}
+
+	mailEventMu.RLock()
+	defer mailEventMu.RUnlock()
+
+	for _, doc := range docs {
+		event := MailEvent{Account: account, Message: messageFromIndex(doc), Recipients: doc.Recipients}
+		for ch := range mailEventSubscribers {
+			select {
+			case ch <- event:
+			default:
+				log.Println("⚠️ Mail event subscriber is full, dropping event")
+			}
+		}
+	}
+}
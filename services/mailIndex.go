@@ -0,0 +1,539 @@
+package services
+
+import (
+	"context"
+	"email-client/config"
+	"email-client/models"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultMailIndexInterval = 2 * time.Minute
+	mailIndexFetchBatch      = 500
+
+	// mailIndexVersion is stored with every entry; bump it when the way
+	// envelopes are read changes, so older entries are indexed again (once
+	// per account, see migrateMailIndex).
+	// 2: threading data, 3: charset-aware subjects and attachment names,
+	// 4: attachment part paths, 5: messages without From or To
+	mailIndexVersion = 5
+)
+
+// syncMu makes sure only one sync touches the index at a time
+var syncMu sync.Mutex
+
+// StartMailIndexSync runs SyncMailIndex for every account's store immediately
+// and then on every interval until the returned stop function is called. Each
+// round also works through the full-text search backlog.
+func StartMailIndexSync(stores []MailStore) (stop func()) {
+	interval := defaultMailIndexInterval
+	if v, err := time.ParseDuration(os.Getenv("MAIL_INDEX_SYNC_INTERVAL")); err == nil && v > 0 {
+		interval = v
+	}
+
+	if err := runMailIndexMigrations(stores); err != nil {
+		log.Printf("⚠️ MailIndex migration failed, retried on the next start: %v", err)
+	}
+	if err := ensureMailIndexes(); err != nil {
+		log.Printf("⚠️ Could not create MailIndex indexes: %v", err)
+	}
+	if err := ensureSearchIndexes(); err != nil {
+		log.Printf("⚠️ Could not create MailSearch indexes: %v", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			for _, store := range stores {
+				if err := SyncMailIndex(store); err != nil {
+					log.Printf("❌ Mail index sync for account %s failed: %v", store.Account().ID, err)
+				}
+				if err := IndexSearchBacklog(store); err != nil {
+					log.Printf("❌ Search indexing for account %s failed: %v", store.Account().ID, err)
+				}
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	log.Printf("✅ Mail index sync started (every %v)", interval)
+	return func() {
+		close(done)
+		wg.Wait()
+		log.Println("✅ Mail index sync stopped")
+	}
+}
+
+func ensureMailIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	indexCol := config.GetMailIndexCollection()
+	stateCol := config.GetMailSyncStateCollection()
+
+	_, err := indexCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "account", Value: 1}, {Key: "mailbox", Value: 1}, {Key: "uid_validity", Value: 1}, {Key: "uid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "account", Value: 1}, {Key: "from", Value: 1}, {Key: "date", Value: -1}}},
+		{Keys: bson.D{{Key: "account", Value: 1}, {Key: "recipients", Value: 1}, {Key: "date", Value: -1}}},
+		{Keys: bson.D{{Key: "account", Value: 1}, {Key: "message_id", Value: 1}}},
+		{Keys: bson.D{{Key: "account", Value: 1}, {Key: "thread_id", Value: 1}, {Key: "date", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = stateCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "account", Value: 1}, {Key: "mailbox", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// SyncMailIndex catches the MailIndex collection up with every configured
+// folder of the store's account using UIDVALIDITY/UIDNEXT. A changed UIDVALIDITY throws
+// the folder's old entries away and re-indexes it from scratch; expunged
+// messages are dropped, see reconcileExpunged.
+func SyncMailIndex(store MailStore) error {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	var failed []string
+	for _, folder := range config.MailFolders() {
+		if err := syncMailbox(store, folder); err != nil {
+			log.Printf("❌ Mail index sync of %s failed: %v", folder, err)
+			failed = append(failed, folder)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("sync failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func syncMailbox(store MailStore, mailbox string) error {
+	startTime := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	account := store.Account().ID
+	state, err := loadMailSyncState(ctx, account, mailbox)
+	if err != nil {
+		return fmt.Errorf("failed to load sync state: %w", err)
+	}
+
+	mbox, err := store.Status(mailbox)
+	if err != nil {
+		return fmt.Errorf("failed to read mailbox status: %w", err)
+	}
+
+	// ✅ UIDVALIDITY changed: every stored UID is meaningless now
+	fullResync := state.UIDValidity != mbox.UIDValidity
+	if fullResync {
+		if state.UIDValidity != 0 {
+			log.Printf("⚠️ UIDVALIDITY changed for %s (%d → %d), running full resync", mailbox, state.UIDValidity, mbox.UIDValidity)
+		}
+		if _, err := config.GetMailIndexCollection().DeleteMany(ctx, bson.M{"account": account, "mailbox": mailbox}); err != nil {
+			return fmt.Errorf("failed to clear stale index: %w", err)
+		}
+		if _, err := config.GetMailSearchCollection().DeleteMany(ctx, bson.M{"account": account, "mailbox": mailbox}); err != nil {
+			return fmt.Errorf("failed to clear stale search entries: %w", err)
+		}
+		state = &models.MailSyncState{Account: account, Mailbox: mailbox, UIDValidity: mbox.UIDValidity, UIDNext: 1}
+	}
+
+	if mbox.Messages == 0 || (mbox.UIDNext != 0 && state.UIDNext >= mbox.UIDNext) {
+		if err := reconcileExpunged(ctx, store, mailbox, mbox); err != nil {
+			return err
+		}
+		state.UIDNext = maxUint32(state.UIDNext, mbox.UIDNext)
+		return saveMailSyncState(ctx, state)
+	}
+
+	// ✅ Fetch only what arrived since the last sync
+	uids, err := store.Search(mailbox, MailFilter{MinUID: state.UIDNext})
+	if err != nil {
+		return fmt.Errorf("failed to search new messages: %w", err)
+	}
+
+	var arrived []models.IndexedMessage // announced to live listeners, not on full resync
+	highestUID := state.UIDNext - 1
+	indexed := 0
+
+	for start := 0; start < len(uids); start += mailIndexFetchBatch {
+		end := start + mailIndexFetchBatch
+		if end > len(uids) {
+			end = len(uids)
+		}
+
+		envelopes, err := store.Envelopes(mailbox, uids[start:end])
+		if err != nil {
+			return fmt.Errorf("error while fetching envelopes: %w", err)
+		}
+
+		var batch []mongo.WriteModel
+		for i := range envelopes {
+			doc := &envelopes[i]
+			doc.Account = account
+			doc.IndexVersion = mailIndexVersion
+			doc.IndexedAt = time.Now()
+			batch = append(batch, mongo.NewReplaceOneModel().
+				SetFilter(bson.M{"account": account, "mailbox": doc.Mailbox, "uid_validity": doc.UIDValidity, "uid": doc.UID}).
+				SetReplacement(doc).
+				SetUpsert(true))
+			if !fullResync {
+				arrived = append(arrived, *doc)
+			}
+		}
+		if len(batch) > 0 {
+			if err := writeIndexBatch(ctx, batch); err != nil {
+				return fmt.Errorf("failed to write index: %w", err)
+			}
+		}
+		indexed += len(batch)
+
+		// ✅ Checkpoint after each batch so a failed sync resumes where it stopped
+		if last := uids[end-1]; last > highestUID {
+			highestUID = last
+			state.UIDNext = highestUID + 1
+			if err := saveMailSyncState(ctx, state); err != nil {
+				return fmt.Errorf("failed to save sync state: %w", err)
+			}
+		}
+	}
+
+	if !fullResync {
+		if err := reconcileExpunged(ctx, store, mailbox, mbox); err != nil {
+			return err
+		}
+	}
+
+	state.UIDNext = maxUint32(mbox.UIDNext, highestUID+1)
+	if err := saveMailSyncState(ctx, state); err != nil {
+		return fmt.Errorf("failed to save sync state: %w", err)
+	}
+
+	publishMailEvents(account, arrived)
+
+	log.Printf("✅ Mail index synced %s/%s: %d new messages in %v ms", account, mailbox, indexed, time.Since(startTime).Milliseconds())
+	return nil
+}
+
+// reconcileExpunged drops the index and search entries of messages that were
+// expunged from mailbox or moved out of it. Every UID is only fetched when the
+// number of entries differs from the mailbox's message count.
+func reconcileExpunged(ctx context.Context, store MailStore, mailbox string, mbox *MailboxStatus) error {
+	account := store.Account().ID
+	filter := bson.M{"account": account, "mailbox": mailbox, "uid_validity": mbox.UIDValidity}
+
+	indexCol := config.GetMailIndexCollection()
+	indexed, err := indexCol.CountDocuments(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("failed to count index entries: %w", err)
+	}
+	if indexed == int64(mbox.Messages) {
+		return nil
+	}
+
+	uids, err := store.Search(mailbox, MailFilter{})
+	if err != nil {
+		return fmt.Errorf("failed to list messages: %w", err)
+	}
+	present := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		present[uid] = true
+	}
+
+	cursor, err := indexCol.Find(ctx, filter, options.Find().SetProjection(bson.M{"uid": 1}))
+	if err != nil {
+		return fmt.Errorf("failed to list index entries: %w", err)
+	}
+	var entries []struct {
+		UID uint32 `bson:"uid"`
+	}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return fmt.Errorf("failed to decode index entries: %w", err)
+	}
+	var gone []uint32
+	for _, e := range entries {
+		if !present[e.UID] {
+			gone = append(gone, e.UID)
+		}
+	}
+	if len(gone) == 0 {
+		return nil
+	}
+
+	expunged := bson.M{"account": account, "mailbox": mailbox, "uid_validity": mbox.UIDValidity, "uid": bson.M{"$in": gone}}
+	if _, err := indexCol.DeleteMany(ctx, expunged); err != nil {
+		return fmt.Errorf("failed to delete expunged entries: %w", err)
+	}
+	if _, err := config.GetMailSearchCollection().DeleteMany(ctx, expunged); err != nil {
+		return fmt.Errorf("failed to delete expunged search entries: %w", err)
+	}
+	log.Printf("🧹 Removed %d expunged messages from the index of %s/%s", len(gone), account, mailbox)
+	return nil
+}
+
+func writeIndexBatch(ctx context.Context, batch []mongo.WriteModel) error {
+	_, err := config.GetMailIndexCollection().BulkWrite(ctx, batch, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func loadMailSyncState(ctx context.Context, account, mailbox string) (*models.MailSyncState, error) {
+	var state models.MailSyncState
+	err := config.GetMailSyncStateCollection().FindOne(ctx, bson.M{"account": account, "mailbox": mailbox}).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		return &models.MailSyncState{Account: account, Mailbox: mailbox, UIDNext: 1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func saveMailSyncState(ctx context.Context, state *models.MailSyncState) error {
+	state.SyncedAt = time.Now()
+	_, err := config.GetMailSyncStateCollection().ReplaceOne(ctx,
+		bson.M{"account": state.Account, "mailbox": state.Mailbox},
+		state,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// mailIndexReady reports whether every configured folder of the account has completed at least one sync
+func mailIndexReady(account string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	folders := config.MailFolders()
+	count, err := config.GetMailSyncStateCollection().CountDocuments(ctx, bson.M{"account": account, "mailbox": bson.M{"$in": folders}})
+	return err == nil && count >= int64(len(folders))
+}
+
+// QueryMailIndex returns the account's indexed messages newest first. fromFilter
+// matches the sender address exactly and toFilter matches any recipient as a
+// substring, mirroring the IMAP HEADER searches it replaces.
+func QueryMailIndex(account, fromFilter, toFilter string) ([]models.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := mailIndexFilter(account, fromFilter, toFilter, MessageQuery{})
+	return findIndexedMessages(ctx, filter, options.Find().SetSort(mailIndexSort))
+}
+
+// QueryMailIndexPage is QueryMailIndex narrowed to query's date range and page,
+// with the total number of matches. With query.Threads the page holds threads
+// instead of single messages. Copies of one message in several folders are
+// listed once, see dedupeStages.
+func QueryMailIndexPage(account, fromFilter, toFilter string, query MessageQuery) (*MessagePage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := mailIndexFilter(account, fromFilter, toFilter, query)
+	if query.Threads {
+		return queryMailIndexThreads(ctx, filter, query)
+	}
+
+	pipeline := append(mongo.Pipeline{{{Key: "$match", Value: filter}}}, dedupeStages()...)
+	pipeline = append(pipeline,
+		bson.D{{Key: "$sort", Value: mailIndexSort}},
+		bson.D{{Key: "$facet", Value: bson.M{
+			"total": bson.A{bson.M{"$count": "n"}},
+			"page":  bson.A{bson.M{"$skip": query.offset()}, bson.M{"$limit": query.Limit}},
+		}}},
+	)
+
+	cursor, err := config.GetMailIndexCollection().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("index query failed: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var result []struct {
+		Total []struct {
+			N int64 `bson:"n"`
+		} `bson:"total"`
+		Page []models.IndexedMessage `bson:"page"`
+	}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode index entries: %w", err)
+	}
+
+	var total int64
+	var messages []models.Message
+	if len(result) > 0 {
+		if len(result[0].Total) > 0 {
+			total = result[0].Total[0].N
+		}
+		for _, doc := range result[0].Page {
+			messages = append(messages, messageFromIndex(doc))
+		}
+	}
+	return newMessagePage(messages, total, query), nil
+}
+
+// queryMailIndexThreads groups the matching messages by thread_id, latest thread first
+func queryMailIndexThreads(ctx context.Context, filter bson.M, query MessageQuery) (*MessagePage, error) {
+	pipeline := append(mongo.Pipeline{{{Key: "$match", Value: filter}}}, dedupeStages()...)
+	pipeline = append(pipeline, mongo.Pipeline{
+		{{Key: "$sort", Value: mailIndexSort}},
+		{{Key: "$group", Value: bson.M{
+			"_id":         "$thread_id",
+			"latest_date": bson.M{"$first": "$date"},
+			"messages":    bson.M{"$push": "$$ROOT"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "latest_date", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$facet", Value: bson.M{
+			"total": bson.A{bson.M{"$count": "n"}},
+			"page":  bson.A{bson.M{"$skip": query.offset()}, bson.M{"$limit": query.Limit}},
+		}}},
+	}...)
+
+	cursor, err := config.GetMailIndexCollection().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("thread query failed: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var result []struct {
+		Total []struct {
+			N int64 `bson:"n"`
+		} `bson:"total"`
+		Page []struct {
+			ID       string                  `bson:"_id"`
+			Messages []models.IndexedMessage `bson:"messages"`
+		} `bson:"page"`
+	}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode threads: %w", err)
+	}
+
+	var total int64
+	var threads []models.Thread
+	if len(result) > 0 {
+		if len(result[0].Total) > 0 {
+			total = result[0].Total[0].N
+		}
+		for _, group := range result[0].Page {
+			thread := models.Thread{ID: group.ID}
+			for _, doc := range group.Messages {
+				thread.Messages = append(thread.Messages, messageFromIndex(doc))
+			}
+			finishThread(&thread)
+			threads = append(threads, thread)
+		}
+	}
+	return newThreadPage(threads, total, query), nil
+}
+
+// indexedFromName returns the sender name on the latest indexed message from email
+func indexedFromName(account, email string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var doc models.IndexedMessage
+	err := config.GetMailIndexCollection().FindOne(ctx,
+		bson.M{"account": account, "from": strings.ToLower(strings.TrimSpace(email)), "from_name": bson.M{"$ne": ""}},
+		options.FindOne().SetSort(bson.D{{Key: "date", Value: -1}}),
+	).Decode(&doc)
+	if err != nil {
+		return "", err
+	}
+	return doc.FromName, nil
+}
+
+// mailIndexSort lists newest first, with a stable order for equal dates so pages don't overlap
+var mailIndexSort = bson.D{{Key: "date", Value: -1}, {Key: "mailbox", Value: 1}, {Key: "uid", Value: -1}}
+
+func mailIndexFilter(account, fromFilter, toFilter string, query MessageQuery) bson.M {
+	filter := bson.M{"account": account, "mailbox": bson.M{"$in": config.MailFolders()}}
+	if fromFilter != "" {
+		filter["from"] = strings.ToLower(strings.TrimSpace(fromFilter))
+	}
+	if toFilter != "" {
+		filter["recipients"] = bson.M{"$regex": regexp.QuoteMeta(strings.ToLower(strings.TrimSpace(toFilter)))}
+	}
+
+	dateRange := bson.M{}
+	if !query.Since.IsZero() {
+		dateRange["$gte"] = truncateToDay(query.Since)
+	}
+	if !query.Before.IsZero() {
+		dateRange["$lt"] = truncateToDay(query.Before)
+	}
+	if len(dateRange) > 0 {
+		filter["date"] = dateRange
+	}
+	return filter
+}
+
+func findIndexedMessages(ctx context.Context, filter bson.M, opts *options.FindOptions) ([]models.Message, error) {
+	cursor, err := config.GetMailIndexCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("index query failed: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var docs []models.IndexedMessage
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to decode index entries: %w", err)
+	}
+
+	messages := make([]models.Message, 0, len(docs))
+	for _, doc := range docs {
+		messages = append(messages, messageFromIndex(doc))
+	}
+	return messages, nil
+}
+
+func messageFromIndex(doc models.IndexedMessage) models.Message {
+	return models.Message{
+		ID:              documentIDFromIndex(doc),
+		UID:             doc.UID,
+		Folder:          doc.Mailbox,
+		Subject:         doc.Subject,
+		From:            doc.From,
+		FromName:        doc.FromName,
+		To:              doc.To,
+		Date:            doc.Date.Format("Jan 02 2006 03:04 PM"),
+		AttachmentNames: doc.AttachmentNames,
+		Attachments:     doc.Attachments,
+		MessageID:       doc.MessageID,
+		InReplyTo:       doc.InReplyTo,
+		References:      doc.References,
+		ThreadID:        doc.ThreadID,
+		DICOM:           doc.DICOM,
+	}
+}
+
+func maxUint32(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"email-client/config"
+	"email-client/models"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// legacyMigrationID is the MailIndexMeta document of the one-off cleanup of
+// entries written before per-clinic accounts
+const legacyMigrationID = "legacy"
+
+// migrateLegacyMailIndex drops the entries, sync state and unique indexes from
+// before per-clinic accounts. It runs once and before ensureMailIndexes, whose
+// per-account indexes would clash with the old ones.
+func migrateLegacyMailIndex(ctx context.Context) error {
+	done, err := loadMailIndexMeta(ctx, legacyMigrationID)
+	if err != nil || done != nil {
+		return err
+	}
+
+	indexCol := config.GetMailIndexCollection()
+	stateCol := config.GetMailSyncStateCollection()
+	if err := dropIndexIfExists(ctx, indexCol, "mailbox_1_uid_validity_1_uid_1"); err != nil {
+		return fmt.Errorf("failed to drop legacy MailIndex index: %w", err)
+	}
+	if err := dropIndexIfExists(ctx, stateCol, "mailbox_1"); err != nil {
+		return fmt.Errorf("failed to drop legacy MailSyncState index: %w", err)
+	}
+
+	// ✅ Entries without an owner: they are indexed again under their account
+	legacy := bson.M{"account": bson.M{"$exists": false}}
+	for _, col := range []*mongo.Collection{indexCol, config.GetMailSearchCollection(), stateCol} {
+		res, err := col.DeleteMany(ctx, legacy)
+		if err != nil {
+			return fmt.Errorf("failed to delete legacy %s entries: %w", col.Name(), err)
+		}
+		if res.DeletedCount > 0 {
+			log.Printf("🧹 Dropped %d %s entries from before per-clinic accounts", res.DeletedCount, col.Name())
+		}
+	}
+	return saveMailIndexMeta(ctx, legacyMigrationID, 0)
+}
+
+// migrateMailIndex re-indexes an account whose entries were written by an
+// older indexer (no thread data, garbled charsets, ...), once per bump of
+// mailIndexVersion. Other accounts' entries and sync state are left alone.
+func migrateMailIndex(ctx context.Context, account string) error {
+	meta, err := loadMailIndexMeta(ctx, account)
+	if err != nil {
+		return err
+	}
+	if meta != nil && meta.IndexVersion == mailIndexVersion {
+		return nil
+	}
+
+	indexCol := config.GetMailIndexCollection()
+	outdated := bson.M{"account": account, "index_version": bson.M{"$ne": mailIndexVersion}}
+	n, err := indexCol.CountDocuments(ctx, outdated)
+	if err != nil {
+		return fmt.Errorf("failed to count outdated entries: %w", err)
+	}
+
+	if n > 0 {
+		log.Printf("⚠️ Account %s has %d index entries from an older indexer, re-indexing", account, n)
+		if _, err := indexCol.DeleteMany(ctx, outdated); err != nil {
+			return fmt.Errorf("failed to delete outdated entries: %w", err)
+		}
+		if _, err := config.GetMailSearchCollection().DeleteMany(ctx, outdated); err != nil {
+			return fmt.Errorf("failed to delete outdated search entries: %w", err)
+		}
+		// ✅ Without sync state every folder is indexed again from scratch
+		if _, err := config.GetMailSyncStateCollection().DeleteMany(ctx, bson.M{"account": account}); err != nil {
+			return fmt.Errorf("failed to reset sync state: %w", err)
+		}
+	}
+	return saveMailIndexMeta(ctx, account, mailIndexVersion)
+}
+
+// runMailIndexMigrations brings the MailIndex up to date before the first sync.
+// An account whose migration failed is retried on the next start.
+func runMailIndexMigrations(stores []MailStore) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	if err := migrateLegacyMailIndex(ctx); err != nil {
+		return err
+	}
+	var errs []error
+	for _, store := range stores {
+		account := store.Account().ID
+		if err := migrateMailIndex(ctx, account); err != nil {
+			errs = append(errs, fmt.Errorf("account %s: %w", account, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func loadMailIndexMeta(ctx context.Context, id string) (*models.MailIndexMeta, error) {
+	var meta models.MailIndexMeta
+	err := config.GetMailIndexMetaCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&meta)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load index migration state: %w", err)
+	}
+	return &meta, nil
+}
+
+func saveMailIndexMeta(ctx context.Context, id string, version int) error {
+	_, err := config.GetMailIndexMetaCollection().ReplaceOne(ctx,
+		bson.M{"_id": id},
+		models.MailIndexMeta{ID: id, IndexVersion: version, MigratedAt: time.Now()},
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save index migration state: %w", err)
+	}
+	return nil
+}
+
+// dropIndexIfExists drops an index, which is fine to find already gone
+func dropIndexIfExists(ctx context.Context, col *mongo.Collection, name string) error {
+	_, err := col.Indexes().DropOne(ctx, name)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Name == "IndexNotFound" || cmdErr.Name == "NamespaceNotFound") {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,450 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"email-client/config"
+	"email-client/models"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/emersion/go-message/mail"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	searchIndexBatch    = 50
+	searchIndexBudget   = 1 * time.Minute // per sync tick, so a large backlog doesn't hold up the index sync
+	searchMaxPDFSize    = 20 << 20
+	searchPDFTimeout    = 30 * time.Second
+	searchSnippetRadius = 80
+)
+
+// SearchQuery is a full-text search limited to what Doctor may see. Patient
+// (a mobile number) narrows it to one patient the way EmailHandler's "to" does.
+type SearchQuery struct {
+	Text    string
+	Doctor  string
+	Patient string
+	Page    MessageQuery
+}
+
+// SearchHit is one matching message with the text around the first match
+type SearchHit struct {
+	models.Message
+	Snippet string  `json:"snippet"`
+	Score   float64 `json:"score"`
+}
+
+// SearchPage is one page of search results, best match first
+type SearchPage struct {
+	Results    []SearchHit `json:"results"`
+	Total      int64       `json:"total"`
+	Page       int         `json:"page"`
+	Limit      int         `json:"limit"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+func ensureSearchIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := config.GetMailSearchCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "account", Value: 1}, {Key: "mailbox", Value: 1}, {Key: "uid_validity", Value: 1}, {Key: "uid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// ✅ No stemming or stop words: report terms like "HbA1c" must match as typed
+			Keys: bson.D{{Key: "subject", Value: "text"}, {Key: "body", Value: "text"}, {Key: "attachment_text", Value: "text"}},
+			Options: options.Index().
+				SetName("mail_search_text").
+				SetDefaultLanguage("none").
+				SetWeights(bson.D{{Key: "subject", Value: 10}, {Key: "body", Value: 2}, {Key: "attachment_text", Value: 1}}),
+		},
+	})
+	return err
+}
+
+// IndexSearchBacklog extracts the body and PDF attachment text of messages that
+// are in the MailIndex but not yet in MailSearch, newest first. Attachment
+// text is only extracted once the attachments were scanned clean.
+func IndexSearchBacklog(store MailStore) error {
+	account := store.Account().ID
+	deadline := time.Now().Add(searchIndexBudget)
+	indexed := 0
+
+	for time.Now().Before(deadline) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		docs, err := pendingSearchDocs(ctx, account)
+		if err != nil {
+			cancel()
+			return err
+		}
+		if len(docs) == 0 {
+			cancel()
+			break
+		}
+
+		for _, doc := range docs {
+			if err := indexSearchDoc(ctx, store, doc); err != nil {
+				cancel()
+				return err
+			}
+			indexed++
+		}
+		cancel()
+	}
+
+	if indexed > 0 {
+		log.Printf("✅ Search index: %d messages indexed for account %s", indexed, account)
+	}
+	return nil
+}
+
+func pendingSearchDocs(ctx context.Context, account string) ([]models.IndexedMessage, error) {
+	cursor, err := config.GetMailIndexCollection().Find(ctx,
+		bson.M{"account": account, "mailbox": bson.M{"$in": config.MailFolders()}, "search_indexed": bson.M{"$ne": true}},
+		options.Find().SetSort(bson.D{{Key: "date", Value: -1}}).SetLimit(searchIndexBatch),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list unindexed messages: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var docs []models.IndexedMessage
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to decode unindexed messages: %w", err)
+	}
+	return docs, nil
+}
+
+func indexSearchDoc(ctx context.Context, store MailStore, doc models.IndexedMessage) error {
+	key := bson.M{"account": doc.Account, "mailbox": doc.Mailbox, "uid_validity": doc.UIDValidity, "uid": doc.UID}
+
+	set := bson.M{"search_indexed": true}
+	raw, err := store.FetchRaw(doc.Mailbox, doc.UID)
+	switch {
+	case errors.Is(err, ErrMessageNotFound):
+		log.Printf("⚠️ Message %s/%d vanished before it could be search-indexed", doc.Mailbox, doc.UID)
+	case err != nil:
+		return fmt.Errorf("failed to fetch message %d: %w", doc.UID, err)
+	default:
+		// Attachments that weren't found clean by StartAttachmentScanner are not
+		// handed to pdftotext or the DICOM parser; the scanner re-queues the
+		// message once it has a verdict
+		body, attachmentText, studies := extractSearchText(raw, doc.MalwareScan == malwareScanClean)
+		doc.SearchIndexed = true
+		doc.DICOM = studies
+		if len(studies) > 0 {
+			set["dicom"] = studies
+		}
+		entry := models.SearchDocument{IndexedMessage: doc, Body: body, AttachmentText: attachmentText}
+		if _, err := config.GetMailSearchCollection().ReplaceOne(ctx, key, entry, options.Replace().SetUpsert(true)); err != nil {
+			return fmt.Errorf("failed to write search entry: %w", err)
+		}
+	}
+
+	// ✅ Left pending if the scanner gave its verdict in the meantime
+	filter := bson.M{"account": doc.Account, "mailbox": doc.Mailbox, "uid_validity": doc.UIDValidity, "uid": doc.UID, "malware_scan": doc.MalwareScan}
+	if doc.MalwareScan == "" {
+		filter["malware_scan"] = bson.M{"$in": bson.A{nil, ""}}
+	}
+	_, err = config.GetMailIndexCollection().UpdateOne(ctx, filter, bson.M{"$set": set})
+	return err
+}
+
+// extractSearchText returns the message's body as plain text and, with
+// withAttachments, the text of its PDF attachments and the metadata of its
+// DICOM attachments
+func extractSearchText(raw []byte, withAttachments bool) (string, string, []models.DICOMInfo) {
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		return "", "", nil
+	}
+	defer mr.Close()
+
+	var plainText, htmlText string
+	var attachmentText []string
+	var studies []models.DICOMInfo
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("⚠️ Error reading part for search: %v", err)
+			break
+		}
+
+		switch h := part.Header.(type) {
+		case *mail.InlineHeader:
+			contentType, _, _ := h.ContentType()
+			data, err := io.ReadAll(part.Body)
+			if err != nil {
+				continue
+			}
+			switch contentType {
+			case "text/plain":
+				plainText += decodeBodyText(data) + "\n"
+			case "text/html":
+				htmlText += htmlToText(decodeBodyText(data)) + "\n"
+			}
+		case *mail.AttachmentHeader:
+			if !withAttachments {
+				continue
+			}
+			contentType, _, _ := h.ContentType()
+			filename := partFilename(h.Get("Content-Disposition"), h.Get("Content-Type"))
+			if isDICOM(contentType, filename) {
+				data, err := io.ReadAll(io.LimitReader(part.Body, dicomMaxSize+1))
+				if err != nil || len(data) > dicomMaxSize {
+					log.Printf("⚠️ Skipping DICOM %s: unreadable or too large", filename)
+					continue
+				}
+				info, err := parseDICOMInfo(bytes.NewReader(data), int64(len(data)), filename)
+				if err != nil {
+					log.Printf("⚠️ Could not read DICOM metadata from %s: %v", filename, err)
+					continue
+				}
+				studies = append(studies, *info)
+				// ✅ Patient name, modality and body part are searchable too
+				attachmentText = append(attachmentText, strings.Join([]string{info.PatientName, info.StudyDate, info.Modality, info.BodyPart}, " "))
+				continue
+			}
+			if contentType != "application/pdf" && !strings.HasSuffix(strings.ToLower(filename), ".pdf") {
+				continue
+			}
+			data, err := io.ReadAll(io.LimitReader(part.Body, searchMaxPDFSize+1))
+			if err != nil || len(data) > searchMaxPDFSize {
+				log.Printf("⚠️ Skipping PDF %s for search: unreadable or too large", filename)
+				continue
+			}
+			text, err := pdfToText(data)
+			if err != nil {
+				log.Printf("⚠️ Could not extract text from %s: %v", filename, err)
+				continue
+			}
+			attachmentText = append(attachmentText, text)
+		}
+	}
+
+	body := plainText
+	if strings.TrimSpace(body) == "" {
+		body = htmlText
+	}
+	return collapseSpace(body), collapseSpace(strings.Join(attachmentText, "\n")), studies
+}
+
+var (
+	htmlBlockPattern = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+	htmlTagPattern   = regexp.MustCompile(`(?s)<[^>]*>`)
+	spacePattern     = regexp.MustCompile(`\s+`)
+)
+
+func htmlToText(s string) string {
+	s = htmlBlockPattern.ReplaceAllString(s, " ")
+	s = htmlTagPattern.ReplaceAllString(s, " ")
+	return html.UnescapeString(s)
+}
+
+func collapseSpace(s string) string {
+	return strings.TrimSpace(spacePattern.ReplaceAllString(s, " "))
+}
+
+var pdftotextMissing sync.Once
+
+// pdfToText runs poppler's pdftotext (PDFTOTEXT_PATH, default "pdftotext") over the PDF
+func pdfToText(data []byte) (string, error) {
+	bin := os.Getenv("PDFTOTEXT_PATH")
+	if bin == "" {
+		bin = "pdftotext"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), searchPDFTimeout)
+	defer cancel()
+
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, "-q", "-enc", "UTF-8", "-", "-")
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			pdftotextMissing.Do(func() {
+				log.Printf("⚠️ %s not found: PDF attachments won't be searchable", bin)
+			})
+		}
+		return "", fmt.Errorf("pdftotext failed: %v %s", err, stderr.String())
+	}
+	return out.String(), nil
+}
+
+// SearchMail runs a full-text search over subject, body and PDF text. Results
+// follow EmailHandler's access rules: with a patient, everything sent to them
+// if they granted access (CheckAccessValue == "Y"), otherwise only the doctor's
+// own messages; without one, the doctor's own messages plus everything sent to
+// patients who granted access.
+func SearchMail(store MailStore, q SearchQuery) (*SearchPage, error) {
+	page := q.Page.normalize()
+	account := store.Account()
+
+	filter, err := searchAccessFilter(account, q.Doctor, q.Patient, page)
+	if err != nil {
+		return nil, err
+	}
+	filter["$text"] = bson.M{"$search": q.Text}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// ✅ The score has to be kept before dedupeStages regroup the entries
+	pipeline := append(mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$addFields", Value: bson.M{"score": bson.M{"$meta": "textScore"}}}},
+	}, dedupeStages()...)
+	pipeline = append(pipeline,
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "score", Value: -1}, {Key: "date", Value: -1}, {Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$facet", Value: bson.M{
+			"total": bson.A{bson.M{"$count": "n"}},
+			"page":  bson.A{bson.M{"$skip": page.offset()}, bson.M{"$limit": page.Limit}},
+		}}},
+	)
+
+	cursor, err := config.GetMailSearchCollection().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("search failed: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	type scoredDocument struct {
+		models.SearchDocument `bson:",inline"`
+		Score                 float64 `bson:"score"`
+	}
+	var found []struct {
+		Total []struct {
+			N int64 `bson:"n"`
+		} `bson:"total"`
+		Page []scoredDocument `bson:"page"`
+	}
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, fmt.Errorf("failed to decode search results: %w", err)
+	}
+
+	var total int64
+	var docs []scoredDocument
+	if len(found) > 0 {
+		if len(found[0].Total) > 0 {
+			total = found[0].Total[0].N
+		}
+		docs = found[0].Page
+	}
+
+	result := &SearchPage{Results: make([]SearchHit, 0, len(docs)), Total: total, Page: page.Page, Limit: page.Limit}
+	for _, doc := range docs {
+		result.Results = append(result.Results, SearchHit{
+			Message: messageFromIndex(doc.IndexedMessage),
+			Snippet: searchSnippet(q.Text, doc.Subject, doc.Body, doc.AttachmentText),
+			Score:   doc.Score,
+		})
+	}
+	if int64(page.offset()+len(docs)) < total {
+		next := page
+		next.Page++
+		result.NextCursor = EncodePageCursor(next)
+	}
+	return result, nil
+}
+
+// searchAccessFilter builds the MailSearch filter for what doctor may see
+func searchAccessFilter(account *config.MailAccount, doctor, patient string, page MessageQuery) (bson.M, error) {
+	if patient != "" {
+		access, err := CheckAccessValue(doctor, patient)
+		if err != nil {
+			return nil, fmt.Errorf("access check failed: %w", err)
+		}
+		if access == "Y" {
+			return mailIndexFilter(account.ID, "", patient, page), nil
+		}
+		return mailIndexFilter(account.ID, doctor, patient, page), nil
+	}
+
+	patients, err := PatientsWithAccess(doctor)
+	if err != nil {
+		return nil, fmt.Errorf("access lookup failed: %w", err)
+	}
+	addresses := make([]string, 0, len(patients))
+	for _, mobile := range patients {
+		addresses = append(addresses, strings.ToLower(account.VaultAddress(mobile)))
+	}
+
+	filter := mailIndexFilter(account.ID, "", "", page)
+	filter["$or"] = bson.A{
+		bson.M{"from": strings.ToLower(strings.TrimSpace(doctor))},
+		bson.M{"recipients": bson.M{"$in": addresses}},
+	}
+	return filter, nil
+}
+
+// searchSnippet returns the text around the first search term found
+func searchSnippet(query string, texts ...string) string {
+	terms := strings.Fields(strings.ToLower(strings.ReplaceAll(query, `"`, " ")))
+	for _, text := range texts {
+		lower, offsets := lowerWithOffsets(text)
+		for _, term := range terms {
+			if strings.HasPrefix(term, "-") {
+				continue // excluded term
+			}
+			i := strings.Index(lower, term)
+			if i < 0 {
+				continue
+			}
+			// ✅ Lower-casing can change a character's length, so map back into text
+			start, end := offsets[i]-searchSnippetRadius, offsets[i+len(term)]+searchSnippetRadius
+			if start < 0 {
+				start = 0
+			}
+			if end > len(text) {
+				end = len(text)
+			}
+			snippet := strings.ToValidUTF8(text[start:end], "")
+			if start > 0 {
+				snippet = "…" + snippet
+			}
+			if end < len(text) {
+				snippet += "…"
+			}
+			return snippet
+		}
+	}
+	return ""
+}
+
+// lowerWithOffsets returns strings.ToLower(s) and, for every byte offset in
+// it (and its length), the offset in s of the character it came from
+func lowerWithOffsets(s string) (string, []int) {
+	var b strings.Builder
+	b.Grow(len(s))
+	offsets := make([]int, 0, len(s)+1)
+	for i, r := range s {
+		n := b.Len()
+		b.WriteRune(unicode.ToLower(r))
+		for ; n < b.Len(); n++ {
+			offsets = append(offsets, i)
+		}
+	}
+	return b.String(), append(offsets, len(s))
+}
@@ -0,0 +1,43 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearchSnippet(t *testing.T) {
+	long := strings.Repeat("x", 200)
+
+	tests := []struct {
+		name     string
+		query    string
+		texts    []string
+		want     string // must be in the snippet
+		wantNone bool
+	}{
+		{"case-insensitive", "hba1c", []string{"Result: HbA1c 7.2%"}, "HbA1c 7.2%", false},
+		{"later text", "ferritin", []string{"OPD report", "Ferritin low"}, "Ferritin low", false},
+		{"excluded term skipped", "-ferritin glucose", []string{"Ferritin ok, Glucose high"}, "Glucose", false},
+		{"phrase quotes", `"blood sugar"`, []string{"Fasting blood sugar 110"}, "blood sugar", false},
+		{"long text is cut", "glucose", []string{long + " glucose " + long}, "…", false},
+		{"no match", "ferritin", []string{"OPD report"}, "", true},
+		// Ⱥ is 2 bytes but its lower case ⱥ is 3, so byte offsets in the lower-cased text drift
+		{"lower case grows", "hba1c", []string{strings.Repeat("Ⱥ", 300) + " HbA1c 7.2%"}, "HbA1c 7.2%", false},
+		{"lower case shrinks", "hba1c", []string{strings.Repeat("\u212a", 300) + " HbA1c 7.2%"}, "HbA1c 7.2%", false}, // Kelvin sign, 3 bytes to 1
+		{"invalid utf-8", "hba1c", []string{strings.Repeat("\xff", 300) + " HbA1c"}, "HbA1c", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := searchSnippet(tt.query, tt.texts...)
+			if tt.wantNone {
+				if got != "" {
+					t.Errorf("snippet = %q, want none", got)
+				}
+				return
+			}
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("snippet %q does not contain %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package services
+
+import (
+	"bytes"
+	"email-client/config"
+	"email-client/models"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+var (
+	// ErrMessageNotFound is returned by a MailStore when a UID doesn't exist
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrAttachmentNotFound is returned when a message has no attachment at the requested part or name
+	ErrAttachmentNotFound = errors.New("attachment not found")
+)
+
+// MailboxStatus describes the state of a mailbox the way IMAP reports it
+type MailboxStatus struct {
+	Name        string
+	UIDValidity uint32
+	UIDNext     uint32
+	Messages    uint32
+}
+
+// MailFilter narrows a Search. Empty fields match everything; From and To are
+// case-insensitive substring matches like an IMAP HEADER search, and Since
+// (inclusive) and Before (exclusive) compare whole days like IMAP SINCE/BEFORE.
+type MailFilter struct {
+	From      string
+	To        string
+	MessageID string // exact, without angle brackets
+	MinUID    uint32
+	Since     time.Time
+	Before    time.Time
+}
+
+// MailStore is where the document views read one clinic account's mail from,
+// and where generated reports are archived. Besides the real IMAP account there
+// are Maildir and in-memory implementations so the app can run without a mail
+// server. Every call names the mailbox (folder) it works on.
+type MailStore interface {
+	// Account is the clinic account the store reads
+	Account() *config.MailAccount
+	// Status returns UIDVALIDITY/UIDNEXT for the mailbox
+	Status(mailbox string) (*MailboxStatus, error)
+	// Search returns the UIDs matching filter in ascending order
+	Search(mailbox string, filter MailFilter) ([]uint32, error)
+	// Envelopes returns header data and attachment names for the given UIDs
+	Envelopes(mailbox string, uids []uint32) ([]models.IndexedMessage, error)
+	// FetchRaw returns the full RFC 822 message
+	FetchRaw(mailbox string, uid uint32) ([]byte, error)
+	// OpenRaw streams the full RFC 822 message; callers must close it
+	OpenRaw(mailbox string, uid uint32) (io.ReadCloser, error)
+	// OpenPart streams one decoded MIME part, addressed by its part path
+	// (e.g. "2.1"); callers must close it
+	OpenPart(mailbox string, uid uint32, path string) (*MessagePart, error)
+	// Append stores a raw RFC 822 message in the mailbox with IMAP flags
+	// (e.g. \Seen), creating the mailbox if it doesn't exist yet
+	Append(mailbox string, flags []string, date time.Time, raw []byte) error
+}
+
+// searchFolders runs Search/Envelopes over every configured folder
+func searchFolders(store MailStore, filter MailFilter) ([]models.IndexedMessage, error) {
+	var all []models.IndexedMessage
+	for _, folder := range config.MailFolders() {
+		uids, err := store.Search(folder, filter)
+		if err != nil {
+			return nil, fmt.Errorf("search in %s failed: %w", folder, err)
+		}
+		if len(uids) == 0 {
+			continue
+		}
+		envelopes, err := store.Envelopes(folder, uids)
+		if err != nil {
+			return nil, fmt.Errorf("envelope fetch in %s failed: %w", folder, err)
+		}
+		for i := range envelopes {
+			envelopes[i].Account = store.Account().ID
+		}
+		all = append(all, envelopes...)
+	}
+	return all, nil
+}
+
+// firstFolderWithMatches returns the UIDs of the first configured folder that has any match
+func firstFolderWithMatches(store MailStore, filter MailFilter) (string, []uint32, error) {
+	for _, folder := range config.MailFolders() {
+		uids, err := store.Search(folder, filter)
+		if err != nil {
+			return "", nil, fmt.Errorf("search in %s failed: %w", folder, err)
+		}
+		if len(uids) > 0 {
+			return folder, uids, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// NewMailStoreFromEnv opens account's store with the backend from MAIL_STORE
+// (imap, maildir or memory). Maildir accounts other than the default one live
+// in a subdirectory of MAILDIR_PATH named after the account id.
+func NewMailStoreFromEnv(account *config.MailAccount) (MailStore, error) {
+	switch backend := strings.ToLower(strings.TrimSpace(os.Getenv("MAIL_STORE"))); backend {
+	case "", "imap":
+		log.Printf("📮 Using IMAP mail store for account %s", account.ID)
+		return NewIMAPStore(account), nil
+	case "maildir":
+		dir := os.Getenv("MAILDIR_PATH")
+		if dir == "" {
+			dir = "./maildir"
+		}
+		if account.ID != config.DefaultMailAccountID {
+			dir = filepath.Join(dir, account.ID)
+		}
+		log.Printf("📮 Using Maildir mail store at %s for account %s", dir, account.ID)
+		return NewMaildirStore(account, dir)
+	case "memory":
+		store := NewMemoryStore(account)
+		if seedDir := os.Getenv("MAIL_SEED_DIR"); seedDir != "" && account.Default {
+			if err := store.LoadDir(seedDir); err != nil {
+				return nil, err
+			}
+		}
+		log.Printf("📮 Using in-memory mail store for account %s", account.ID)
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_STORE %q (expected imap, maildir or memory)", backend)
+	}
+}
+
+// envelopeFromRaw parses headers and attachments out of a raw message. Like
+// indexedMessageFromIMAP, it leaves the address fields of a message without
+// From or To empty rather than skipping it.
+func envelopeFromRaw(raw []byte, mailbox string, uidValidity, uid uint32) (*models.IndexedMessage, error) {
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message %d: %w", uid, err)
+	}
+	defer mr.Close()
+
+	from, _ := mr.Header.AddressList("From")
+	to, _ := mr.Header.AddressList("To")
+
+	subject := decodeHeaderText(mr.Header.Get("Subject"))
+	messageID, _ := mr.Header.MessageID()
+	inReplyTo, _ := mr.Header.MsgIDList("In-Reply-To")
+	references, _ := mr.Header.MsgIDList("References")
+	date, err := mr.Header.Date()
+	if err != nil {
+		date = time.Time{}
+	}
+
+	var recipients []string
+	for _, addr := range to {
+		recipients = append(recipients, strings.ToLower(addr.Address))
+	}
+
+	attachments, err := attachmentsFromRaw(raw)
+	if err != nil {
+		log.Printf("⚠️ Error reading parts of message %d: %v", uid, err)
+	}
+
+	env := &models.IndexedMessage{
+		Mailbox:         mailbox,
+		UIDValidity:     uidValidity,
+		UID:             uid,
+		MessageID:       normalizeMessageID(messageID),
+		References:      references,
+		Subject:         subject,
+		Recipients:      recipients,
+		Date:            date,
+		AttachmentNames: attachmentNamesOf(attachments),
+		Attachments:     attachments,
+	}
+	if len(from) > 0 {
+		env.From, env.FromName = strings.ToLower(from[0].Address), from[0].Name
+	}
+	if len(to) > 0 {
+		env.To = to[0].Address
+	}
+	if len(inReplyTo) > 0 {
+		env.InReplyTo = inReplyTo[0]
+	}
+	env.ThreadID = threadIDFor(env)
+	return env, nil
+}
+
+// matchesFilter applies a MailFilter to a parsed envelope
+func matchesFilter(env *models.IndexedMessage, filter MailFilter) bool {
+	if env == nil || env.UID < filter.MinUID {
+		return false
+	}
+	if filter.From != "" && !strings.Contains(env.From, strings.ToLower(filter.From)) {
+		return false
+	}
+	if filter.MessageID != "" && env.MessageID != normalizeMessageID(filter.MessageID) {
+		return false
+	}
+	if !filter.Since.IsZero() && env.Date.Before(truncateToDay(filter.Since)) {
+		return false
+	}
+	if !filter.Before.IsZero() && !env.Date.Before(truncateToDay(filter.Before)) {
+		return false
+	}
+	if filter.To != "" {
+		needle := strings.ToLower(filter.To)
+		for _, r := range env.Recipients {
+			if strings.Contains(r, needle) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// findInlinePart returns the part with the given Content-ID (without angle brackets)
+func findInlinePart(r io.Reader, contentID string) (*MessagePart, error) {
+	var found *MessagePart
+	err := walkMIMEParts(r, func(path string, e *message.Entity) (bool, error) {
+		if partContentID(e.Header.Get("Content-ID")) != contentID {
+			return false, nil
+		}
+		found = messagePartFromEntity(path, e)
+		if entityFilename(e) == "" {
+			found.Filename = contentID
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: cid:%s", ErrAttachmentNotFound, contentID)
+	}
+	return found, nil
+}
+
+// partContentID strips the angle brackets from a Content-ID header
+func partContentID(value string) string {
+	return strings.Trim(strings.TrimSpace(value), "<>")
+}
+
+// truncateToDay drops the time of day, since IMAP date searches ignore it
+func truncateToDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func sortUIDs(uids []uint32) {
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"email-client/config"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+const (
+	idleRestartInterval  = 25 * time.Minute // RFC 2177: re-issue IDLE before the 29 minute server timeout
+	watcherRetryMin      = 5 * time.Second
+	watcherRetryMax      = 5 * time.Minute
+	watcherUpdatesBuffer = 32
+)
+
+// StartMailWatcher keeps a dedicated IMAP IDLE session open on the INBOX of the
+// store's account and runs SyncMailIndex on store whenever the server reports
+// new mail, so subscribers to SubscribeMailEvents hear about reports as they
+// arrive. Other folders are picked up by the periodic sync.
+func StartMailWatcher(store MailStore) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		backoff := watcherRetryMin
+
+		for {
+			started := time.Now()
+			err := watchMailbox(store, done)
+			if err == nil {
+				return // stopped
+			}
+			log.Printf("⚠️ Mail watcher for account %s disconnected: %v", store.Account().ID, err)
+
+			if time.Since(started) > watcherRetryMax {
+				backoff = watcherRetryMin
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > watcherRetryMax {
+				backoff = watcherRetryMax
+			}
+		}
+	}()
+
+	log.Printf("✅ Mail watcher started for account %s (IMAP IDLE on INBOX)", store.Account().ID)
+	return func() {
+		close(done)
+		wg.Wait()
+		log.Printf("✅ Mail watcher stopped for account %s", store.Account().ID)
+	}
+}
+
+// watchMailbox runs one IDLE session until done is closed (nil error) or the connection fails
+func watchMailbox(store MailStore, done <-chan struct{}) error {
+	// ✅ Dedicated session: an idling client can't be shared through the pool
+	imapClient, err := config.ConnectIMAP(store.Account())
+	if err != nil {
+		return err
+	}
+	defer imapClient.Logout()
+
+	updates := make(chan client.Update, watcherUpdatesBuffer)
+	imapClient.Updates = updates
+
+	if _, err := imapClient.Select(config.DefaultMailFolder, true); err != nil {
+		return err
+	}
+
+	for {
+		stopIdle := make(chan struct{})
+		idleDone := make(chan error, 1)
+		go func() {
+			idleDone <- imapClient.Idle(stopIdle, nil)
+		}()
+
+		newMail := false
+		restart := time.NewTimer(idleRestartInterval)
+
+	waitLoop:
+		for {
+			select {
+			case <-done:
+				restart.Stop()
+				close(stopIdle)
+				<-idleDone
+				return nil
+			case upd := <-updates:
+				if _, ok := upd.(*client.MailboxUpdate); ok {
+					newMail = true
+					close(stopIdle)
+					break waitLoop
+				}
+			case <-restart.C:
+				close(stopIdle)
+				break waitLoop
+			case err := <-idleDone:
+				restart.Stop()
+				if err == nil {
+					err = errIdleEnded
+				}
+				return err
+			}
+		}
+		restart.Stop()
+
+		if err := <-idleDone; err != nil {
+			return err
+		}
+
+		if drainUpdates(updates) {
+			newMail = true
+		}
+		if newMail {
+			log.Println("📬 New mail reported by IMAP IDLE, syncing index")
+			if err := SyncMailIndex(store); err != nil {
+				log.Printf("❌ Mail index sync after IDLE failed: %v", err)
+			}
+		}
+	}
+}
+
+var errIdleEnded = errors.New("IDLE ended unexpectedly")
+
+// drainUpdates empties updates queued while not idling; go-imap blocks when the channel is full
+func drainUpdates(updates <-chan client.Update) bool {
+	newMail := false
+	for {
+		select {
+		case upd := <-updates:
+			if _, ok := upd.(*client.MailboxUpdate); ok {
+				newMail = true
+			}
+		default:
+			return newMail
+		}
+	}
+}
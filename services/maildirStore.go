@@ -0,0 +1,388 @@
+package services
+
+import (
+	"bufio"
+	"email-client/config"
+	"email-client/models"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maildirUIDListFile = ".uidlist"
+
+// MaildirStore is a MailStore over a Maildir++ tree: INBOX lives in the root
+// (cur/, new/, tmp/) and every other folder in a ".Name" subdirectory.
+type MaildirStore struct {
+	account *config.MailAccount
+	root    string
+
+	mu      sync.Mutex
+	folders map[string]*maildirFolder
+}
+
+// maildirFolder is one Maildir. UIDs are assigned in arrival order and
+// persisted in .uidlist so they stay stable across restarts, the same way
+// IMAP servers keep them.
+type maildirFolder struct {
+	name        string
+	dir         string
+	uidValidity uint32
+	nextUID     uint32
+	uidByKey    map[string]uint32 // maildir unique name (without :2,flags) → UID
+	pathByUID   map[uint32]string
+	envelopes   map[uint32]*models.IndexedMessage
+}
+
+func NewMaildirStore(account *config.MailAccount, root string) (*MaildirStore, error) {
+	s := &MaildirStore{account: account, root: root, folders: make(map[string]*maildirFolder)}
+	if _, err := s.open(config.DefaultMailFolder); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *MaildirStore) Account() *config.MailAccount {
+	return s.account
+}
+
+// open returns the folder's Maildir, creating it if needed. Callers must hold s.mu.
+func (s *MaildirStore) open(mailbox string) (*maildirFolder, error) {
+	if f, ok := s.folders[mailbox]; ok {
+		return f, nil
+	}
+
+	dir := s.root
+	if !strings.EqualFold(mailbox, config.DefaultMailFolder) {
+		if strings.ContainsAny(mailbox, `/\`) || strings.HasPrefix(mailbox, ".") {
+			return nil, fmt.Errorf("invalid maildir folder name %q", mailbox)
+		}
+		dir = filepath.Join(s.root, "."+mailbox)
+	}
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), os.ModePerm); err != nil {
+			return nil, fmt.Errorf("failed to create maildir %s: %w", dir, err)
+		}
+	}
+
+	f := &maildirFolder{
+		name:      mailbox,
+		dir:       dir,
+		uidByKey:  make(map[string]uint32),
+		pathByUID: make(map[uint32]string),
+		envelopes: make(map[uint32]*models.IndexedMessage),
+	}
+	if err := f.loadUIDList(); err != nil {
+		return nil, err
+	}
+	s.folders[mailbox] = f
+	return f, nil
+}
+
+// loadUIDList reads "uidvalidity nextuid" followed by "uid key" lines
+func (s *maildirFolder) loadUIDList() error {
+	f, err := os.Open(filepath.Join(s.dir, maildirUIDListFile))
+	if os.IsNotExist(err) {
+		s.uidValidity = uint32(time.Now().Unix())
+		s.nextUID = 1
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open uid list: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if scanner.Scan() {
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %d", &s.uidValidity, &s.nextUID); err != nil {
+			return fmt.Errorf("corrupt uid list header: %w", err)
+		}
+	}
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		s.uidByKey[fields[1]] = uint32(uid)
+	}
+	return scanner.Err()
+}
+
+func (s *maildirFolder) saveUIDList() error {
+	type entry struct {
+		uid uint32
+		key string
+	}
+	entries := make([]entry, 0, len(s.uidByKey))
+	for key, uid := range s.uidByKey {
+		entries = append(entries, entry{uid, key})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].uid < entries[j].uid })
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%d %d\n", s.uidValidity, s.nextUID))
+	for _, e := range entries {
+		sb.WriteString(fmt.Sprintf("%d %s\n", e.uid, e.key))
+	}
+
+	tmp := filepath.Join(s.dir, maildirUIDListFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, maildirUIDListFile))
+}
+
+// rescan picks up delivered and removed files
+func (s *maildirFolder) rescan() error {
+	type found struct {
+		key, path string
+		mtime     time.Time
+	}
+	var files []found
+
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(s.dir, sub))
+		if err != nil {
+			return fmt.Errorf("failed to read maildir: %w", err)
+		}
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			key := strings.SplitN(e.Name(), ":", 2)[0]
+			files = append(files, found{key, filepath.Join(s.dir, sub, e.Name()), info.ModTime()})
+		}
+	}
+
+	// ✅ New files get UIDs in delivery order
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].mtime.Equal(files[j].mtime) {
+			return files[i].key < files[j].key
+		}
+		return files[i].mtime.Before(files[j].mtime)
+	})
+
+	present := make(map[string]bool, len(files))
+	changed := false
+	pathByUID := make(map[uint32]string, len(files))
+
+	for _, f := range files {
+		present[f.key] = true
+		uid, ok := s.uidByKey[f.key]
+		if !ok {
+			uid = s.nextUID
+			s.nextUID++
+			s.uidByKey[f.key] = uid
+			changed = true
+		}
+		pathByUID[uid] = f.path
+	}
+
+	for key, uid := range s.uidByKey {
+		if !present[key] {
+			delete(s.uidByKey, key)
+			delete(s.envelopes, uid)
+			changed = true
+		}
+	}
+	s.pathByUID = pathByUID
+
+	if changed {
+		if err := s.saveUIDList(); err != nil {
+			log.Printf("⚠️ Failed to persist maildir uid list: %v", err)
+		}
+	}
+	return nil
+}
+
+// envelope parses and caches a message's headers
+func (s *maildirFolder) envelope(uid uint32) (*models.IndexedMessage, error) {
+	if env, ok := s.envelopes[uid]; ok {
+		return env, nil
+	}
+	path, ok := s.pathByUID[uid]
+	if !ok {
+		return nil, fmt.Errorf("%w: UID %d", ErrMessageNotFound, uid)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	env, err := envelopeFromRaw(raw, s.name, s.uidValidity, uid)
+	if err != nil {
+		return nil, err
+	}
+	s.envelopes[uid] = env
+	return env, nil
+}
+
+func (s *MaildirStore) Status(mailbox string) (*MailboxStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := s.open(mailbox)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.rescan(); err != nil {
+		return nil, err
+	}
+	return &MailboxStatus{
+		Name:        mailbox,
+		UIDValidity: f.uidValidity,
+		UIDNext:     f.nextUID,
+		Messages:    uint32(len(f.pathByUID)),
+	}, nil
+}
+
+func (s *MaildirStore) Search(mailbox string, filter MailFilter) ([]uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := s.open(mailbox)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.rescan(); err != nil {
+		return nil, err
+	}
+
+	var uids []uint32
+	for uid := range f.pathByUID {
+		env, err := f.envelope(uid)
+		if err != nil {
+			log.Printf("⚠️ Skipping unreadable maildir message %d in %s: %v", uid, mailbox, err)
+			continue
+		}
+		if matchesFilter(env, filter) {
+			uids = append(uids, uid)
+		}
+	}
+	sortUIDs(uids)
+	return uids, nil
+}
+
+func (s *MaildirStore) Envelopes(mailbox string, uids []uint32) ([]models.IndexedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := s.open(mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	var envelopes []models.IndexedMessage
+	for _, uid := range uids {
+		env, err := f.envelope(uid)
+		if err != nil || env == nil {
+			continue
+		}
+		envelopes = append(envelopes, *env)
+	}
+	return envelopes, nil
+}
+
+func (s *MaildirStore) FetchRaw(mailbox string, uid uint32) ([]byte, error) {
+	s.mu.Lock()
+	path, err := s.locate(mailbox, uid)
+	s.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// locate finds the file for a UID, rescanning once in case it was just delivered. Callers must hold s.mu.
+func (s *MaildirStore) locate(mailbox string, uid uint32) (string, error) {
+	f, err := s.open(mailbox)
+	if err != nil {
+		return "", err
+	}
+	if path, ok := f.pathByUID[uid]; ok {
+		return path, nil
+	}
+	if err := f.rescan(); err != nil {
+		return "", err
+	}
+	if path, ok := f.pathByUID[uid]; ok {
+		return path, nil
+	}
+	return "", fmt.Errorf("%w: UID %d in %s", ErrMessageNotFound, uid, mailbox)
+}
+
+func (s *MaildirStore) OpenRaw(mailbox string, uid uint32) (io.ReadCloser, error) {
+	s.mu.Lock()
+	path, err := s.locate(mailbox, uid)
+	s.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s *MaildirStore) OpenPart(mailbox string, uid uint32, path string) (*MessagePart, error) {
+	return openRawPart(s, mailbox, uid, path)
+}
+
+// maildirFlags maps IMAP system flags to Maildir info letters, in the ASCII
+// order the info part must list them in
+var maildirFlags = []struct {
+	imap   string
+	letter string
+}{
+	{`\Draft`, "D"}, {`\Flagged`, "F"}, {`\Answered`, "R"}, {`\Seen`, "S"}, {`\Deleted`, "T"},
+}
+
+// Append delivers raw the Maildir way: written to tmp/, then renamed into
+// cur/ with its flags, so a rescan never sees a partial file
+func (s *MaildirStore) Append(mailbox string, flags []string, date time.Time, raw []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := s.open(mailbox)
+	if err != nil {
+		return err
+	}
+
+	var info strings.Builder
+	for _, mf := range maildirFlags {
+		for _, flag := range flags {
+			if strings.EqualFold(flag, mf.imap) {
+				info.WriteString(mf.letter)
+				break
+			}
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	key := fmt.Sprintf("%d.P%d.%s", time.Now().UnixNano(), os.Getpid(), strings.NewReplacer("/", "_", ":", "_").Replace(hostname))
+	tmp := filepath.Join(f.dir, "tmp", key)
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return fmt.Errorf("failed to write maildir message: %w", err)
+	}
+	if !date.IsZero() {
+		os.Chtimes(tmp, date, date)
+	}
+	if err := os.Rename(tmp, filepath.Join(f.dir, "cur", key+":2,"+info.String())); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to deliver maildir message: %w", err)
+	}
+	return f.rescan()
+}
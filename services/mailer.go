@@ -0,0 +1,366 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"email-client/config"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+// errSMTPNoTLS is returned when a message must not go out unencrypted but the server offers no TLS
+var errSMTPNoTLS = errors.New("SMTP server does not support TLS")
+
+const (
+	smtpDialTimeout = 10 * time.Second
+	smtpSendTimeout = 2 * time.Minute // for one whole message, attachments included
+)
+
+// MessageClass says what kind of mail a message is, which picks the SMTP host it goes out through
+type MessageClass string
+
+const (
+	MessageClassOTP          MessageClass = "otp"          // access codes: SMTP_HOST
+	MessageClassReport       MessageClass = "report"       // OPD reports: SMTP_HOST_ALT
+	MessageClassRegistration MessageClass = "registration" // new patient notices: SMTP_HOST_ALT
+)
+
+// OutgoingAttachment is a file sent with an OutgoingMessage
+type OutgoingAttachment struct {
+	Filename    string
+	ContentType string // e.g. "application/pdf"
+	Data        []byte
+}
+
+// OutgoingMessage is a message for Mailer.Send. From defaults to the account's
+// SMTP address, which is always the envelope sender.
+type OutgoingMessage struct {
+	Class       MessageClass
+	From        string
+	FromName    string
+	To          []string
+	Cc          []string
+	Subject     string
+	TextBody    string
+	HTMLBody    string
+	Attachments []OutgoingAttachment
+
+	SMIME *SMIMEOptions // sign and/or encrypt the content, nil sends plain MIME
+}
+
+// recipients returns every envelope recipient, To and Cc
+func (m *OutgoingMessage) recipients() []string {
+	var rcpts []string
+	for _, addr := range append(append([]string{}, m.To...), m.Cc...) {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			rcpts = append(rcpts, addr)
+		}
+	}
+	return rcpts
+}
+
+// Mailer sends mail on behalf of a clinic account. Send returns the message
+// exactly as it went out, so callers can archive that copy.
+type Mailer interface {
+	Send(account *config.MailAccount, msg *OutgoingMessage) ([]byte, error)
+}
+
+var (
+	mailerMu      sync.RWMutex
+	currentMailer Mailer = &SMTPMailer{}
+)
+
+// GetMailer returns the Mailer the services send through
+func GetMailer() Mailer {
+	mailerMu.RLock()
+	defer mailerMu.RUnlock()
+	return currentMailer
+}
+
+// SetMailer replaces the Mailer, e.g. with one that records messages in tests, and returns the previous one
+func SetMailer(m Mailer) Mailer {
+	mailerMu.Lock()
+	defer mailerMu.Unlock()
+	previous := currentMailer
+	currentMailer = m
+	return previous
+}
+
+// SMTPMailer builds RFC 5322 messages and sends them through the account's SMTP servers
+type SMTPMailer struct{}
+
+// Send builds msg and sends it through the SMTP host for its class, retrying
+// temporary failures like the IMAP paths do
+func (SMTPMailer) Send(account *config.MailAccount, msg *OutgoingMessage) ([]byte, error) {
+	startTime := time.Now()
+
+	rcpts := msg.recipients()
+	if len(rcpts) == 0 {
+		return nil, errors.New("message has no recipients")
+	}
+
+	raw, err := BuildSignedMessage(account, msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build %s message: %w", msg.Class, err)
+	}
+
+	host := smtpHostFor(&account.SMTP, msg.Class)
+	// ✅ Never send the password or a patient's report in the clear
+	requireTLS := account.SMTP.Password != "" || msg.Class == MessageClassReport
+	err = withMailRetry("SMTP", account, func() error {
+		return sendSMTP(&account.SMTP, host, requireTLS, rcpts, raw)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send email: %w", err)
+	}
+
+	log.Printf("✅ %s email sent to %s via %s in %v ms", msg.Class, strings.Join(rcpts, ", "), host, time.Since(startTime).Milliseconds())
+	return raw, nil
+}
+
+// smtpHostFor picks the server for a message class: OTPs go through
+// SMTP_HOST, reports and registrations through SMTP_HOST_ALT when it is set
+func smtpHostFor(cfg *config.SMTPConfig, class MessageClass) string {
+	if class != MessageClassOTP && strings.TrimSpace(cfg.SMTPHost_ALT) != "" {
+		return strings.TrimSpace(cfg.SMTPHost_ALT)
+	}
+	return strings.TrimSpace(cfg.SMTPHost)
+}
+
+// sendSMTP delivers one message: implicit TLS on port 465, STARTTLS elsewhere.
+// With requireTLS a server that doesn't offer STARTTLS is refused, otherwise
+// the message goes out in the clear. Certificates are always checked except
+// for the account's InsecureHost when SMTP_SECURITY=false.
+func sendSMTP(cfg *config.SMTPConfig, host string, requireTLS bool, rcpts []string, raw []byte) error {
+	addr := net.JoinHostPort(host, strings.TrimSpace(cfg.SMTPPort))
+	tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: skipCertificateCheck(cfg, host)}
+
+	dialStart := time.Now()
+	var conn net.Conn
+	var err error
+	if strings.TrimSpace(cfg.SMTPPort) == "465" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: smtpDialTimeout}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, smtpDialTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(smtpSendTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	defer c.Close()
+	log.Printf("🔌 SMTP Dial time: %v ms", time.Since(dialStart).Milliseconds())
+
+	if _, isTLS := conn.(*tls.Conn); !isTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return fmt.Errorf("STARTTLS failed: %w", err)
+			}
+		} else if requireTLS {
+			return fmt.Errorf("%w: %s does not offer STARTTLS", errSMTPNoTLS, host)
+		}
+	}
+	if ok, _ := c.Extension("AUTH"); ok && cfg.Password != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.From, cfg.Password, host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+
+	if err := c.Mail(cfg.From); err != nil {
+		return fmt.Errorf("MAIL FROM rejected: %w", err)
+	}
+	for _, rcpt := range rcpts {
+		if err := c.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("recipient %s rejected: %w", rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("DATA rejected: %w", err)
+	}
+	if _, err := w.Write(raw); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("message rejected: %w", err)
+	}
+	return c.Quit()
+}
+
+// skipCertificateCheck reports whether host is the one server the account
+// opted out of certificate checks for, e.g. a relay with a self-signed one
+func skipCertificateCheck(cfg *config.SMTPConfig, host string) bool {
+	insecure := strings.TrimSpace(cfg.InsecureHost)
+	return cfg.SMTPSecurity == "false" && insecure != "" && strings.EqualFold(host, insecure)
+}
+
+// BuildMessage renders msg as an RFC 5322 message: encoded-word headers,
+// quoted-printable text, base64 attachments with RFC 2231 file names, and
+// multipart/alternative when there is both a text and an HTML body. With
+// msg.SMIME the content is then signed and/or encrypted as one entity.
+func BuildMessage(account *config.MailAccount, msg *OutgoingMessage) ([]byte, error) {
+	from := strings.TrimSpace(msg.From)
+	if from == "" {
+		from = account.SMTP.From
+	}
+
+	var h mail.Header
+	h.SetDate(time.Now())
+	h.SetAddressList("From", []*mail.Address{{Name: msg.FromName, Address: from}})
+	if !strings.EqualFold(from, account.SMTP.From) {
+		// ✅ Sent for a doctor through the clinic's account
+		h.SetAddressList("Sender", []*mail.Address{{Address: account.SMTP.From}})
+	}
+	h.SetAddressList("To", addressList(msg.To))
+	if len(msg.Cc) > 0 {
+		h.SetAddressList("Cc", addressList(msg.Cc))
+	}
+	h.SetSubject(msg.Subject)
+	h.Set("Message-Id", newMessageID(from))
+	h.Set("MIME-Version", "1.0")
+
+	entity, err := buildContentEntity(msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.SMIME != nil {
+		if entity, err = applySMIME(entity, msg.SMIME); err != nil {
+			return nil, err
+		}
+	}
+	return joinEntity(h.Header, entity)
+}
+
+// buildContentEntity renders the bodies and attachments as one MIME entity,
+// header fields included, ready to be signed or joined to the message header
+func buildContentEntity(msg *OutgoingMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	if len(msg.Attachments) == 0 {
+		err := writeBodyEntity(func(ph message.Header) (*message.Writer, error) {
+			return message.CreateWriter(&buf, ph)
+		}, message.Header{}, msg)
+		return buf.Bytes(), err
+	}
+
+	var h message.Header
+	h.SetContentType("multipart/mixed", nil)
+	mw, err := message.CreateWriter(&buf, h)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeBodyEntity(mw.CreatePart, message.Header{}, msg); err != nil {
+		return nil, err
+	}
+	for _, att := range msg.Attachments {
+		contentType := att.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		var ah message.Header
+		ah.SetContentType(contentType, map[string]string{"name": att.Filename})
+		ah.SetContentDisposition("attachment", map[string]string{"filename": att.Filename})
+		ah.Set("Content-Transfer-Encoding", "base64")
+		if err := writePart(mw.CreatePart, ah, att.Data); err != nil {
+			return nil, fmt.Errorf("failed to write attachment %s: %w", att.Filename, err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// BuildSignedMessage is BuildMessage with a DKIM signature when a key is
+// configured for the From domain or the account's domain, see InitDKIMSigners
+func BuildSignedMessage(account *config.MailAccount, msg *OutgoingMessage) ([]byte, error) {
+	raw, err := BuildMessage(account, msg)
+	if err != nil {
+		return nil, err
+	}
+	return signDKIM(raw, account.SMTP.From)
+}
+
+// writeBodyEntity writes the text and HTML bodies as one entity carrying the
+// header fields in h: a single part, or multipart/alternative for both
+func writeBodyEntity(create func(message.Header) (*message.Writer, error), h message.Header, msg *OutgoingMessage) error {
+	type body struct{ contentType, text string }
+	var bodies []body
+	if msg.TextBody != "" || msg.HTMLBody == "" {
+		bodies = append(bodies, body{"text/plain", msg.TextBody})
+	}
+	if msg.HTMLBody != "" {
+		bodies = append(bodies, body{"text/html", msg.HTMLBody})
+	}
+
+	if len(bodies) == 1 {
+		h.SetContentType(bodies[0].contentType, map[string]string{"charset": "utf-8"})
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+		return writePart(create, h, []byte(bodies[0].text))
+	}
+
+	h.SetContentType("multipart/alternative", nil)
+	w, err := create(h)
+	if err != nil {
+		return err
+	}
+	for _, b := range bodies {
+		var ph message.Header
+		ph.SetContentType(b.contentType, map[string]string{"charset": "utf-8"})
+		ph.Set("Content-Transfer-Encoding", "quoted-printable")
+		if err := writePart(w.CreatePart, ph, []byte(b.text)); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// writePart writes one leaf part; go-message applies its Content-Transfer-Encoding
+func writePart(create func(message.Header) (*message.Writer, error), h message.Header, data []byte) error {
+	w, err := create(h)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func addressList(addrs []string) []*mail.Address {
+	var list []*mail.Address
+	for _, addr := range addrs {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			list = append(list, &mail.Address{Address: addr})
+		}
+	}
+	return list
+}
+
+// newMessageID returns a unique Message-ID in the sender's domain
+func newMessageID(from string) string {
+	domain := "localhost"
+	if _, d, ok := strings.Cut(from, "@"); ok && d != "" {
+		domain = d
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return "<" + hex.EncodeToString(id) + "@" + domain + ">"
+}
@@ -0,0 +1,367 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"email-client/config"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// recordingMailer keeps the messages it is given instead of sending them, and
+// fails with err when that is set
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []OutgoingMessage
+	err  error
+}
+
+func (r *recordingMailer) Send(account *config.MailAccount, msg *OutgoingMessage) ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	raw, err := BuildMessage(account, msg)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, *msg)
+	return raw, nil
+}
+
+func (r *recordingMailer) Sent() []OutgoingMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]OutgoingMessage(nil), r.sent...)
+}
+
+// withRecordingMailer sends through a recordingMailer for the duration of a test
+func withRecordingMailer(t *testing.T) *recordingMailer {
+	t.Helper()
+	rec := &recordingMailer{}
+	previous := SetMailer(rec)
+	t.Cleanup(func() { SetMailer(previous) })
+	return rec
+}
+
+// fakePlainSMTP accepts one connection and answers like a server without
+// STARTTLS, recording whether a message was handed over
+func fakePlainSMTP(t *testing.T) (host, port string, delivered <-chan bool) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	result := make(chan bool, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			result <- false
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+		reply("220 fake ESMTP")
+		data, gotMessage := false, false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				result <- gotMessage
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if data {
+				if line == "." {
+					data, gotMessage = false, true
+					reply("250 queued")
+				}
+				continue
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+			case "EHLO", "HELO":
+				reply("250-fake\r\n250 8BITMIME")
+			case "DATA":
+				data = true
+				reply("354 go ahead")
+			case "QUIT":
+				reply("221 bye")
+				result <- gotMessage
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	host, port, _ = net.SplitHostPort(ln.Addr().String())
+	return host, port, result
+}
+
+func TestSendSMTPWithoutTLS(t *testing.T) {
+	tests := []struct {
+		name          string
+		requireTLS    bool
+		wantErr       error
+		wantDelivered bool
+	}{
+		{"refused when TLS is required", true, errSMTPNoTLS, false},
+		{"sent in the clear otherwise", false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, delivered := fakePlainSMTP(t)
+			cfg := &config.SMTPConfig{From: "reports@clinic.example", SMTPPort: port}
+
+			err := sendSMTP(cfg, host, tt.requireTLS, []string{"p@vault.example"}, []byte("Subject: hi\r\n\r\nhello\r\n"))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil && isTransientMailError(err) {
+				t.Error("missing TLS is retried as a temporary failure")
+			}
+			if tt.wantErr == nil {
+				if got := <-delivered; got != tt.wantDelivered {
+					t.Errorf("delivered = %v, want %v", got, tt.wantDelivered)
+				}
+			}
+		})
+	}
+}
+
+func TestSkipCertificateCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		security string
+		insecure string
+		host     string
+		want     bool
+	}{
+		{"checked by default", "", "", "smtp.clinic.example", false},
+		{"security=false alone checks every host", "false", "", "smtp.clinic.example", false},
+		{"opted-in host", "false", "relay.clinic.example", "relay.clinic.example", true},
+		{"opted-in host, any case", "false", " Relay.Clinic.example ", "relay.clinic.example", true},
+		{"other hosts still checked", "false", "relay.clinic.example", "smtp.mailhost.example", false},
+		{"host without security=false", "", "relay.clinic.example", "relay.clinic.example", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.SMTPConfig{SMTPSecurity: tt.security, InsecureHost: tt.insecure}
+			if got := skipCertificateCheck(cfg, tt.host); got != tt.want {
+				t.Errorf("skipCertificateCheck = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// mimePart is one leaf of a parsed test message
+type mimePart struct {
+	contentType string
+	encoding    string
+	filename    string
+	body        string
+}
+
+// parseTestMessage reads a built message back the way a mail client would
+func parseTestMessage(t *testing.T, raw []byte) (*mail.Header, string, []mimePart) {
+	t.Helper()
+	for i, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 998 {
+			t.Fatalf("line %d is %d bytes long", i, len(line))
+		}
+	}
+	for _, b := range raw {
+		if b >= 0x80 {
+			t.Fatal("message contains 8-bit bytes")
+		}
+	}
+
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("mail.CreateReader: %v", err)
+	}
+	defer mr.Close()
+	topType, _, _ := mr.Header.ContentType()
+
+	var parts []mimePart
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart: %v", err)
+		}
+		body, err := io.ReadAll(p.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part := mimePart{encoding: p.Header.Get("Content-Transfer-Encoding"), body: string(body)}
+		part.contentType, _, _ = mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if h, ok := p.Header.(*mail.AttachmentHeader); ok {
+			part.filename, _ = h.Filename()
+		}
+		parts = append(parts, part)
+	}
+	return &mr.Header, topType, parts
+}
+
+func TestBuildMessage(t *testing.T) {
+	account := &config.MailAccount{SMTP: config.SMTPConfig{From: "reports@clinic.example"}}
+	longLine := strings.Repeat("Paracetamol 500 mg twice daily after food. ", 40)
+
+	tests := []struct {
+		name      string
+		msg       OutgoingMessage
+		wantType  string
+		wantParts []mimePart // body is matched as a substring
+		wantFrom  string
+		wantSend  string // Sender, "" when there must be none
+	}{
+		{
+			name:      "plain text",
+			msg:       OutgoingMessage{To: []string{"p@vault.example"}, Subject: "Noreply: Vault access OTP", TextBody: "OTP: 123456"},
+			wantType:  "text/plain",
+			wantParts: []mimePart{{contentType: "text/plain", encoding: "quoted-printable", body: "OTP: 123456"}},
+			wantFrom:  "reports@clinic.example",
+		},
+		{
+			name:      "html only",
+			msg:       OutgoingMessage{To: []string{"p@vault.example"}, Subject: "Registration", HTMLBody: "<p>Welcome</p>"},
+			wantType:  "text/html",
+			wantParts: []mimePart{{contentType: "text/html", encoding: "quoted-printable", body: "<p>Welcome</p>"}},
+			wantFrom:  "reports@clinic.example",
+		},
+		{
+			name:     "text and html",
+			msg:      OutgoingMessage{To: []string{"p@vault.example"}, Subject: "Report", TextBody: "Take rest.", HTMLBody: "<p>Take rest.</p>"},
+			wantType: "multipart/alternative",
+			wantParts: []mimePart{
+				{contentType: "text/plain", encoding: "quoted-printable", body: "Take rest."},
+				{contentType: "text/html", encoding: "quoted-printable", body: "<p>Take rest.</p>"},
+			},
+			wantFrom: "reports@clinic.example",
+		},
+		{
+			name: "report from a doctor with a unicode attachment name",
+			msg: OutgoingMessage{
+				Class: MessageClassReport, From: "dr.rao@clinic.example", FromName: "Dr. Rāo",
+				To: []string{"p@vault.example"}, Cc: []string{"copy@clinic.example"},
+				Subject: "Échographie – résultats", HTMLBody: "<p>" + longLine + "</p>",
+				Attachments: []OutgoingAttachment{{Filename: "Échographie Asha.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4 \x00\xff")}},
+			},
+			wantType: "multipart/mixed",
+			wantParts: []mimePart{
+				{contentType: "text/html", encoding: "quoted-printable", body: longLine},
+				{contentType: "application/pdf", encoding: "base64", filename: "Échographie Asha.pdf", body: "%PDF-1.4 \x00\xff"},
+			},
+			wantFrom: "dr.rao@clinic.example",
+			wantSend: "reports@clinic.example",
+		},
+		{
+			name: "attachment without a content type",
+			msg: OutgoingMessage{
+				To: []string{"p@vault.example"}, Subject: "Scan", TextBody: "Attached.",
+				Attachments: []OutgoingAttachment{{Filename: "scan.dcm", Data: []byte("DICM")}},
+			},
+			wantType: "multipart/mixed",
+			wantParts: []mimePart{
+				{contentType: "text/plain", encoding: "quoted-printable", body: "Attached."},
+				{contentType: "application/octet-stream", encoding: "base64", filename: "scan.dcm", body: "DICM"},
+			},
+			wantFrom: "reports@clinic.example",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := BuildMessage(account, &tt.msg)
+			if err != nil {
+				t.Fatalf("BuildMessage: %v", err)
+			}
+			h, topType, parts := parseTestMessage(t, raw)
+
+			if topType != tt.wantType {
+				t.Errorf("Content-Type = %s, want %s", topType, tt.wantType)
+			}
+			if h.Get("MIME-Version") != "1.0" {
+				t.Error("MIME-Version missing")
+			}
+			if subject, _ := h.Subject(); subject != tt.msg.Subject {
+				t.Errorf("Subject = %q, want %q", subject, tt.msg.Subject)
+			}
+			from, _ := h.AddressList("From")
+			if len(from) != 1 || from[0].Address != tt.wantFrom || from[0].Name != tt.msg.FromName {
+				t.Errorf("From = %v, want %q <%s>", from, tt.msg.FromName, tt.wantFrom)
+			}
+			if sender := h.Get("Sender"); !strings.Contains(sender, tt.wantSend) || (tt.wantSend == "") != (sender == "") {
+				t.Errorf("Sender = %q, want %q", sender, tt.wantSend)
+			}
+			if to, _ := h.AddressList("To"); len(to) != len(tt.msg.To) {
+				t.Errorf("To = %v, want %v", to, tt.msg.To)
+			}
+			if cc, _ := h.AddressList("Cc"); len(cc) != len(tt.msg.Cc) {
+				t.Errorf("Cc = %v, want %v", cc, tt.msg.Cc)
+			}
+			if id, err := h.MessageID(); err != nil || !strings.HasSuffix(id, "@clinic.example") {
+				t.Errorf("Message-Id = %q (%v), want one in the sender's domain", id, err)
+			}
+
+			if len(parts) != len(tt.wantParts) {
+				t.Fatalf("got %d parts, want %d", len(parts), len(tt.wantParts))
+			}
+			for i, want := range tt.wantParts {
+				got := parts[i]
+				if got.contentType != want.contentType || got.encoding != want.encoding || got.filename != want.filename {
+					t.Errorf("part %d = %s %s %q, want %s %s %q", i, got.contentType, got.encoding, got.filename, want.contentType, want.encoding, want.filename)
+				}
+				if !strings.Contains(got.body, want.body) {
+					t.Errorf("part %d body %q does not contain %q", i, got.body, want.body)
+				}
+			}
+		})
+	}
+}
+
+func TestSendEmailThroughMailer(t *testing.T) {
+	account := &config.MailAccount{SMTP: config.SMTPConfig{From: "vault@clinic.example"}}
+
+	t.Run("otp", func(t *testing.T) {
+		rec := withRecordingMailer(t)
+		if err := SendEmail(account, "482913", "p@vault.example", "Asha"); err != nil {
+			t.Fatalf("SendEmail: %v", err)
+		}
+		sent := rec.Sent()
+		if len(sent) != 1 {
+			t.Fatalf("sent %d messages, want 1", len(sent))
+		}
+		msg := sent[0]
+		if msg.Class != MessageClassOTP || msg.Subject != SubjectTemplate || len(msg.To) != 1 || msg.To[0] != "p@vault.example" {
+			t.Errorf("unexpected message %+v", msg)
+		}
+		if !strings.Contains(msg.TextBody, "OTP: 482913") || !strings.Contains(msg.TextBody, "Dear Asha") {
+			t.Errorf("body = %q", msg.TextBody)
+		}
+	})
+
+	t.Run("mailer error", func(t *testing.T) {
+		rec := withRecordingMailer(t)
+		rec.err = &MailUnavailableError{Protocol: "SMTP", Account: "clinic", Err: io.EOF}
+		if err := SendEmail(account, "482913", "p@vault.example", "Asha"); !errors.Is(err, ErrMailUnavailable) {
+			t.Fatalf("err = %v, want ErrMailUnavailable", err)
+		}
+		if len(rec.Sent()) != 0 {
+			t.Error("failed send was recorded")
+		}
+	})
+}
@@ -0,0 +1,299 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"email-client/config"
+	"email-client/models"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	defaultClamdAddress = "tcp://127.0.0.1:3310"
+	defaultClamdTimeout = 2 * time.Minute
+	clamdDialTimeout    = 5 * time.Second
+	clamdChunkSize      = 64 << 10
+)
+
+var (
+	// ErrQuarantined is returned for attachments the malware scanner flagged
+	ErrQuarantined = errors.New("attachment quarantined")
+
+	// ErrScannerUnavailable is returned when attachments can't be scanned;
+	// they are not served unscanned
+	ErrScannerUnavailable = errors.New("malware scanner unavailable")
+
+	errAttachmentRead = errors.New("error reading attachment for scanning")
+)
+
+// eicarSignature is the standard antivirus test file, which every scanner
+// reports as infected
+var eicarSignature = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+// ScanResult is the verdict on one attachment
+type ScanResult struct {
+	Infected  bool
+	Signature string // what was found, e.g. "Win.Test.EICAR_HDB-1"
+}
+
+// MalwareScanner checks attachment content before it is cached or served
+type MalwareScanner interface {
+	Scan(r io.Reader) (ScanResult, error)
+}
+
+var (
+	malwareScannerInstance MalwareScanner
+	malwareScannerOnce     sync.Once
+)
+
+// malwareScanner returns the scanner chosen by MALWARE_SCANNER: "clamd" (the
+// default) talks to the daemon at CLAMD_ADDRESS, "local" is the in-process
+// SignatureScanner for development and tests
+func malwareScanner() MalwareScanner {
+	malwareScannerOnce.Do(func() {
+		switch strings.ToLower(os.Getenv("MALWARE_SCANNER")) {
+		case "local":
+			malwareScannerInstance = NewEICARScanner()
+			log.Println("⚠️ Malware scanner: local EICAR stand-in, attachments are NOT checked for real malware")
+		default:
+			scanner := NewClamdScanner(os.Getenv("CLAMD_ADDRESS"))
+			if d, err := time.ParseDuration(os.Getenv("CLAMD_TIMEOUT")); err == nil && d > 0 {
+				scanner.Timeout = d
+			}
+			malwareScannerInstance = scanner
+			log.Printf("✅ Malware scanner: clamd at %s://%s", scanner.Network, scanner.Address)
+		}
+	})
+	return malwareScannerInstance
+}
+
+// ClamdScanner scans through a clamd daemon with the INSTREAM command
+type ClamdScanner struct {
+	Network string // "tcp" or "unix"
+	Address string
+	Timeout time.Duration // for the whole scan of one attachment
+}
+
+// NewClamdScanner takes an address like "tcp://127.0.0.1:3310",
+// "unix:///var/run/clamav/clamd.ctl", a bare host:port or a socket path
+func NewClamdScanner(address string) *ClamdScanner {
+	if address == "" {
+		address = defaultClamdAddress
+	}
+	s := &ClamdScanner{Network: "tcp", Address: address, Timeout: defaultClamdTimeout}
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		s.Network, s.Address = "unix", strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "tcp://"):
+		s.Address = strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "/"):
+		s.Network = "unix"
+	}
+	return s
+}
+
+// Scan streams r to clamd in chunks and reads its verdict
+func (s *ClamdScanner) Scan(r io.Reader) (ScanResult, error) {
+	conn, err := net.DialTimeout(s.Network, s.Address, clamdDialTimeout)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("%w: %v", ErrScannerUnavailable, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	// ✅ clamd stops reading when a stream exceeds its StreamMaxLength and
+	// replies with an error, so a failed write still leaves a reply to read
+	writeErr := s.send(conn, r)
+	if errors.Is(writeErr, errAttachmentRead) {
+		return ScanResult{}, writeErr
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		if writeErr != nil {
+			err = writeErr
+		}
+		return ScanResult{}, fmt.Errorf("%w: %v", ErrScannerUnavailable, err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\r\n"))
+}
+
+func (s *ClamdScanner) send(conn net.Conn, r io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+	chunk := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk[:4], uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errAttachmentRead, err)
+		}
+	}
+	// ✅ A zero-length chunk ends the stream
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseClamdReply reads "stream: OK", "stream: <signature> FOUND" or "<reason> ERROR"
+func parseClamdReply(reply string) (ScanResult, error) {
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd could not scan the attachment: %s", reply)
+	}
+}
+
+// SignatureScanner is an in-process stand-in for clamd that looks for fixed
+// byte patterns. It finds the EICAR test file and nothing real.
+type SignatureScanner struct {
+	Signatures []ScanSignature
+}
+
+// ScanSignature is one byte pattern SignatureScanner looks for
+type ScanSignature struct {
+	Name    string
+	Pattern []byte
+}
+
+// NewEICARScanner returns a SignatureScanner that knows the EICAR test file
+func NewEICARScanner() *SignatureScanner {
+	return &SignatureScanner{Signatures: []ScanSignature{{Name: "Eicar-Test-Signature", Pattern: eicarSignature}}}
+}
+
+// Scan reads r in chunks, keeping enough of the previous chunk to find
+// patterns that straddle two reads
+func (s *SignatureScanner) Scan(r io.Reader) (ScanResult, error) {
+	overlap := 0
+	for _, sig := range s.Signatures {
+		if len(sig.Pattern) > overlap {
+			overlap = len(sig.Pattern)
+		}
+	}
+
+	window := make([]byte, 0, overlap+clamdChunkSize)
+	chunk := make([]byte, clamdChunkSize)
+	for {
+		n, err := r.Read(chunk)
+		window = append(window, chunk[:n]...)
+		for _, sig := range s.Signatures {
+			if len(sig.Pattern) > 0 && bytes.Contains(window, sig.Pattern) {
+				return ScanResult{Infected: true, Signature: sig.Name}, nil
+			}
+		}
+		if err == io.EOF {
+			return ScanResult{}, nil
+		}
+		if err != nil {
+			return ScanResult{}, fmt.Errorf("%w: %v", errAttachmentRead, err)
+		}
+		keep := overlap - 1
+		if keep < 0 {
+			keep = 0
+		}
+		if len(window) > keep {
+			window = window[:copy(window, window[len(window)-keep:])]
+		}
+	}
+}
+
+// scanFile scans a spooled attachment
+func scanFile(path string) (ScanResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("failed to open attachment for scanning: %w", err)
+	}
+	defer f.Close()
+	return malwareScanner().Scan(f)
+}
+
+// scanMessageAttachments scans every attachment of a raw message and returns
+// the infected ones by part path
+func scanMessageAttachments(raw []byte) (map[string]ScanResult, error) {
+	infected := make(map[string]ScanResult)
+	err := walkMIMEParts(bytes.NewReader(raw), func(path string, e *message.Entity) (bool, error) {
+		disposition, _, _ := mime.ParseMediaType(e.Header.Get("Content-Disposition"))
+		if !isAttachmentPart(disposition, entityFilename(e), partContentID(e.Header.Get("Content-ID"))) {
+			return false, nil
+		}
+		result, err := malwareScanner().Scan(e.Body)
+		if err != nil {
+			return true, fmt.Errorf("failed to scan part %s: %w", path, err)
+		}
+		if result.Infected {
+			infected[path] = result
+		}
+		return false, nil
+	})
+	return infected, err
+}
+
+// flagAttachmentThreats marks the infected attachments in a message's listing entry
+func flagAttachmentThreats(attachments []models.AttachmentInfo, infected map[string]ScanResult) {
+	for i := range attachments {
+		if result, ok := infected[attachments[i].Part]; ok {
+			attachments[i].Quarantined = true
+			attachments[i].Threat = result.Signature
+		}
+	}
+}
+
+// flagQuarantinedAttachment marks an attachment that was found infected when
+// it was opened in the MailIndex and MailSearch, so listings show it
+func flagQuarantinedAttachment(store MailStore, folder string, emailUID uint32, part, threat string) {
+	status, err := store.Status(folder)
+	if err != nil {
+		log.Printf("⚠️ Could not flag quarantined attachment %s of UID %d: %v", part, emailUID, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"account":          store.Account().ID,
+		"mailbox":          folder,
+		"uid_validity":     status.UIDValidity,
+		"uid":              emailUID,
+		"attachments.part": part,
+	}
+	update := bson.M{"$set": bson.M{"attachments.$.quarantined": true, "attachments.$.threat": threat}}
+	for _, col := range []*mongo.Collection{config.GetMailIndexCollection(), config.GetMailSearchCollection()} {
+		if _, err := col.UpdateOne(ctx, filter, update); err != nil {
+			log.Printf("⚠️ Could not flag quarantined attachment %s of UID %d: %v", part, emailUID, err)
+		}
+	}
+
+	// ✅ The cached body still lists the attachment as it was before the scan
+	document := EncodeDocumentID(DocumentRef{Account: store.Account().ID, Mailbox: folder, UIDValidity: status.UIDValidity, UID: emailUID})
+	if err := dropSanitizedBodies(ctx, document); err != nil {
+		log.Printf("⚠️ Could not drop the cached body of UID %d: %v", emailUID, err)
+	}
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"bytes"
+	"email-client/config"
+	"email-client/models"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a MailStore that keeps messages in memory, for local runs and tests
+type MemoryStore struct {
+	account *config.MailAccount
+	mu      sync.RWMutex
+	folders map[string]*memoryFolder
+}
+
+type memoryFolder struct {
+	uidValidity uint32
+	nextUID     uint32
+	raw         map[uint32][]byte
+	envelopes   map[uint32]*models.IndexedMessage
+}
+
+func NewMemoryStore(account *config.MailAccount) *MemoryStore {
+	return &MemoryStore{account: account, folders: make(map[string]*memoryFolder)}
+}
+
+func (s *MemoryStore) Account() *config.MailAccount {
+	return s.account
+}
+
+// folder returns the named folder, creating it on first use. Callers must hold s.mu for writing.
+func (s *MemoryStore) folder(mailbox string) *memoryFolder {
+	f, ok := s.folders[mailbox]
+	if !ok {
+		f = &memoryFolder{
+			uidValidity: uint32(time.Now().Unix()),
+			nextUID:     1,
+			raw:         make(map[uint32][]byte),
+			envelopes:   make(map[uint32]*models.IndexedMessage),
+		}
+		s.folders[mailbox] = f
+	}
+	return f
+}
+
+// Add stores a raw RFC 822 message in mailbox and returns its UID
+func (s *MemoryStore) Add(mailbox string, raw []byte) (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.folder(mailbox)
+	uid := f.nextUID
+	env, err := envelopeFromRaw(raw, mailbox, f.uidValidity, uid)
+	if err != nil {
+		return 0, err
+	}
+
+	f.raw[uid] = raw
+	f.envelopes[uid] = env
+	f.nextUID++
+	return uid, nil
+}
+
+// LoadDir adds every *.eml file in dir to INBOX, and every *.eml file in a
+// subdirectory to the folder of the same name
+func (s *MemoryStore) LoadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	load := func(mailbox, path string) error {
+		files, err := filepath.Glob(filepath.Join(path, "*.eml"))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			raw, err := os.ReadFile(f)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", f, err)
+			}
+			if _, err := s.Add(mailbox, raw); err != nil {
+				log.Printf("⚠️ Skipping %s: %v", f, err)
+			}
+		}
+		log.Printf("✅ Loaded %d messages into memory folder %s", len(files), mailbox)
+		return nil
+	}
+
+	if err := load(config.DefaultMailFolder, dir); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			if err := load(e.Name(), filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Status(mailbox string) (*MailboxStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.folder(mailbox)
+	return &MailboxStatus{
+		Name:        mailbox,
+		UIDValidity: f.uidValidity,
+		UIDNext:     f.nextUID,
+		Messages:    uint32(len(f.raw)),
+	}, nil
+}
+
+func (s *MemoryStore) Search(mailbox string, filter MailFilter) ([]uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f, ok := s.folders[mailbox]
+	if !ok {
+		return nil, nil
+	}
+
+	var uids []uint32
+	for uid, env := range f.envelopes {
+		if matchesFilter(env, filter) {
+			uids = append(uids, uid)
+		}
+	}
+	sortUIDs(uids)
+	return uids, nil
+}
+
+func (s *MemoryStore) Envelopes(mailbox string, uids []uint32) ([]models.IndexedMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f, ok := s.folders[mailbox]
+	if !ok {
+		return nil, nil
+	}
+
+	var envelopes []models.IndexedMessage
+	for _, uid := range uids {
+		if env := f.envelopes[uid]; env != nil {
+			envelopes = append(envelopes, *env)
+		}
+	}
+	return envelopes, nil
+}
+
+func (s *MemoryStore) FetchRaw(mailbox string, uid uint32) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if f, ok := s.folders[mailbox]; ok {
+		if raw, ok := f.raw[uid]; ok {
+			return raw, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: UID %d in %s", ErrMessageNotFound, uid, mailbox)
+}
+
+func (s *MemoryStore) OpenRaw(mailbox string, uid uint32) (io.ReadCloser, error) {
+	raw, err := s.FetchRaw(mailbox, uid)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(raw)), nil
+}
+
+func (s *MemoryStore) OpenPart(mailbox string, uid uint32, path string) (*MessagePart, error) {
+	return openRawPart(s, mailbox, uid, path)
+}
+
+// Append is Add; the memory store keeps no flags
+func (s *MemoryStore) Append(mailbox string, flags []string, date time.Time, raw []byte) error {
+	_, err := s.Add(mailbox, raw)
+	return err
+}
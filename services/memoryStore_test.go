@@ -0,0 +1,100 @@
+package services
+
+import (
+	"email-client/config"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testMessage(from, to, messageID string, date time.Time) []byte {
+	return []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: OPD report\r\nMessage-ID: <%s>\r\nDate: %s\r\n\r\nReport attached.\r\n",
+		from, to, messageID, date.Format(time.RFC1123Z)))
+}
+
+func newTestMemoryStore(t *testing.T) *MemoryStore {
+	t.Helper()
+	store := NewMemoryStore(&config.MailAccount{ID: "memory"})
+	day := time.Date(2024, 3, 10, 9, 0, 0, 0, time.UTC)
+	messages := [][]byte{
+		testMessage("Lab <lab@example.com>", "clinic@example.com", "1@lab", day),
+		testMessage("Dr Rao <rao@example.com>", "clinic@example.com, billing@example.com", "2@rao", day.AddDate(0, 0, 1)),
+		testMessage("Lab <LAB@example.com>", "billing@example.com", "3@lab", day.AddDate(0, 0, 2)),
+		[]byte("Subject: no addresses\r\n\r\nbody\r\n"),
+	}
+	for _, raw := range messages {
+		if _, err := store.Add(config.DefaultMailFolder, raw); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	return store
+}
+
+func TestMemoryStoreSearch(t *testing.T) {
+	store := newTestMemoryStore(t)
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		mailbox string
+		filter  MailFilter
+		want    []uint32
+	}{
+		{"all in uid order", config.DefaultMailFolder, MailFilter{}, []uint32{1, 2, 3, 4}},
+		{"from is case-insensitive", config.DefaultMailFolder, MailFilter{From: "Lab@Example.com"}, []uint32{1, 3}},
+		{"to any recipient", config.DefaultMailFolder, MailFilter{To: "billing"}, []uint32{2, 3}},
+		{"message id with brackets", config.DefaultMailFolder, MailFilter{MessageID: "<2@rao>"}, []uint32{2}},
+		{"min uid", config.DefaultMailFolder, MailFilter{MinUID: 2}, []uint32{2, 3, 4}},
+		{"since is inclusive", config.DefaultMailFolder, MailFilter{Since: day.AddDate(0, 0, 1)}, []uint32{2, 3}},
+		{"before is exclusive", config.DefaultMailFolder, MailFilter{Before: day.AddDate(0, 0, 1)}, []uint32{1, 4}}, // 4 has no date
+		{"combined", config.DefaultMailFolder, MailFilter{From: "lab@example.com", To: "clinic"}, []uint32{1}},
+		{"no match", config.DefaultMailFolder, MailFilter{From: "nobody@example.com"}, nil},
+		{"unknown mailbox", "Archive", MailFilter{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.Search(tt.mailbox, tt.filter)
+			if err != nil {
+				t.Fatalf("Search: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Search(%q, %+v) = %v, want %v", tt.mailbox, tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreEnvelopes(t *testing.T) {
+	store := newTestMemoryStore(t)
+
+	tests := []struct {
+		name    string
+		mailbox string
+		uids    []uint32
+		want    []string // message IDs, in the order returned
+	}{
+		{"in requested order", config.DefaultMailFolder, []uint32{3, 1}, []string{"3@lab", "1@lab"}},
+		{"missing uids skipped", config.DefaultMailFolder, []uint32{2, 99}, []string{"2@rao"}},
+		{"message without addresses", config.DefaultMailFolder, []uint32{4}, []string{""}},
+		{"unknown mailbox", "Archive", []uint32{1}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelopes, err := store.Envelopes(tt.mailbox, tt.uids)
+			if err != nil {
+				t.Fatalf("Envelopes: %v", err)
+			}
+			var got []string
+			for _, env := range envelopes {
+				if env.Mailbox != tt.mailbox {
+					t.Errorf("envelope %d mailbox = %q, want %q", env.UID, env.Mailbox, tt.mailbox)
+				}
+				got = append(got, env.MessageID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Envelopes(%q, %v) = %v, want %v", tt.mailbox, tt.uids, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package services
+
+import (
+	"bytes"
+	"email-client/models"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+)
+
+// ErrInvalidPart is returned for a part path that isn't of the form 2.1
+var ErrInvalidPart = errors.New("invalid MIME part path")
+
+var partPathPattern = regexp.MustCompile(`^[1-9][0-9]*(\.[1-9][0-9]*)*$`)
+
+// MessagePart is one decoded MIME part of a message, read straight from the
+// mail store. Close releases the message behind it.
+type MessagePart struct {
+	Path     string // IMAP part path, e.g. "2.1"
+	Filename string
+	MIMEType string    // from the part's Content-Type, may be empty
+	Body     io.Reader // decoded content
+	closer   io.Closer
+}
+
+func (p *MessagePart) Close() error {
+	if p.closer == nil {
+		return nil
+	}
+	return p.closer.Close()
+}
+
+// parsePartPath checks a part path and splits it into the numbers IMAP expects
+func parsePartPath(path string) ([]int, error) {
+	if !partPathPattern.MatchString(path) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPart, path)
+	}
+	var numbers []int
+	for _, s := range strings.Split(path, ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidPart, path)
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, nil
+}
+
+func joinPartPath(parent string, n int) string {
+	if parent == "" {
+		return strconv.Itoa(n)
+	}
+	return parent + "." + strconv.Itoa(n)
+}
+
+// isAttachmentPart tells attachments apart from body text and embedded images:
+// anything marked as attachment, and named parts that carry no Content-ID
+// (some mailers send attachments as inline parts with a file name)
+func isAttachmentPart(disposition, filename, contentID string) bool {
+	if strings.EqualFold(disposition, "attachment") {
+		return true
+	}
+	return filename != "" && contentID == ""
+}
+
+// attachmentDisplayName names attachments that came without a file name
+func attachmentDisplayName(filename, path string) string {
+	if filename != "" {
+		return filename
+	}
+	return "attachment-" + path
+}
+
+// attachmentsFromStructure lists the attachments of an IMAP BODYSTRUCTURE with
+// their part paths. Messages attached as message/rfc822 count as one attachment.
+func attachmentsFromStructure(bs *imap.BodyStructure, path string) []models.AttachmentInfo {
+	if bs == nil {
+		return nil
+	}
+	if strings.EqualFold(bs.MIMEType, "multipart") {
+		var infos []models.AttachmentInfo
+		for i, sub := range bs.Parts {
+			infos = append(infos, attachmentsFromStructure(sub, joinPartPath(path, i+1))...)
+		}
+		return infos
+	}
+	if path == "" {
+		path = "1" // a single-part message is part 1
+	}
+
+	// ✅ The file name is a Content-Disposition parameter, with the Content-Type name as fallback
+	filename := decodedParam(bs.DispositionParams, "filename")
+	if filename == "" {
+		filename = decodedParam(bs.Params, "name")
+	}
+	if !isAttachmentPart(bs.Disposition, filename, bs.Id) {
+		return nil
+	}
+	return []models.AttachmentInfo{{
+		Part:     path,
+		Name:     attachmentDisplayName(filename, path),
+		MIMEType: strings.ToLower(bs.MIMEType + "/" + bs.MIMESubType),
+		Size:     decodedSizeEstimate(bs.Encoding, bs.Size),
+	}}
+}
+
+// decodedSizeEstimate turns the encoded size IMAP reports into the file size:
+// base64 carries 57 bytes per 78-byte line
+func decodedSizeEstimate(encoding string, size uint32) int64 {
+	if strings.EqualFold(encoding, "base64") {
+		return int64(size) * 57 / 78
+	}
+	return int64(size)
+}
+
+// attachmentNamesOf lists just the names, for the attachment_names field
+func attachmentNamesOf(infos []models.AttachmentInfo) []string {
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	return names
+}
+
+// walkMIMEParts calls fn for every leaf part of the message in r with its IMAP
+// part path, until fn asks to stop. Part bodies are decoded by go-message.
+func walkMIMEParts(r io.Reader, fn func(path string, e *message.Entity) (stop bool, err error)) error {
+	e, err := message.Read(r)
+	if err != nil && !message.IsUnknownCharset(err) {
+		return fmt.Errorf("failed to parse email: %w", err)
+	}
+	_, err = walkMIMEEntity(e, "", fn)
+	return err
+}
+
+func walkMIMEEntity(e *message.Entity, path string, fn func(string, *message.Entity) (bool, error)) (bool, error) {
+	if mr := e.MultipartReader(); mr != nil {
+		for i := 1; ; i++ {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return false, nil
+			}
+			if err != nil && !message.IsUnknownCharset(err) {
+				return false, fmt.Errorf("error reading multipart part: %w", err)
+			}
+			if stop, err := walkMIMEEntity(part, joinPartPath(path, i), fn); stop || err != nil {
+				return stop, err
+			}
+		}
+	}
+	if path == "" {
+		path = "1"
+	}
+	return fn(path, e)
+}
+
+// entityFilename returns the decoded file name of a part, see partFilename
+func entityFilename(e *message.Entity) string {
+	return partFilename(e.Header.Get("Content-Disposition"), e.Header.Get("Content-Type"))
+}
+
+// attachmentsFromRaw lists the attachments of a raw message like
+// attachmentsFromStructure does for IMAP, with exact sizes
+func attachmentsFromRaw(raw []byte) ([]models.AttachmentInfo, error) {
+	var infos []models.AttachmentInfo
+	err := walkMIMEParts(bytes.NewReader(raw), func(path string, e *message.Entity) (bool, error) {
+		disposition, _, _ := mime.ParseMediaType(e.Header.Get("Content-Disposition"))
+		filename := entityFilename(e)
+		if !isAttachmentPart(disposition, filename, partContentID(e.Header.Get("Content-ID"))) {
+			return false, nil
+		}
+		mimeType, _, _ := mime.ParseMediaType(e.Header.Get("Content-Type"))
+		size, _ := io.Copy(io.Discard, e.Body)
+		infos = append(infos, models.AttachmentInfo{
+			Part:     path,
+			Name:     attachmentDisplayName(filename, path),
+			MIMEType: mimeType,
+			Size:     size,
+		})
+		return false, nil
+	})
+	return infos, err
+}
+
+// findPartByPath returns the part at path of the message in r with its body
+// positioned for streaming; r must stay open until Body has been read
+func findPartByPath(r io.Reader, path string) (*MessagePart, error) {
+	if _, err := parsePartPath(path); err != nil {
+		return nil, err
+	}
+
+	var found *MessagePart
+	err := walkMIMEParts(r, func(p string, e *message.Entity) (bool, error) {
+		if p != path {
+			return false, nil
+		}
+		found = messagePartFromEntity(path, e)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: part %s", ErrAttachmentNotFound, path)
+	}
+	return found, nil
+}
+
+func messagePartFromEntity(path string, e *message.Entity) *MessagePart {
+	mimeType, _, _ := mime.ParseMediaType(e.Header.Get("Content-Type"))
+	return &MessagePart{
+		Path:     path,
+		Filename: attachmentDisplayName(entityFilename(e), path),
+		MIMEType: mimeType,
+		Body:     e.Body,
+	}
+}
+
+// openRawPart implements MailStore.OpenPart for stores that keep whole messages
+func openRawPart(store MailStore, mailbox string, uid uint32, path string) (*MessagePart, error) {
+	raw, err := store.OpenRaw(mailbox, uid)
+	if err != nil {
+		return nil, err
+	}
+	part, err := findPartByPath(raw, path)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	part.closer = raw
+	return part, nil
+}
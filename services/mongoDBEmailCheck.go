@@ -83,6 +83,33 @@ func CheckAccessValue(doctorId, patientId string) (string, error) {
 	return result.HasAccess, nil
 }
 
+// PatientsWithAccess lists the patients (mobile numbers) who granted doctorId access
+func PatientsWithAccess(doctorId string) ([]string, error) {
+	collection := config.GetDoctorPatientAccessCollection()
+
+	cursor, err := collection.Find(context.TODO(), bson.M{
+		"DoctorId":  doctorId,
+		"HasAccess": "Y",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+
+	var records []struct {
+		PatientId string `bson:"PatientId"`
+	}
+	if err := cursor.All(context.TODO(), &records); err != nil {
+		return nil, err
+	}
+
+	patients := make([]string, 0, len(records))
+	for _, r := range records {
+		patients = append(patients, r.PatientId)
+	}
+	return patients, nil
+}
+
 func UpdateAccessIfExists(doctorId, patientId string) error {
 	collection := config.GetDoctorPatientAccessCollection()
 
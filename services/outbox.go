@@ -0,0 +1,382 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"email-client/config"
+	"email-client/models"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	OutboxQueued  = "queued"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed"
+)
+
+const (
+	defaultOutboxWorkers = 2
+	outboxMaxAttempts    = 8
+	outboxBaseDelay      = 1 * time.Minute
+	outboxMaxDelay       = 1 * time.Hour
+	outboxLease          = 10 * time.Minute // a job still "sending" after this was lost by a crashed worker
+	outboxPollInterval   = 15 * time.Second
+	outboxListLimit      = 50
+)
+
+var (
+	// ErrJobNotFound is returned for an outbox job that doesn't exist or belongs to another doctor
+	ErrJobNotFound = errors.New("outbox job not found")
+
+	// ErrJobNotFailed is returned when resending a job that hasn't failed
+	ErrJobNotFailed = errors.New("only failed jobs can be resent")
+
+	// errOutboxLeaseLost means another worker claimed the job after this one's lease ran out
+	errOutboxLeaseLost = errors.New("outbox job was claimed by another worker")
+)
+
+// outboxWake nudges an idle worker when a job is queued
+var outboxWake = make(chan struct{}, 1)
+
+func ensureOutboxIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := config.GetOutboxCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt", Value: 1}}},
+		{Keys: bson.D{{Key: "doctor", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	return err
+}
+
+// EnqueueOPDReport saves an OPD report for the workers to generate and mail,
+// and returns the queued job
+func EnqueueOPDReport(account *config.MailAccount, opdData models.OpdModel, recipientEmail, loggedInEmail, fromName string) (*models.OutboxJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	job := &models.OutboxJob{
+		ID:          newOutboxJobID(),
+		Account:     account.ID,
+		Doctor:      loggedInEmail,
+		FromName:    fromName,
+		Recipient:   recipientEmail,
+		OPD:         opdData,
+		Status:      OutboxQueued,
+		NextAttempt: now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if _, err := config.GetOutboxCollection().InsertOne(ctx, job); err != nil {
+		return nil, fmt.Errorf("failed to queue report: %w", err)
+	}
+	log.Printf("📤 Report for %s queued as job %s", recipientEmail, job.ID)
+
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// OutboxJobFor returns one of the doctor's jobs
+func OutboxJobFor(doctor, id string) (*models.OutboxJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var job models.OutboxJob
+	err := config.GetOutboxCollection().FindOne(ctx, bson.M{"_id": id, "doctor": doctor}).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox job: %w", err)
+	}
+	return &job, nil
+}
+
+// ListOutboxJobs returns the doctor's latest jobs, optionally only those with the given status
+func ListOutboxJobs(doctor, status string, limit int) ([]models.OutboxJob, error) {
+	if limit <= 0 || limit > outboxListLimit {
+		limit = outboxListLimit
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"doctor": doctor}
+	if status != "" {
+		filter["status"] = status
+	}
+	cursor, err := config.GetOutboxCollection().Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list outbox jobs: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	jobs := []models.OutboxJob{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, fmt.Errorf("failed to decode outbox jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// ResendOutboxJob queues a failed job again with a fresh set of attempts
+func ResendOutboxJob(doctor, id string) (*models.OutboxJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var job models.OutboxJob
+	err := config.GetOutboxCollection().FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "doctor": doctor, "status": OutboxFailed},
+		bson.M{"$set": bson.M{"status": OutboxQueued, "attempts": 0, "next_attempt": now, "updated_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, lookupErr := OutboxJobFor(doctor, id); lookupErr != nil {
+			return nil, lookupErr
+		}
+		return nil, fmt.Errorf("%w: job %s", ErrJobNotFailed, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to requeue outbox job: %w", err)
+	}
+	log.Printf("📤 Job %s queued again by %s", id, doctor)
+
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+	return &job, nil
+}
+
+// outboxWorkerCount is the number of jobs sent in parallel, OUTBOX_WORKERS
+func outboxWorkerCount() int {
+	n, err := strconv.Atoi(os.Getenv("OUTBOX_WORKERS"))
+	if err != nil || n <= 0 {
+		return defaultOutboxWorkers
+	}
+	return n
+}
+
+// StartOutboxWorkers runs the worker pool that sends queued jobs until the
+// returned stop function is called. A job being sent when stop is called is
+// finished first.
+func StartOutboxWorkers() (stop func()) {
+	if err := ensureOutboxIndexes(); err != nil {
+		log.Printf("⚠️ Could not create Outbox indexes: %v", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	workers := outboxWorkerCount()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(outboxPollInterval)
+			defer ticker.Stop()
+
+			for {
+				failAbandonedOutboxJobs()
+
+				// ✅ Drain the queue, then wait for a new job or the next poll
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					job, err := claimOutboxJob()
+					if err != nil {
+						if !errors.Is(err, mongo.ErrNoDocuments) {
+							log.Printf("❌ Outbox: failed to claim a job: %v", err)
+						}
+						break
+					}
+					runOutboxJob(job)
+				}
+
+				select {
+				case <-done:
+					return
+				case <-outboxWake:
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+
+	log.Printf("✅ Outbox started with %d worker(s)", workers)
+	return func() {
+		close(done)
+		wg.Wait()
+		log.Println("✅ Outbox stopped")
+	}
+}
+
+// outboxClaimFilter matches the jobs a worker may take: due queued jobs, and
+// jobs whose worker died while sending them that have attempts left
+func outboxClaimFilter(now time.Time) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"status": OutboxQueued, "next_attempt": bson.M{"$lte": now}},
+		{"status": OutboxSending, "lease_until": bson.M{"$lt": now}, "attempts": bson.M{"$lt": outboxMaxAttempts}},
+	}}
+}
+
+// claimOutboxJob takes the oldest due job, or one whose worker died while sending it
+func claimOutboxJob() (*models.OutboxJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var job models.OutboxJob
+	err := config.GetOutboxCollection().FindOneAndUpdate(ctx,
+		outboxClaimFilter(now),
+		bson.M{
+			"$set": bson.M{"status": OutboxSending, "lease_until": now.Add(outboxLease), "updated_at": now},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "next_attempt", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// renewOutboxLease gives the worker a full lease again, unless another worker
+// has claimed the job in the meantime. Claiming counts an attempt, so the
+// attempt number tells whose lease it is.
+func renewOutboxLease(job *models.OutboxJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	res, err := config.GetOutboxCollection().UpdateOne(ctx,
+		bson.M{"_id": job.ID, "status": OutboxSending, "attempts": job.Attempts},
+		bson.M{"$set": bson.M{"lease_until": now.Add(outboxLease), "updated_at": now}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to renew outbox lease: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return errOutboxLeaseLost
+	}
+	return nil
+}
+
+// failAbandonedOutboxJobs gives up on jobs whose worker died while sending
+// them on their last attempt. The report may have gone out, so they are not
+// retried on their own; the doctor can resend them.
+func failAbandonedOutboxJobs() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	res, err := config.GetOutboxCollection().UpdateMany(ctx,
+		bson.M{"status": OutboxSending, "lease_until": bson.M{"$lt": now}, "attempts": bson.M{"$gte": outboxMaxAttempts}},
+		bson.M{"$set": bson.M{
+			"status":      OutboxFailed,
+			"last_error":  "worker stopped while sending; check whether the report arrived before resending",
+			"lease_until": time.Time{},
+			"updated_at":  now,
+		}},
+	)
+	if err != nil {
+		log.Printf("❌ Outbox: failed to fail abandoned jobs: %v", err)
+		return
+	}
+	if res.ModifiedCount > 0 {
+		log.Printf("⚠️ Outbox: %d job(s) abandoned on their last attempt marked failed", res.ModifiedCount)
+	}
+}
+
+// runOutboxJob generates and sends one report, then records the outcome:
+// sent, queued again after a backoff when the mail server was unavailable,
+// or failed
+func runOutboxJob(job *models.OutboxJob) {
+	startTime := time.Now()
+
+	err := sendOutboxJob(job)
+	if errors.Is(err, errOutboxLeaseLost) {
+		log.Printf("⚠️ Outbox job %s was claimed by another worker, not sending it twice", job.ID)
+		return
+	}
+	now := time.Now()
+	set := bson.M{"updated_at": now, "lease_until": time.Time{}}
+	switch {
+	case err == nil:
+		set["status"] = OutboxSent
+		set["sent_at"] = now
+		set["last_error"] = ""
+		log.Printf("✅ Outbox job %s sent to %s in %v ms (attempt %d)", job.ID, job.Recipient, time.Since(startTime).Milliseconds(), job.Attempts)
+	case errors.Is(err, ErrMailUnavailable) && job.Attempts < outboxMaxAttempts:
+		delay := outboxBackoff(job.Attempts)
+		if retryAfter, ok := MailRetryAfter(err); ok && retryAfter > delay {
+			delay = retryAfter
+		}
+		set["status"] = OutboxQueued
+		set["next_attempt"] = now.Add(delay)
+		set["last_error"] = err.Error()
+		log.Printf("⚠️ Outbox job %s failed (attempt %d/%d), retrying in %v: %v", job.ID, job.Attempts, outboxMaxAttempts, delay, err)
+	default:
+		set["status"] = OutboxFailed
+		set["last_error"] = err.Error()
+		log.Printf("❌ Outbox job %s failed after %d attempt(s): %v", job.ID, job.Attempts, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := config.GetOutboxCollection().UpdateOne(ctx, bson.M{"_id": job.ID, "attempts": job.Attempts}, bson.M{"$set": set}); err != nil {
+		log.Printf("❌ Outbox: failed to record the outcome of job %s: %v", job.ID, err)
+	}
+}
+
+func sendOutboxJob(job *models.OutboxJob) error {
+	account, err := config.MailAccountByID(job.Account)
+	if err != nil {
+		return fmt.Errorf("mail account %s: %w", job.Account, err)
+	}
+	// ✅ Typst may have eaten into the lease: renew it, and make sure no other
+	// worker took the job over, before handing the report to SMTP
+	return GeneratePDFAndSendEmail(account, job.OPD, job.Recipient, job.Doctor, job.FromName, func() error {
+		return renewOutboxLease(job)
+	})
+}
+
+// outboxBackoff doubles the delay per attempt up to outboxMaxDelay
+func outboxBackoff(attempt int) time.Duration {
+	delay := outboxBaseDelay
+	for i := 1; i < attempt && delay < outboxMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > outboxMaxDelay {
+		delay = outboxMaxDelay
+	}
+	return delay
+}
+
+func newOutboxJobID() string {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
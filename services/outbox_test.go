@@ -0,0 +1,58 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, outboxBaseDelay},
+		{1, outboxBaseDelay},
+		{2, 2 * outboxBaseDelay},
+		{3, 4 * outboxBaseDelay},
+		{6, 32 * outboxBaseDelay},
+		{7, outboxMaxDelay},
+		{outboxMaxAttempts, outboxMaxDelay},
+		{100, outboxMaxDelay},
+	}
+	for _, tt := range tests {
+		if got := outboxBackoff(tt.attempt); got != tt.want {
+			t.Errorf("outboxBackoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestOutboxClaimFilter(t *testing.T) {
+	now := time.Now()
+	branches, ok := outboxClaimFilter(now)["$or"].([]bson.M)
+	if !ok || len(branches) != 2 {
+		t.Fatalf("unexpected claim filter %v", outboxClaimFilter(now))
+	}
+
+	tests := []struct {
+		name   string
+		branch bson.M
+		want   bson.M
+	}{
+		{"due queued jobs", branches[0], bson.M{"status": OutboxQueued, "next_attempt": bson.M{"$lte": now}}},
+		{
+			"expired leases with attempts left",
+			branches[1],
+			bson.M{"status": OutboxSending, "lease_until": bson.M{"$lt": now}, "attempts": bson.M{"$lt": outboxMaxAttempts}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.branch, tt.want) {
+				t.Errorf("filter = %v, want %v", tt.branch, tt.want)
+			}
+		})
+	}
+}
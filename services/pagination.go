@@ -0,0 +1,127 @@
+package services
+
+import (
+	"email-client/models"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 200
+)
+
+// ErrInvalidCursor is returned for a next_cursor that wasn't issued by MessagePage
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// MessageQuery pages and date-filters a message listing. Since is inclusive,
+// Before exclusive; zero values leave that end open. Threads pages through
+// conversations instead of single messages.
+type MessageQuery struct {
+	Page    int
+	Limit   int
+	Since   time.Time
+	Before  time.Time
+	Threads bool
+}
+
+// normalize applies the default page and limit and caps the limit
+func (q MessageQuery) normalize() MessageQuery {
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultPageLimit
+	}
+	if q.Limit > MaxPageLimit {
+		q.Limit = MaxPageLimit
+	}
+	return q
+}
+
+func (q MessageQuery) offset() int {
+	return (q.Page - 1) * q.Limit
+}
+
+// MessagePage is one page of a listing, newest first. A threaded listing fills
+// Threads and counts threads in Total; Messages is then empty.
+type MessagePage struct {
+	Messages   []models.Message `json:"emails"`
+	Threads    []models.Thread  `json:"threads,omitempty"`
+	Total      int64            `json:"total"`
+	Page       int              `json:"page"`
+	Limit      int              `json:"limit"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// newMessagePage wraps one page of results, adding a cursor when more remain
+func newMessagePage(messages []models.Message, total int64, q MessageQuery) *MessagePage {
+	if messages == nil {
+		messages = []models.Message{}
+	}
+	page := &MessagePage{Messages: messages, Total: total, Page: q.Page, Limit: q.Limit}
+	page.setNextCursor(len(messages), q)
+	return page
+}
+
+// newThreadPage is newMessagePage for a threaded listing
+func newThreadPage(threads []models.Thread, total int64, q MessageQuery) *MessagePage {
+	if threads == nil {
+		threads = []models.Thread{}
+	}
+	page := &MessagePage{Messages: []models.Message{}, Threads: threads, Total: total, Page: q.Page, Limit: q.Limit}
+	page.setNextCursor(len(threads), q)
+	return page
+}
+
+func (p *MessagePage) setNextCursor(count int, q MessageQuery) {
+	if int64(q.offset()+count) < p.Total {
+		next := q
+		next.Page++
+		p.NextCursor = EncodePageCursor(next)
+	}
+}
+
+type pageCursor struct {
+	Page    int   `json:"p"`
+	Limit   int   `json:"l"`
+	Since   int64 `json:"s,omitempty"`
+	Before  int64 `json:"b,omitempty"`
+	Threads bool  `json:"t,omitempty"`
+}
+
+// EncodePageCursor turns a query into the opaque next_cursor token
+func EncodePageCursor(q MessageQuery) string {
+	c := pageCursor{Page: q.Page, Limit: q.Limit, Threads: q.Threads}
+	if !q.Since.IsZero() {
+		c.Since = q.Since.Unix()
+	}
+	if !q.Before.IsZero() {
+		c.Before = q.Before.Unix()
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodePageCursor restores the query a cursor was issued for
+func DecodePageCursor(cursor string) (MessageQuery, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return MessageQuery{}, ErrInvalidCursor
+	}
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Page < 1 {
+		return MessageQuery{}, ErrInvalidCursor
+	}
+
+	q := MessageQuery{Page: c.Page, Limit: c.Limit, Threads: c.Threads}
+	if c.Since != 0 {
+		q.Since = time.Unix(c.Since, 0).UTC()
+	}
+	if c.Before != 0 {
+		q.Before = time.Unix(c.Before, 0).UTC()
+	}
+	return q, nil
+}
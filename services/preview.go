@@ -0,0 +1,225 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // register decoders for image.Decode
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	previewMaxSize     = 320 // longest edge of a thumbnail, in pixels
+	previewJPEGQuality = 80
+	previewPDFTimeout  = 30 * time.Second
+	previewMaxPixels   = 40 << 20 // larger images aren't decoded: a small compressed file can claim a huge canvas
+)
+
+// ErrNoPreview is returned for attachments that have no thumbnail, e.g. Word files
+var ErrNoPreview = errors.New("no preview available for this attachment")
+
+var pdftoppmMissing sync.Once
+
+// PreviewKind tells whether an attachment gets a thumbnail: "image", "pdf", "dicom" or ""
+func PreviewKind(mimeType, filename string) string {
+	mimeType = strings.ToLower(mimeType)
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch {
+	case mimeType == "image/jpeg", mimeType == "image/png", mimeType == "image/gif",
+		ext == ".jpg", ext == ".jpeg", ext == ".png", ext == ".gif":
+		return "image"
+	case mimeType == "application/pdf", ext == ".pdf":
+		return "pdf"
+	case isDICOM(mimeType, filename):
+		return "dicom"
+	default:
+		return ""
+	}
+}
+
+// OpenPreview returns a small JPEG of an image attachment, of the first page
+// of a PDF or of the first frame of a DICOM file, rendering it into the attachment cache on first use.
+// Callers must close the file.
+func OpenPreview(store MailStore, folder string, emailUID uint32, part string) (*AttachmentFile, error) {
+	src, err := OpenAttachment(store, folder, emailUID, part)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	kind := PreviewKind(src.MIMEType, src.Filename)
+	if kind == "" {
+		return nil, fmt.Errorf("%w: %s", ErrNoPreview, src.Filename)
+	}
+
+	// ✅ Previews are keyed by the attachment's content, like the attachment itself
+	path := attachmentPreviewPath(src.SHA256)
+	if file, err := openPreviewFile(path, src.Filename); err == nil {
+		return file, nil
+	}
+
+	startTime := time.Now()
+	var data []byte
+	switch kind {
+	case "image":
+		data, err = renderImagePreview(src)
+	case "pdf":
+		data, err = renderPDFPreview(src.File.Name())
+	case "dicom":
+		data, err = renderDICOMPreview(src.File.Name())
+	}
+	if err != nil {
+		log.Printf("⚠️ Preview of '%s' failed: %v", src.Filename, err)
+		return nil, fmt.Errorf("%w: %v", ErrNoPreview, err)
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		return nil, fmt.Errorf("failed to store preview: %w", err)
+	}
+	log.Printf("🖼️ Preview of '%s' rendered in %v ms", src.Filename, time.Since(startTime).Milliseconds())
+	return openPreviewFile(path, src.Filename)
+}
+
+// attachmentPreviewPath is where the thumbnail of the attachment with the given SHA-256 is stored
+func attachmentPreviewPath(sum string) string {
+	return filepath.Join(attachmentCacheDir(), "previews", sum[:2], sum+"-"+strconv.Itoa(previewMaxSize)+".jpg")
+}
+
+func openPreviewFile(path, filename string) (*AttachmentFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &AttachmentFile{
+		File:     f,
+		Filename: strings.TrimSuffix(filename, filepath.Ext(filename)) + "-preview.jpg",
+		MIMEType: "image/jpeg",
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	}, nil
+}
+
+// renderImagePreview scales a JPEG, PNG or GIF down to previewMaxSize
+func renderImagePreview(src io.ReadSeeker) ([]byte, error) {
+	// ✅ Check the dimensions in the header before allocating the whole image
+	cfg, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > previewMaxPixels {
+		return nil, fmt.Errorf("image is too large to preview (%dx%d)", cfg.Width, cfg.Height)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return encodeThumbnail(img)
+}
+
+// encodeThumbnail scales an image down to previewMaxSize and encodes it as JPEG
+func encodeThumbnail(img image.Image) ([]byte, error) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > previewMaxSize || h > previewMaxSize {
+		if w >= h {
+			w, h = previewMaxSize, h*previewMaxSize/w
+		} else {
+			w, h = w*previewMaxSize/h, previewMaxSize
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src) // flatten transparency onto white
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: previewJPEGQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode preview: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// renderPDFPreview renders the first page with poppler's pdftoppm (PDFTOPPM_PATH, default "pdftoppm")
+func renderPDFPreview(pdfPath string) ([]byte, error) {
+	bin := os.Getenv("PDFTOPPM_PATH")
+	if bin == "" {
+		bin = "pdftoppm"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), previewPDFTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, bin,
+		"-q", "-jpeg", "-jpegopt", "quality="+strconv.Itoa(previewJPEGQuality),
+		"-f", "1", "-singlefile", "-scale-to", strconv.Itoa(previewMaxSize),
+		pdfPath) // no output root: the page is written to stdout
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			pdftoppmMissing.Do(func() {
+				log.Printf("⚠️ %s not found: PDF attachments won't get previews", bin)
+			})
+		}
+		return nil, fmt.Errorf("pdftoppm failed: %v %s", err, stderr.String())
+	}
+	if out.Len() == 0 {
+		return nil, errors.New("pdftoppm produced no image")
+	}
+	return out.Bytes(), nil
+}
+
+// writeFileAtomic writes data through a temp file in the cache, so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmpDir := filepath.Join(attachmentCacheDir(), "tmp")
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(tmpDir, "preview-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"email-client/config"
+	"email-client/models"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// errNotArchived is returned, together with no archive copy, when a report
+// went out but archiveCopy could not rebuild it for the ArchiveMailbox
+var errNotArchived = errors.New("report sent but not archived")
+
+// archiveSentReport appends a sent report, read (\Seen), to the ArchiveMailbox
+// and indexes that mailbox right away, so the doctor sees the report without
+// waiting for the relay to deliver it back. copyErr is the errNotArchived the
+// send returned, if any. The report has already gone out, so failures are only
+// logged: failing the job would send it again.
+func archiveSentReport(account *config.MailAccount, raw []byte, copyErr error) {
+	mailbox := config.ArchiveMailbox()
+	if mailbox == "" {
+		return
+	}
+	if copyErr != nil {
+		log.Printf("❌ Failed to archive report in %s/%s: %v", account.ID, mailbox, copyErr)
+		return
+	}
+	if len(raw) == 0 {
+		return
+	}
+
+	store, err := MailStoreFor(account)
+	if err != nil {
+		log.Printf("⚠️ Report not archived: %v", err)
+		return
+	}
+	if err := store.Append(mailbox, []string{imap.SeenFlag}, time.Now(), raw); err != nil {
+		log.Printf("❌ Failed to archive report in %s/%s: %v", account.ID, mailbox, err)
+		return
+	}
+	log.Printf("🗄️ Report archived in %s/%s", account.ID, mailbox)
+
+	// ✅ Index it now rather than on the next periodic sync
+	syncMu.Lock()
+	err = syncMailbox(store, mailbox)
+	syncMu.Unlock()
+	if err != nil {
+		log.Printf("⚠️ Archived report will show up after the next sync: %v", err)
+	}
+}
+
+// archiveCopy returns the copy of a sent report to keep in the ArchiveMailbox.
+// A report encrypted to the patient could not be read back from the archive,
+// so it is rebuilt signed only, under the header fields it went out with: both
+// copies share the Message-ID and dedupeStages still merges them.
+func archiveCopy(sent []byte, msg *OutgoingMessage) ([]byte, error) {
+	if msg.SMIME == nil || len(msg.SMIME.EncryptTo) == 0 {
+		return sent, nil
+	}
+
+	h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(sent)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sent header: %w", err)
+	}
+	// ✅ The signature and the content fields belong to the encrypted body
+	for _, k := range []string{"DKIM-Signature", "Content-Type", "Content-Transfer-Encoding", "Content-Disposition"} {
+		h.Del(k)
+	}
+
+	entity, err := buildContentEntity(msg)
+	if err != nil {
+		return nil, err
+	}
+	signOnly := &SMIMEOptions{Certificate: msg.SMIME.Certificate, PrivateKey: msg.SMIME.PrivateKey, Chain: msg.SMIME.Chain}
+	if entity, err = applySMIME(entity, signOnly); err != nil {
+		return nil, err
+	}
+	return joinEntity(message.Header{Header: h}, entity)
+}
+
+// dedupeStages collapse the copies of one message, such as an archived report
+// and the one the relay delivered to INBOX, into a single index entry. The
+// ArchiveMailbox copy wins; messages without a Message-ID are never merged.
+func dedupeStages() mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$addFields", Value: bson.M{
+			"copy_key": bson.M{"$cond": bson.A{
+				bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{"$message_id", ""}}, ""}},
+				"$_id",
+				"$message_id",
+			}},
+			"archived": bson.M{"$eq": bson.A{"$mailbox", config.ArchiveMailbox()}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "archived", Value: -1}, {Key: "date", Value: -1}, {Key: "mailbox", Value: 1}, {Key: "uid", Value: -1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$copy_key", "doc": bson.M{"$first": "$$ROOT"}}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$doc"}}},
+		{{Key: "$project", Value: bson.M{"copy_key": 0, "archived": 0}}},
+	}
+}
+
+// dedupeEnvelopes is dedupeStages for envelopes read from the store directly
+func dedupeEnvelopes(envelopes []models.IndexedMessage) []models.IndexedMessage {
+	archive := config.ArchiveMailbox()
+	kept := make([]models.IndexedMessage, 0, len(envelopes))
+	byMessageID := make(map[string]int)
+	for _, env := range envelopes {
+		if env.MessageID == "" {
+			kept = append(kept, env)
+			continue
+		}
+		i, seen := byMessageID[env.MessageID]
+		if !seen {
+			byMessageID[env.MessageID] = len(kept)
+			kept = append(kept, env)
+			continue
+		}
+		if env.Mailbox == archive && kept[i].Mailbox != archive {
+			kept[i] = env
+		}
+	}
+	return kept
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"email-client/config"
+	"email-client/models"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// testCertificate returns a self-signed RSA certificate for addr
+func testCertificate(t *testing.T, addr string) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: addr},
+		EmailAddresses: []string{addr},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func readTestHeader(t *testing.T, raw []byte) textproto.Header {
+	t.Helper()
+	h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestArchiveCopy(t *testing.T) {
+	clinicCert, clinicKey := testCertificate(t, "reports@clinic.example")
+	patientCert, _ := testCertificate(t, "9876543210@vault.example")
+	account := &config.MailAccount{SMTP: config.SMTPConfig{From: "reports@clinic.example"}}
+
+	tests := []struct {
+		name          string
+		smime         *SMIMEOptions
+		wantUnchanged bool
+	}{
+		{"plain report", nil, true},
+		{"signed report", &SMIMEOptions{Certificate: clinicCert, PrivateKey: clinicKey}, true},
+		{"encrypted and signed report", &SMIMEOptions{Certificate: clinicCert, PrivateKey: clinicKey, EncryptTo: []*x509.Certificate{patientCert, clinicCert}}, false},
+		{"encrypted report without a signing certificate", &SMIMEOptions{EncryptTo: []*x509.Certificate{patientCert}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &OutgoingMessage{
+				Class:    MessageClassReport,
+				To:       []string{"9876543210@vault.example"},
+				Subject:  "OPD report",
+				HTMLBody: "<p>Take rest.</p>",
+				Attachments: []OutgoingAttachment{
+					{Filename: "OPD_Asha.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4 test")},
+				},
+				SMIME: tt.smime,
+			}
+			sent, err := BuildMessage(account, msg)
+			if err != nil {
+				t.Fatalf("BuildMessage: %v", err)
+			}
+
+			archived, err := archiveCopy(sent, msg)
+			if err != nil {
+				t.Fatalf("archiveCopy: %v", err)
+			}
+			if tt.wantUnchanged {
+				if !bytes.Equal(archived, sent) {
+					t.Fatal("archive copy differs from the sent message")
+				}
+				return
+			}
+
+			sentHeader, archivedHeader := readTestHeader(t, sent), readTestHeader(t, archived)
+			if got, want := archivedHeader.Get("Message-Id"), sentHeader.Get("Message-Id"); got != want {
+				t.Errorf("Message-Id = %q, want %q", got, want)
+			}
+			if len(archivedHeader.Values("Content-Type")) != 1 {
+				t.Errorf("archive copy has %d Content-Type fields", len(archivedHeader.Values("Content-Type")))
+			}
+			if bytes.Contains(archived, []byte("application/pkcs7-mime")) {
+				t.Error("archive copy is still encrypted")
+			}
+			if !bytes.Contains(archived, []byte("OPD_Asha.pdf")) {
+				t.Error("archive copy lost the report attachment")
+			}
+			signed := bytes.Contains(archived, []byte("multipart/signed"))
+			if wantSigned := tt.smime.Certificate != nil; signed != wantSigned {
+				t.Errorf("signed = %v, want %v", signed, wantSigned)
+			}
+		})
+	}
+}
+
+func TestDedupeEnvelopes(t *testing.T) {
+	const archive = "Sent Reports"
+	t.Setenv("ARCHIVE_MAILBOX", archive)
+
+	envelopes := []models.IndexedMessage{
+		{Mailbox: "INBOX", UID: 1, MessageID: "a@clinic"},
+		{Mailbox: archive, UID: 7, MessageID: "a@clinic"},
+		{Mailbox: "INBOX", UID: 2},
+		{Mailbox: "INBOX", UID: 3},
+		{Mailbox: "INBOX", UID: 4, MessageID: "b@clinic"},
+	}
+	got := dedupeEnvelopes(envelopes)
+
+	want := []struct {
+		mailbox string
+		uid     uint32
+	}{{archive, 7}, {"INBOX", 2}, {"INBOX", 3}, {"INBOX", 4}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d envelopes, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].Mailbox != w.mailbox || got[i].UID != w.uid {
+			t.Errorf("envelope %d = %s/%d, want %s/%d", i, got[i].Mailbox, got[i].UID, w.mailbox, w.uid)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package services
+
+import (
+	"email-client/config"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	mailRetryAttempts   = 3
+	mailRetryBaseDelay  = 200 * time.Millisecond
+	mailRetryMaxDelay   = 2 * time.Second
+	mailBreakerFailures = 5                // consecutive failed calls before the breaker opens
+	mailBreakerCooldown = 30 * time.Second // how long an open breaker rejects calls
+	mailRetryAfter      = 10 * time.Second // suggested wait after a failed call while the breaker is still closed
+)
+
+// ErrMailUnavailable matches every MailUnavailableError via errors.Is
+var ErrMailUnavailable = errors.New("mail server unavailable")
+
+// MailUnavailableError is returned when an IMAP or SMTP call failed for
+// reasons worth retrying later: the server is unreachable, timed out, answered
+// with a temporary failure, or its circuit breaker is open.
+type MailUnavailableError struct {
+	Protocol   string // "IMAP" or "SMTP"
+	Account    string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *MailUnavailableError) Error() string {
+	return fmt.Sprintf("%s server for account %s unavailable (retry after %v): %v", e.Protocol, e.Account, e.RetryAfter, e.Err)
+}
+
+func (e *MailUnavailableError) Unwrap() error { return e.Err }
+
+func (e *MailUnavailableError) Is(target error) bool { return target == ErrMailUnavailable }
+
+// errBreakerOpen is the cause of a MailUnavailableError raised without trying the server
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// MailRetryAfter returns how long the caller should wait before retrying err,
+// and false when err isn't a MailUnavailableError.
+func MailRetryAfter(err error) (time.Duration, bool) {
+	var unavailable *MailUnavailableError
+	if errors.As(err, &unavailable) {
+		return unavailable.RetryAfter, true
+	}
+	return 0, false
+}
+
+// circuitBreaker stops calling a server that keeps failing: after
+// mailBreakerFailures failed calls in a row it rejects calls for
+// mailBreakerCooldown, then lets a single trial call through.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	name      string
+	failures  int
+	openUntil time.Time
+	trial     bool // a half-open trial call is in flight
+}
+
+// allow reports whether a call may go ahead, or how long the breaker stays open
+func (b *circuitBreaker) allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return 0, true
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return wait, false
+	}
+	// ✅ Cooldown over: half-open, one trial call at a time
+	if b.trial {
+		return mailBreakerCooldown, false
+	}
+	b.trial = true
+	return 0, true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.openUntil.IsZero() {
+		log.Printf("✅ %s circuit breaker closed", b.name)
+	}
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.trial = false
+}
+
+// release ends a half-open trial call that never reached the server, so the
+// next call can try instead; the breaker's state is left as it is
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.trial || b.failures >= mailBreakerFailures {
+		if b.openUntil.IsZero() || b.trial {
+			log.Printf("⚠️ %s circuit breaker open for %v after %d failures", b.name, mailBreakerCooldown, b.failures)
+		}
+		b.openUntil = time.Now().Add(mailBreakerCooldown)
+		b.trial = false
+	}
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*circuitBreaker) // "IMAP/account" → breaker
+)
+
+func breakerFor(protocol string, account *config.MailAccount) *circuitBreaker {
+	name := protocol + "/" + account.ID
+
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	b, ok := breakers[name]
+	if !ok {
+		b = &circuitBreaker{name: name}
+		breakers[name] = b
+	}
+	return b
+}
+
+// withMailRetry runs a mail server call through the account's circuit breaker,
+// retrying transient failures with bounded exponential backoff. op must be safe
+// to repeat. Errors that aren't transient are returned as they are.
+func withMailRetry(protocol string, account *config.MailAccount, op func() error) error {
+	breaker := breakerFor(protocol, account)
+	if wait, ok := breaker.allow(); !ok {
+		return &MailUnavailableError{Protocol: protocol, Account: account.ID, RetryAfter: wait, Err: errBreakerOpen}
+	}
+
+	var err error
+	for attempt := 0; attempt < mailRetryAttempts; attempt++ {
+		if attempt > 0 {
+			delay := backoffDelay(attempt)
+			log.Printf("⚠️ %s call for %s failed, retrying in %v (attempt %d/%d): %v", protocol, account.ID, delay, attempt+1, mailRetryAttempts, err)
+			time.Sleep(delay)
+		}
+
+		err = op()
+		if err == nil {
+			breaker.success()
+			return nil
+		}
+		if errors.Is(err, config.ErrIMAPPoolExhausted) {
+			// ✅ All of our own sessions are busy: the server is fine, and
+			// retrying would only queue for longer
+			breaker.release()
+			return &MailUnavailableError{Protocol: protocol, Account: account.ID, RetryAfter: mailRetryAfter, Err: err}
+		}
+		if !isTransientMailError(err) {
+			// ✅ The server answered; a bad request or missing message says nothing about its health
+			breaker.success()
+			return err
+		}
+	}
+
+	breaker.failure()
+	retryAfter := mailRetryAfter
+	if wait, ok := breaker.allow(); !ok {
+		retryAfter = wait
+	}
+	log.Printf("❌ %s call for %s failed after %d attempts: %v", protocol, account.ID, mailRetryAttempts, err)
+	return &MailUnavailableError{Protocol: protocol, Account: account.ID, RetryAfter: retryAfter, Err: err}
+}
+
+// backoffDelay doubles the base delay per attempt up to the cap, with up to 50% jitter
+func backoffDelay(attempt int) time.Duration {
+	delay := mailRetryBaseDelay << (attempt - 1)
+	if delay > mailRetryMaxDelay {
+		delay = mailRetryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// isTransientMailError reports whether err is a connection-level failure or a
+// temporary server reply (SMTP 4xx) that may succeed when tried again
+func isTransientMailError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrMailUnavailable) {
+		return true
+	}
+
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+
+	// go-imap reports a dropped connection as a plain error
+	return strings.Contains(strings.ToLower(err.Error()), "connection closed")
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"email-client/config"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestWithMailRetry(t *testing.T) {
+	tests := []struct {
+		name            string
+		err             error
+		wantCalls       int
+		wantUnavailable bool
+		wantFailures    int
+	}{
+		{"success", nil, 1, false, 0},
+		{"server error is not retried", fmt.Errorf("failed to select INBOX: %w", errors.New("NO no such mailbox")), 1, false, 0},
+		{"dropped connection is retried", fmt.Errorf("fetch failed: %w", io.EOF), mailRetryAttempts, true, 1},
+		{"busy pool fails fast", fmt.Errorf("failed to connect to IMAP: %w", config.ErrIMAPPoolExhausted), 1, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			account := &config.MailAccount{ID: "retry-" + t.Name()}
+			calls := 0
+			err := withMailRetry("IMAP", account, func() error {
+				calls++
+				return tt.err
+			})
+
+			if calls != tt.wantCalls {
+				t.Errorf("op called %d times, want %d", calls, tt.wantCalls)
+			}
+			if errors.Is(err, ErrMailUnavailable) != tt.wantUnavailable {
+				t.Errorf("err = %v, want unavailable %v", err, tt.wantUnavailable)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, does not wrap %v", err, tt.err)
+			}
+			if got := breakerFor("IMAP", account).failures; got != tt.wantFailures {
+				t.Errorf("breaker failures = %d, want %d", got, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestBusyPoolDoesNotOpenBreaker(t *testing.T) {
+	account := &config.MailAccount{ID: "busy-pool"}
+	for i := 0; i < mailBreakerFailures*2; i++ {
+		withMailRetry("IMAP", account, func() error { return config.ErrIMAPPoolExhausted })
+	}
+	if _, ok := breakerFor("IMAP", account).allow(); !ok {
+		t.Fatal("breaker opened on pool exhaustion")
+	}
+}
+
+func TestBusyPoolReleasesHalfOpenTrial(t *testing.T) {
+	account := &config.MailAccount{ID: "half-open"}
+	breaker := breakerFor("IMAP", account)
+	breaker.openUntil = time.Now().Add(-time.Second) // cooldown over
+
+	withMailRetry("IMAP", account, func() error { return config.ErrIMAPPoolExhausted })
+
+	calls := 0
+	if err := withMailRetry("IMAP", account, func() error { calls++; return nil }); err != nil || calls != 1 {
+		t.Fatalf("trial after a busy pool: err = %v, calls = %d", err, calls)
+	}
+	if !breaker.openUntil.IsZero() {
+		t.Error("breaker still open after a successful trial")
+	}
+}
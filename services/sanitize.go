@@ -0,0 +1,230 @@
+package services
+
+import (
+	"context"
+	"email-client/config"
+	"email-client/models"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/microcosm-cc/bluemonday"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// sanitizerPolicyVersion is stored with every cached body; bump it when the
+	// policy changes so bodies sanitized under the old one are redone.
+	// 2: remote images really blocked, 3: cid: images always linked, never embedded
+	sanitizerPolicyVersion = 3
+	sanitizedBodyTTL       = 30 * 24 * time.Hour
+)
+
+var (
+	// Images the body may show without asking: the message's own inline images
+	localImagePattern = `data:image/(png|jpeg|gif|webp|bmp);base64,[A-Za-z0-9+/=\s]+|/inline-image\?[-\w.~%&=;:+]*`
+	localImageSrc     = regexp.MustCompile(`^(` + localImagePattern + `)$`)
+	anyImageSrc       = regexp.MustCompile(`^(` + localImagePattern + `|https?://\S+)$`)
+
+	remoteImagePattern = regexp.MustCompile(`(?i)<img\b[^>]*\bsrc\s*=\s*["']?\s*(https?:)?//`)
+
+	emailPolicy             = newEmailPolicy(false)
+	emailPolicyRemoteImages = newEmailPolicy(true)
+)
+
+// newEmailPolicy allows the formatting reports use (text, links, tables,
+// inline styles, images) and drops everything else: scripts, event handlers,
+// forms, frames, style sheets and, unless remoteImages, images loaded from
+// other servers, which would tell the sender when the report was read.
+//
+// This is bluemonday's UGCPolicy without its AllowImages: attribute rules are
+// OR-ed, so once UGC lets every img src through no matcher can narrow it again.
+func newEmailPolicy(remoteImages bool) *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowStandardAttributes()
+	p.AllowStandardURLs()
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	p.AllowDataURIImages()
+
+	p.AllowElements(
+		"article", "aside", "figure", "section", "summary",
+		"h1", "h2", "h3", "h4", "h5", "h6", "hgroup",
+		"br", "div", "hr", "p", "span", "wbr",
+		"abbr", "acronym", "cite", "code", "dfn", "em", "figcaption", "mark", "s", "samp", "strong", "sub", "sup", "var",
+		"b", "i", "pre", "small", "strike", "tt", "u", "rp", "rt", "ruby", "del", "ins",
+	)
+	p.AllowAttrs("href").OnElements("a")
+	p.AllowAttrs("cite").OnElements("blockquote", "q")
+	p.AllowAttrs("datetime").Matching(bluemonday.ISO8601).OnElements("time", "del", "ins")
+	p.AllowAttrs("dir").Matching(bluemonday.Direction).OnElements("bdi", "bdo")
+	p.AllowLists()
+	p.AllowTables()
+
+	// ✅ Images: the message's own, plus remote ones only when the doctor asked for them
+	imageSrc := localImageSrc
+	if remoteImages {
+		imageSrc = anyImageSrc
+	}
+	p.AllowAttrs("src").Matching(imageSrc).OnElements("img")
+	p.AllowAttrs("alt").Matching(bluemonday.Paragraph).OnElements("img")
+	p.AllowAttrs("align").Matching(bluemonday.ImageAlign).OnElements("img")
+
+	// ✅ Legacy layout markup common in generated reports
+	p.AllowElements("font", "center")
+	p.AllowAttrs("color", "face", "size").OnElements("font")
+	p.AllowAttrs("bgcolor").OnElements("table", "tr", "td", "th", "body")
+	p.AllowAttrs("border", "cellpadding", "cellspacing", "width").OnElements("table")
+	p.AllowAttrs("width", "height", "valign", "nowrap").OnElements("td", "th")
+	p.AllowAttrs("width", "height", "border").OnElements("img")
+
+	// ✅ Only properties that can't load anything: no background-image, no url()
+	p.AllowStyles(
+		"color", "background-color", "font-family", "font-size", "font-style", "font-weight",
+		"text-align", "text-decoration", "vertical-align", "line-height", "white-space",
+		"border", "border-collapse", "border-color", "border-style", "border-width",
+		"border-top", "border-right", "border-bottom", "border-left",
+		"margin", "margin-top", "margin-right", "margin-bottom", "margin-left",
+		"padding", "padding-top", "padding-right", "padding-bottom", "padding-left",
+		"width", "height", "max-width", "display",
+	).Globally()
+	return p
+}
+
+// SanitizeEmailHTML applies the allow-list policy to a message body. It also
+// reports whether remote images were dropped, so the page can offer to load them.
+func SanitizeEmailHTML(body string, remoteImages bool) (string, bool) {
+	if remoteImages {
+		return emailPolicyRemoteImages.Sanitize(body), false
+	}
+	return emailPolicy.Sanitize(body), remoteImagePattern.MatchString(body)
+}
+
+// EnsureSanitizedBodyIndexes creates the lookup and expiry indexes of the SanitizedBodies collection
+func EnsureSanitizedBodyIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := config.GetSanitizedBodyCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "document", Value: 1}, {Key: "remote_images", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "created_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(sanitizedBodyTTL.Seconds())),
+		},
+	})
+	return err
+}
+
+// FetchSanitizedEmailBody is FetchPlainTextEmailBody with the body sanitized,
+// cached per document so repeated views skip the mail server and the sanitizer
+func FetchSanitizedEmailBody(store MailStore, folder string, emailUID uint32, remoteImages bool, inlineURL func(contentID string) string) (*models.SanitizedBody, error) {
+	document, err := cacheDocumentID(store, folder, emailUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if cached, err := lookupSanitizedBody(document, remoteImages); err == nil {
+		log.Printf("✅ Sanitized body of %s served from cache", document)
+		return cached, nil
+	}
+
+	body, attachments, err := FetchPlainTextEmailBody(store, folder, emailUID, inlineURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// ✅ Show what the malware scanner found so far; a later verdict drops this cache entry
+	markQuarantinedAttachments(document, attachments)
+
+	startTime := time.Now()
+	entry := models.SanitizedBody{
+		Document:      document,
+		RemoteImages:  remoteImages,
+		PolicyVersion: sanitizerPolicyVersion,
+		Attachments:   attachments,
+		CreatedAt:     time.Now(),
+	}
+	entry.Body, entry.RemoteImagesBlocked = SanitizeEmailHTML(body, remoteImages)
+	log.Printf("🧹 Sanitized body of %s in %v ms", document, time.Since(startTime).Milliseconds())
+
+	if err := storeSanitizedBody(&entry); err != nil {
+		log.Printf("⚠️ Failed to cache sanitized body of %s: %v", document, err)
+	}
+	return &entry, nil
+}
+
+func lookupSanitizedBody(document string, remoteImages bool) (*models.SanitizedBody, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var cached models.SanitizedBody
+	err := config.GetSanitizedBodyCollection().FindOne(ctx, bson.M{
+		"document":       document,
+		"remote_images":  remoteImages,
+		"policy_version": sanitizerPolicyVersion,
+	}).Decode(&cached)
+	if err != nil {
+		return nil, err
+	}
+	return &cached, nil
+}
+
+func storeSanitizedBody(entry *models.SanitizedBody) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := config.GetSanitizedBodyCollection().ReplaceOne(ctx,
+		bson.M{"document": entry.Document, "remote_images": entry.RemoteImages},
+		entry,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+// dropSanitizedBodies removes the cached bodies of a document, with and
+// without remote images, once the malware scanner flags one of its attachments
+func dropSanitizedBodies(ctx context.Context, document string) error {
+	_, err := config.GetSanitizedBodyCollection().DeleteMany(ctx, bson.M{"document": document})
+	return err
+}
+
+// markQuarantinedAttachments flags the listed attachments the malware scanner
+// has already found infected, going by the message's index entry
+func markQuarantinedAttachments(document string, attachments []map[string]string) {
+	ref, err := DecodeDocumentID(document)
+	if err != nil || len(attachments) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var indexed models.IndexedMessage
+	err = config.GetMailIndexCollection().FindOne(ctx,
+		bson.M{"account": ref.Account, "mailbox": ref.Mailbox, "uid_validity": ref.UIDValidity, "uid": ref.UID},
+		options.FindOne().SetProjection(bson.M{"attachments": 1}),
+	).Decode(&indexed)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("⚠️ Could not read scan results of %s: %v", document, err)
+		}
+		return
+	}
+
+	threats := make(map[string]string)
+	for _, info := range indexed.Attachments {
+		if info.Quarantined {
+			threats[info.Part] = info.Threat
+		}
+	}
+	for _, att := range attachments {
+		if threat, ok := threats[att["part"]]; ok {
+			att["quarantined"] = "true"
+			att["threat"] = threat
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeEmailHTMLImages(t *testing.T) {
+	const dataPNG = "data:image/png;base64,iVBORw0KGgo="
+
+	tests := []struct {
+		name         string
+		body         string
+		remoteImages bool
+		wantKept     string // must survive, "" when nothing must
+		wantGone     string // must be removed, "" when nothing must
+		wantBlocked  bool
+	}{
+		{"https tracking pixel", `<p>Hi</p><img src="https://tracker.example.com/p.gif?id=1">`, false, "<p>Hi</p>", "tracker.example.com", true},
+		{"protocol-relative image", `<img src="//evil.example/x.png">`, false, "", "evil.example", true},
+		{"http image", `<img src="http://cdn.example/logo.png" alt="logo">`, false, "", "cdn.example", true},
+		{"inline cid image", `<img src="/inline-image?id=abc&amp;cid=logo%40clinic">`, false, `src="/inline-image?id=abc&amp;cid=logo%40clinic"`, "", false},
+		{"data uri image", `<img src="` + dataPNG + `">`, false, dataPNG, "", false},
+		{"remote image when allowed", `<img src="https://cdn.example/logo.png">`, true, "https://cdn.example/logo.png", "", false},
+		{"protocol-relative even when allowed", `<img src="//evil.example/x.png">`, true, "", "evil.example", false},
+		{"script", `<p onclick="steal()">Rx</p><script>steal()</script>`, false, "<p>Rx</p>", "steal", false},
+		{"legacy table layout", `<table border="1" bgcolor="#eee"><tr><td valign="top">5 mg</td></tr></table>`, false, `<td valign="top">5 mg</td>`, "", false},
+		{"links open in a new tab", `<a href="https://clinic.example/">site</a>`, false, `target="_blank"`, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, blocked := SanitizeEmailHTML(tt.body, tt.remoteImages)
+			if tt.wantKept != "" && !strings.Contains(got, tt.wantKept) {
+				t.Errorf("%q missing from %q", tt.wantKept, got)
+			}
+			if tt.wantGone != "" && strings.Contains(got, tt.wantGone) {
+				t.Errorf("%q still in %q", tt.wantGone, got)
+			}
+			if blocked != tt.wantBlocked {
+				t.Errorf("blocked = %v, want %v", blocked, tt.wantBlocked)
+			}
+		})
+	}
+}
@@ -2,8 +2,8 @@ package services
 
 import (
 	"fmt"
+	"html"
 	"log"
-	"net/smtp"
 	"strings"
 	"time"
 
@@ -11,16 +11,13 @@ import (
 	"email-client/models"
 )
 
-// SendEmailNewPatientRegistration sends email with new patient details using ALT SMTP
+// SendEmailNewPatientRegistration sends email with new patient details, from the doctor, through the registration SMTP host
 
-func SendEmailNewPatientRegistration(patientData models.PatientDataModel, recipientEmail, fromName string) error {
+func SendEmailNewPatientRegistration(account *config.MailAccount, patientData models.PatientDataModel, recipientEmail, fromName string) error {
 	start := time.Now()
 
-	// Load SMTP configuration
-	smtpConfig, err := config.LoadSMTPConfig()
-	if err != nil {
-		return fmt.Errorf("failed to load SMTP config: %w", err)
-	}
+	// SMTP configuration of the doctor's clinic
+	smtpConfig := &account.SMTP
 
 	// ✅ Append domain if only mobile is passed
 	if !strings.Contains(recipientEmail, "@") && len(recipientEmail) >= 10 {
@@ -55,34 +52,24 @@ func SendEmailNewPatientRegistration(patientData models.PatientDataModel, recipi
                 <p>Gender: %s</p>
             </body>
         </html>`,
-		patientDataFormatted.PatientName,
-		patientDataFormatted.Email,
-		patientDataFormatted.Mobile,
-		patientDataFormatted.DOB,
-		patientDataFormatted.Gender,
+		html.EscapeString(patientDataFormatted.PatientName),
+		html.EscapeString(patientDataFormatted.Email),
+		html.EscapeString(patientDataFormatted.Mobile),
+		html.EscapeString(patientDataFormatted.DOB),
+		html.EscapeString(patientDataFormatted.Gender),
 	)
 
-	// Build headers
-	message := fmt.Sprintf("From: \"%s\" <%s>\r\n", fromName, patientDataFormatted.DoctorID) +
-		fmt.Sprintf("To: %s\r\n", recipientEmail) +
-		"Subject: New Patient Registration\r\n" +
-		fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)) +
-		"MIME-Version: 1.0\r\n" +
-		"Content-Type: text/html; charset=\"utf-8\"\r\n\r\n" +
-		emailBody
-
 	// Send email
-	auth := smtp.PlainAuth("", smtpConfig.From, smtpConfig.Password, smtpConfig.SMTPHost_ALT)
-
-	err = smtp.SendMail(
-		fmt.Sprintf("%s:%s", smtpConfig.SMTPHost_ALT, smtpConfig.SMTPPort),
-		auth,
-		smtpConfig.From,
-		[]string{recipientEmail},
-		[]byte(message),
-	)
+	_, err := GetMailer().Send(account, &OutgoingMessage{
+		Class:    MessageClassRegistration,
+		From:     patientDataFormatted.DoctorID,
+		FromName: fromName,
+		To:       []string{recipientEmail},
+		Subject:  "New Patient Registration",
+		HTMLBody: emailBody,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to send email: %w", err)
+		return err
 	}
 
 	log.Printf("✅ Email sent to %s (From: %s <%s>)", recipientEmail, fromName, patientDataFormatted.DoctorID)
@@ -0,0 +1,370 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"email-client/config"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"go.mozilla.org/pkcs7"
+)
+
+func init() {
+	// ✅ The library defaults to DES-CBC; reports are enveloped with AES-256
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+}
+
+// SMIMEOptions says how an OutgoingMessage is protected: signed when
+// Certificate and PrivateKey are set, and encrypted when EncryptTo is not empty
+type SMIMEOptions struct {
+	Certificate *x509.Certificate
+	PrivateKey  crypto.PrivateKey
+	Chain       []*x509.Certificate // intermediates sent with the signature
+	EncryptTo   []*x509.Certificate // RSA recipient certificates
+}
+
+// smimeIdentity is a loaded signing certificate
+type smimeIdentity struct {
+	cert  *x509.Certificate
+	chain []*x509.Certificate
+	key   crypto.PrivateKey
+}
+
+var (
+	smimeMu         sync.RWMutex
+	smimeByAddress  map[string]*smimeIdentity // by lower-case address
+	smimeByDomain   map[string]*smimeIdentity // by lower-case domain
+	errNoSMIMEBlock = errors.New("no PEM block found")
+)
+
+// ✅ Call this in main.go; without SMIME_CERTS_FILE reports are sent unsigned
+func InitSMIMEIdentities() error {
+	identities, err := config.LoadSMIMEIdentities()
+	if err != nil {
+		return err
+	}
+
+	byAddress := make(map[string]*smimeIdentity)
+	byDomain := make(map[string]*smimeIdentity)
+	for _, id := range identities {
+		name := id.Address
+		if name == "" {
+			name = "@" + id.Domain
+		}
+		certData, err := os.ReadFile(id.CertificatePath)
+		if err != nil {
+			return fmt.Errorf("❌ Failed to read S/MIME certificate for %s: %w", name, err)
+		}
+		certs, err := ParseSMIMECertificates(certData)
+		if err != nil {
+			return fmt.Errorf("❌ Invalid S/MIME certificate for %s: %w", name, err)
+		}
+		keyData, err := os.ReadFile(id.PrivateKeyPath)
+		if err != nil {
+			return fmt.Errorf("❌ Failed to read S/MIME key for %s: %w", name, err)
+		}
+		key, err := parseSMIMEPrivateKey(keyData)
+		if err != nil {
+			return fmt.Errorf("❌ Invalid S/MIME key for %s: %w", name, err)
+		}
+		if pub, ok := certs[0].PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(key.Public()) {
+			return fmt.Errorf("❌ S/MIME key for %s does not match its certificate", name)
+		}
+
+		identity := &smimeIdentity{cert: certs[0], chain: certs[1:], key: key}
+		if id.Address != "" {
+			byAddress[strings.ToLower(strings.TrimSpace(id.Address))] = identity
+		} else {
+			byDomain[strings.ToLower(strings.TrimPrefix(strings.TrimSpace(id.Domain), "@"))] = identity
+		}
+		if time.Now().After(certs[0].NotAfter) {
+			log.Printf("⚠️ S/MIME certificate for %s expired on %s, reports will go out unsigned", name, certs[0].NotAfter.Format("2006-01-02"))
+		} else {
+			log.Printf("✅ S/MIME signing for %s with %q, valid until %s", name, certs[0].Subject.CommonName, certs[0].NotAfter.Format("2006-01-02"))
+		}
+	}
+
+	smimeMu.Lock()
+	smimeByAddress, smimeByDomain = byAddress, byDomain
+	smimeMu.Unlock()
+	return nil
+}
+
+// ParseSMIMECertificates reads every PEM CERTIFICATE block in data, in order
+func ParseSMIMECertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errNoSMIMEBlock
+	}
+	return certs, nil
+}
+
+// parseSMIMEPrivateKey reads a PEM RSA or ECDSA private key in PKCS#1, SEC 1 or PKCS#8 form
+func parseSMIMEPrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errNoSMIMEBlock
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key: %w", err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// smimeIdentityFor picks the doctor's own certificate, then the clinic's for
+// the From domain, then whatever covers the account's own address or domain
+func smimeIdentityFor(from, accountAddress string) *smimeIdentity {
+	smimeMu.RLock()
+	defer smimeMu.RUnlock()
+
+	for _, addr := range []string{from, accountAddress} {
+		addr = strings.ToLower(strings.TrimSpace(addr))
+		if id := smimeByAddress[addr]; id != nil {
+			return id
+		}
+		if _, domain, ok := strings.Cut(addr, "@"); ok {
+			if id := smimeByDomain[domain]; id != nil {
+				return id
+			}
+		}
+	}
+	return nil
+}
+
+// reportSMIMEOptions returns the protection for a report from a doctor to a
+// patient's vault address: signed when a certificate is configured for the
+// doctor or clinic, encrypted when the patient has a certificate on file.
+// nil means the report goes out as plain MIME.
+func reportSMIMEOptions(account *config.MailAccount, from, recipient string) (*SMIMEOptions, error) {
+	opts := &SMIMEOptions{}
+	if id := smimeIdentityFor(from, account.SMTP.From); id != nil {
+		// ⚠️ An expired certificate would only produce a signature that fails to verify
+		if time.Now().Before(id.cert.NotAfter) {
+			opts.Certificate, opts.PrivateKey, opts.Chain = id.cert, id.key, id.chain
+		}
+	}
+
+	mobile, _, _ := strings.Cut(strings.TrimSpace(recipient), "@")
+	patient, err := GetPatientByMobile(mobile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up patient certificate: %w", err)
+	}
+	if patient != nil && strings.TrimSpace(patient.SMIMECertificate) != "" {
+		// ✅ Fail closed: a patient who gave us a certificate expects encrypted reports
+		cert, err := PatientEncryptionCertificate(patient.SMIMECertificate)
+		if err != nil {
+			return nil, fmt.Errorf("patient %s certificate: %w", mobile, err)
+		}
+		opts.EncryptTo = append(opts.EncryptTo, cert)
+		if opts.Certificate != nil {
+			if _, isRSA := opts.Certificate.PublicKey.(*rsa.PublicKey); isRSA {
+				// ✅ So the sender can still read its own copy
+				opts.EncryptTo = append(opts.EncryptTo, opts.Certificate)
+			}
+		}
+	}
+
+	if opts.Certificate == nil && len(opts.EncryptTo) == 0 {
+		return nil, nil
+	}
+	return opts, nil
+}
+
+// PatientEncryptionCertificate parses a patient's PEM certificate and checks
+// that reports can be encrypted to it today
+func PatientEncryptionCertificate(pemData string) (*x509.Certificate, error) {
+	certs, err := ParseSMIMECertificates([]byte(pemData))
+	if err != nil {
+		return nil, err
+	}
+	cert := certs[0]
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, fmt.Errorf("certificate is not valid now (valid %s to %s)", cert.NotBefore.Format("2006-01-02"), cert.NotAfter.Format("2006-01-02"))
+	}
+	if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("only RSA certificates can be encrypted to, got %T", cert.PublicKey)
+	}
+	if cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageKeyEncipherment == 0 {
+		return nil, errors.New("certificate does not allow key encipherment")
+	}
+	return cert, nil
+}
+
+// applySMIME wraps a MIME entity (its content header fields and body) in
+// multipart/signed and then application/pkcs7-mime, as opts asks
+func applySMIME(entity []byte, opts *SMIMEOptions) ([]byte, error) {
+	entity = canonicalCRLF(entity)
+	var err error
+	if opts.Certificate != nil && opts.PrivateKey != nil {
+		if entity, err = smimeSign(entity, opts); err != nil {
+			return nil, fmt.Errorf("S/MIME signing failed: %w", err)
+		}
+	}
+	if len(opts.EncryptTo) > 0 {
+		if entity, err = smimeEncrypt(entity, opts.EncryptTo); err != nil {
+			return nil, fmt.Errorf("S/MIME encryption failed: %w", err)
+		}
+	}
+	return entity, nil
+}
+
+// smimeSign returns a multipart/signed entity (RFC 8551) whose first part is
+// entity byte for byte and whose second part is the detached signature
+func smimeSign(entity []byte, opts *SMIMEOptions) ([]byte, error) {
+	sd, err := pkcs7.NewSignedData(entity)
+	if err != nil {
+		return nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.AddSignerChain(opts.Certificate, opts.PrivateKey, opts.Chain, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, err
+	}
+	sd.Detach()
+	signature, err := sd.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	boundary := newMIMEBoundary()
+	var h message.Header
+	h.SetContentType("multipart/signed", map[string]string{
+		"protocol": "application/pkcs7-signature",
+		"micalg":   "sha-256",
+		"boundary": boundary,
+	})
+
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, h.Header); err != nil {
+		return nil, err
+	}
+	buf.WriteString("This is an S/MIME signed message\r\n")
+	buf.WriteString("--" + boundary + "\r\n")
+	// ✅ The CRLF before the next delimiter belongs to the delimiter, not to the signed part
+	buf.Write(entity)
+	buf.WriteString("\r\n--" + boundary + "\r\n")
+	if err := writeSMIMEPart(&buf, "application/pkcs7-signature", nil, "smime.p7s", signature); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\r\n--" + boundary + "--\r\n")
+	return buf.Bytes(), nil
+}
+
+// smimeEncrypt returns an application/pkcs7-mime enveloped-data entity that
+// only the holders of the recipients' private keys can open
+func smimeEncrypt(entity []byte, recipients []*x509.Certificate) ([]byte, error) {
+	enveloped, err := pkcs7.Encrypt(entity, recipients)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeSMIMEPart(&buf, "application/pkcs7-mime", map[string]string{"smime-type": "enveloped-data"}, "smime.p7m", enveloped); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeSMIMEPart writes a base64 entity the way RFC 8551 names its parts
+func writeSMIMEPart(buf *bytes.Buffer, contentType string, params map[string]string, filename string, data []byte) error {
+	if params == nil {
+		params = map[string]string{}
+	}
+	params["name"] = filename
+
+	var h message.Header
+	h.SetContentType(contentType, params)
+	h.SetContentDisposition("attachment", map[string]string{"filename": filename})
+	h.Set("Content-Transfer-Encoding", "base64")
+	if err := textproto.WriteHeader(buf, h.Header); err != nil {
+		return err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded)
+	return nil
+}
+
+// joinEntity writes the message header h followed by entity, moving the
+// entity's own header fields (Content-Type and friends) into the message header
+func joinEntity(h message.Header, entity []byte) ([]byte, error) {
+	br := bufio.NewReader(bytes.NewReader(entity))
+	eh, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read entity header: %w", err)
+	}
+	fields := eh.Fields()
+	for fields.Next() {
+		h.Add(fields.Key(), fields.Value())
+	}
+
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, h.Header); err != nil {
+		return nil, err
+	}
+	if _, err := br.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// canonicalCRLF turns every line ending into CRLF, the form S/MIME signs
+func canonicalCRLF(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
+
+// newMIMEBoundary returns a random multipart boundary
+func newMIMEBoundary() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "smime-" + hex.EncodeToString(b)
+}
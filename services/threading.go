@@ -0,0 +1,76 @@
+package services
+
+import (
+	"email-client/models"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var messageIDPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+// threadIDFor names the conversation a message belongs to: the first entry of
+// References (the thread root), else the message it replies to, else itself.
+// Messages without any Message-ID form a thread of their own.
+func threadIDFor(env *models.IndexedMessage) string {
+	if len(env.References) > 0 {
+		return env.References[0]
+	}
+	if env.InReplyTo != "" {
+		return env.InReplyTo
+	}
+	if env.MessageID != "" {
+		return env.MessageID
+	}
+	return fmt.Sprintf("%s:%d:%d", env.Mailbox, env.UIDValidity, env.UID)
+}
+
+// parseMessageIDList pulls the Message-IDs out of an In-Reply-To or References value
+func parseMessageIDList(value string) []string {
+	var ids []string
+	for _, id := range messageIDPattern.FindAllString(value, -1) {
+		ids = append(ids, normalizeMessageID(id))
+	}
+	return ids
+}
+
+// firstMessageID returns the first Message-ID of an In-Reply-To value
+func firstMessageID(value string) string {
+	if ids := parseMessageIDList(value); len(ids) > 0 {
+		return ids[0]
+	}
+	return normalizeMessageID(value)
+}
+
+// groupThreads folds a newest-first listing into threads, ordered by their latest message
+func groupThreads(messages []models.Message) []models.Thread {
+	var threads []models.Thread
+	byID := make(map[string]int)
+	for _, m := range messages {
+		id := m.ThreadID
+		if id == "" {
+			id = m.ID
+		}
+		i, ok := byID[id]
+		if !ok {
+			i = len(threads)
+			byID[id] = i
+			threads = append(threads, models.Thread{ID: id, Latest: m})
+		}
+		threads[i].Messages = append(threads[i].Messages, m)
+	}
+	for i := range threads {
+		finishThread(&threads[i])
+	}
+	return threads
+}
+
+// finishThread fills in the subject and reply count once all messages are collected
+func finishThread(t *models.Thread) {
+	if len(t.Messages) == 0 {
+		return
+	}
+	t.Latest = t.Messages[0]
+	t.Subject = strings.TrimSpace(t.Messages[len(t.Messages)-1].Subject)
+	t.ReplyCount = len(t.Messages) - 1
+}